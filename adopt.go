@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+// adoptRancherCert imports the certificate with the configured name from
+// Rancher into the local storage, so that it is renewed instead of issuing
+// a new certificate. Returns nil if there is no such certificate in Rancher.
+func (c *Context) adoptRancherCert() (*letsencrypt.AcmeCertificate, error) {
+	rancherCert, err := c.Rancher.FindCertByName(c.CertificateName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not lookup certificate in Rancher API: %v", err)
+	}
+	if rancherCert == nil {
+		return nil, nil
+	}
+
+	certPEM, keyPEM, err := rancherCertBundle(rancherCert)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Adopting certificate '%s' with serial %s from Rancher", c.CertificateName, rancherCert.SerialNumber)
+
+	minValidity := time.Duration(c.RenewalPeriodDays) * 24 * time.Hour
+	return c.Acme.ImportCertificate(c.CertificateName, c.Domains, certPEM, keyPEM, minValidity)
+}
+
+// recoveryRefusedError is returned if a certificate of another manager
+// instance was found, but may not be taken over
+type recoveryRefusedError struct {
+	error
+}
+
+// recoverRancherCert restores the local certificate from a certificate created
+// by this manager in one of the Rancher targets, e.g. after the storage volume
+// was lost. The certificate must be marked with the configured domains and CA,
+// and its serial number must match the serial number recorded by Rancher.
+// Returns nil if there is no such certificate.
+func (c *Context) recoverRancherCert() (*letsencrypt.AcmeCertificate, error) {
+	var refused error
+	for _, target := range c.Targets {
+		rancherCert, err := target.Client.FindCertByName(c.CertificateName)
+		if err != nil {
+			return nil, fmt.Errorf("Could not lookup certificate in Rancher API: %v", err)
+		}
+		if rancherCert == nil {
+			continue
+		}
+
+		owner := parseOwnership(rancherCert.Description)
+		if owner == nil || owner.ManagedBy != MANAGED_BY {
+			logrus.Debugf("[%s] Not recovering certificate '%s': Not created by this manager", target.Name, c.CertificateName)
+			continue
+		}
+		// Certificates created by versions without ownership metadata are validated on import only
+		legacy := len(owner.Domains) == 0
+		if !legacy && (!sameDomains(owner.Domains, c.Domains) || owner.CA != strings.ToLower(c.Acme.ApiVersion())) {
+			logrus.Infof("[%s] Not recovering certificate '%s': Domains or CA changed", target.Name, c.CertificateName)
+			continue
+		}
+		if err := c.recoveryError(owner); err != nil {
+			refused = recoveryRefusedError{fmt.Errorf("[%s] %v", target.Name, err)}
+			continue
+		}
+
+		certPEM, keyPEM, err := rancherCertBundle(rancherCert)
+		if err != nil {
+			return nil, err
+		}
+		serial, err := letsencrypt.PEMCertSerialNumber(certPEM)
+		if err != nil {
+			return nil, err
+		}
+		if serial != rancherCert.SerialNumber {
+			return nil, fmt.Errorf("Serial number %s of the certificate does not match %s recorded by Rancher", serial, rancherCert.SerialNumber)
+		}
+
+		logrus.Infof("[%s] Recovering certificate '%s' with serial %s from Rancher", target.Name, c.CertificateName, serial)
+		acmeCert, err := c.Acme.ImportCertificate(c.CertificateName, c.Domains, certPEM, keyPEM, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.recoverInstanceId(owner); err != nil {
+			return nil, err
+		}
+		return acmeCert, nil
+	}
+
+	return nil, refused
+}
+
+// recoveryError returns an error if the certificate of the owner must not be recovered.
+// If the instance ID was generated in this run, it was most likely lost along with the
+// certificate, so that certificates of other instances are recovered as well.
+func (c *Context) recoveryError(owner *Ownership) error {
+	if c.ownedByThis(owner) || c.instanceIdGenerated {
+		return nil
+	}
+	return c.adoptionError(owner)
+}
+
+// recoverInstanceId takes over the instance ID of the owner of a recovered certificate
+// if the ID of this instance was generated in this run. An instance with a loaded or
+// configured ID keeps it when adopting a certificate, so that two running instances
+// never share an ID; the ownership metadata is rewritten when the targets are synchronized.
+func (c *Context) recoverInstanceId(owner *Ownership) error {
+	if !c.instanceIdGenerated || len(owner.InstanceId) == 0 || owner.InstanceId == c.InstanceId {
+		return nil
+	}
+	if err := saveInstanceId(c.Storage, owner.InstanceId); err != nil {
+		return err
+	}
+	logrus.Infof("Recovered manager instance ID %s", owner.InstanceId)
+	c.InstanceId = owner.InstanceId
+	return nil
+}
+
+// rancherCertBundle returns the PEM encoded certificate chain and private key of a Rancher certificate
+func rancherCertBundle(rancherCert *rancherClient.Certificate) ([]byte, []byte, error) {
+	if len(rancherCert.Key) == 0 {
+		return nil, nil, fmt.Errorf("Rancher API did not return the private key")
+	}
+
+	certPEM := strings.TrimSpace(rancherCert.Cert) + "\n"
+	if chain := strings.TrimSpace(rancherCert.CertChain); len(chain) > 0 && !strings.Contains(certPEM, chain) {
+		certPEM += chain + "\n"
+	}
+
+	return []byte(certPEM), []byte(rancherCert.Key), nil
+}
+
+// sameDomains returns true if both lists contain the same domains in any order
+func sameDomains(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := map[string]bool{}
+	for _, domain := range a {
+		set[domain] = true
+	}
+	for _, domain := range b {
+		if !set[domain] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+// Command is a maintenance operation invoked from the command line
+type Command struct {
+	Usage       string
+	Description string
+	Run         func(c *Context, args []string) error
+	// Standalone commands run without initializing the context
+	Standalone bool
+}
+
+var commands = map[string]Command{
+	"account": Command{
+		Usage:       "account <show|update-contacts|rollover-key|deactivate> [email,...]",
+		Description: "Manage the Let's Encrypt account registration",
+		Run:         accountCommand,
+	},
+	"import": Command{
+		Usage:       "import <certbot|lego> <path> [-overwrite]",
+		Description: "Import accounts and certificates from certbot or lego",
+		Run:         importCommand,
+		Standalone:  true,
+	},
+	"history": Command{
+		Usage:       "history [name]",
+		Description: "List the archived versions of a certificate",
+		Run:         historyCommand,
+	},
+	"rollback": Command{
+		Usage:       "rollback [name] [serial] [-hold=<hours>]",
+		Description: "Restore a previous version of a certificate and update load balancers",
+		Run:         rollbackCommand,
+	},
+	"rekey": Command{
+		Usage:       "rekey",
+		Description: "Re-encrypt stored private keys with NEW_ENCRYPTION_PASSPHRASE or NEW_ENCRYPTION_KEY_FILE",
+		Run:         rekeyCommand,
+		Standalone:  true,
+	},
+}
+
+// RunCommand executes the named command and exits the process
+func (c *Context) RunCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage()
+		os.Exit(2)
+	}
+
+	if !cmd.Standalone {
+		c.InitContext()
+		// Deferred until elected with leader election, but commands run on their own
+		if c.Acme == nil {
+			c.InitAcme()
+		}
+	}
+
+	if err := cmd.Run(c, args[1:]); err != nil {
+		logrus.Fatalf("%s: %v", args[0], err)
+	}
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-60s %s\n", commands[name].Usage, commands[name].Description)
+	}
+}
+
+func accountCommand(c *Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Missing account operation")
+	}
+
+	switch args[0] {
+	case "show":
+		reg, err := c.Acme.QueryRegistration()
+		if err != nil {
+			return err
+		}
+		acc := c.Acme.Account()
+		fmt.Printf("Account:  %s\n", acc.Email)
+		fmt.Printf("Status:   %s\n", acc.Status)
+		fmt.Printf("URI:      %s\n", reg.URI)
+		fmt.Printf("Contacts: %s\n", strings.Join(reg.Body.Contact, ", "))
+		fmt.Printf("Terms:    %s\n", reg.Body.Agreement)
+		return nil
+	case "update-contacts":
+		emails := c.Acme.Account().ContactEmails()
+		if len(args) > 1 {
+			emails = listToSlice(args[1])
+		}
+		return c.Acme.UpdateContacts(emails)
+	case "rollover-key":
+		return c.Acme.RolloverKey()
+	case "deactivate":
+		return c.Acme.DeactivateAccount()
+	}
+
+	return fmt.Errorf("Unknown account operation: %s", args[0])
+}
+
+func importCommand(c *Context, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Missing import source")
+	}
+
+	overwrite := len(args) > 2 && args[2] == "-overwrite"
+	c.InitStorage()
+
+	var summary *letsencrypt.ImportSummary
+	var err error
+	switch args[0] {
+	case "certbot":
+		summary, err = letsencrypt.ImportCertbot(c.Storage, args[1], overwrite)
+	case "lego":
+		summary, err = letsencrypt.ImportLego(c.Storage, args[1], overwrite)
+	default:
+		return fmt.Errorf("Unknown import source: %s", args[0])
+	}
+
+	if summary != nil {
+		logrus.Infof("Imported %d account(s) and %d certificate(s)", len(summary.Accounts), len(summary.Certificates))
+	}
+	return err
+}
+
+func rekeyCommand(c *Context, args []string) error {
+	newKek, err := letsencrypt.NewKeyEncryptionKey(getEnvOption("NEW_ENCRYPTION_PASSPHRASE", false),
+		getEnvOption("NEW_ENCRYPTION_KEY_FILE", false))
+	if err != nil {
+		return err
+	}
+	if newKek == nil {
+		return fmt.Errorf("NEW_ENCRYPTION_PASSPHRASE or NEW_ENCRYPTION_KEY_FILE must be set")
+	}
+
+	c.InitStorage()
+	storage, ok := c.Storage.(*letsencrypt.EncryptedStorage)
+	if !ok {
+		// Encrypt plaintext key material for the first time
+		storage = letsencrypt.NewEncryptedStorage(c.Storage, nil)
+	}
+
+	count, err := storage.Rekey(newKek)
+	logrus.Infof("Rekeyed %d object(s)", count)
+	if err != nil {
+		if count > 0 {
+			logrus.Error("Rekey was interrupted: Run it again to complete it. Meanwhile, set ENCRYPTION_PREVIOUS_PASSPHRASE " +
+				"or ENCRYPTION_PREVIOUS_KEY_FILE to the old key to read all objects")
+		}
+		return err
+	}
+
+	logrus.Info("Update ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE to the new key before restarting the service")
+	return nil
+}
+
+func historyCommand(c *Context, args []string) error {
+	certName := c.CertificateName
+	if len(args) > 0 {
+		certName = args[0]
+	}
+
+	history, err := c.Acme.CertificateHistory(certName)
+	if err != nil {
+		return err
+	}
+
+	ok, current := c.Acme.GetStoredCertificate(certName, c.Domains)
+	for _, version := range history {
+		marker := " "
+		if ok && version.SerialNumber == current.SerialNumber {
+			marker = "*"
+		}
+		fmt.Printf("%s %-40s expires %s  %s\n", marker, version.SerialNumber,
+			version.ExpiryDate.UTC().Format(time.UnixDate), strings.Replace(version.DnsNames, "|", ",", -1))
+	}
+	return nil
+}
+
+func rollbackCommand(c *Context, args []string) error {
+	var serial string
+	hold := c.RollbackRenewalHold
+	var positional []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-hold=") {
+			positional = append(positional, arg)
+			continue
+		}
+		hours, err := strconv.Atoi(strings.TrimPrefix(arg, "-hold="))
+		if err != nil || hours < 0 {
+			return fmt.Errorf("Invalid renewal hold '%s'", arg)
+		}
+		hold = time.Duration(hours) * time.Hour
+	}
+	if len(positional) > 0 {
+		c.CertificateName = positional[0]
+	}
+	if len(positional) > 1 {
+		serial = positional[1]
+	}
+
+	return c.rollback(serial, hold)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/kubernetes"
 	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
 	"github.com/janeczku/rancher-letsencrypt/rancher"
 )
@@ -16,11 +20,24 @@ const (
 	ISSUER_PRODUCTION   = "Let's Encrypt"
 	ISSUER_STAGING      = "fake CA"
 	RENEWAL_PERIOD_DAYS = 20
+
+	RECONCILE_INTERVAL_MINUTES = 15
 )
 
 type Context struct {
-	Acme    *letsencrypt.Client
+	Acme *letsencrypt.Client
+	// Optional client rehearsing new domain sets with the staging CA
+	Staging *letsencrypt.Client
 	Rancher *rancher.Client
+	// Rancher environments the certificate is published to,
+	// the environment of Rancher is always the first one
+	Targets []*RancherTarget
+	// Optional client for publishing Kubernetes secrets
+	Kubernetes *kubernetes.Client
+	Storage    letsencrypt.Storage
+	Export     letsencrypt.ExportOpts
+	Hooks      HookOpts
+	Rollout    RolloutOpts
 
 	CertificateName   string
 	Domains           []string
@@ -28,16 +45,95 @@ type Context struct {
 	RenewalPeriodDays int
 	RunOnce           bool
 
-	ExpiryDate    time.Time
-	RancherCertId string
+	// Timezone of RenewalDayTime and the schedules
+	Location *time.Location
+	// Optional schedules restricting renewals and updates of Rancher certificates
+	RenewalSchedule     Schedule
+	RolloutSchedule     Schedule
+	rolloutPending      bool
+	rolloutPendingSince time.Time
+	rolloutNow          bool
+	// A rejected certificate is being reverted, no further revert is attempted
+	reverting bool
+
+	RancherSecrets    bool
+	RancherSecretName string
+	KubernetesSecret  KubernetesSecretOpts
+
+	ExpiryDate time.Time
+	// Renewal postponed because of a rate limit of the CA or a reverted rollout
+	RenewalDeferredUntil time.Time
+	// Renew when this percentage of the validity period remains instead of RenewalPeriodDays
+	RenewalLifetimePercent int
+	// Use the renewal window suggested by the CA if it supports renewal information
+	RenewalInfo bool
+	// Maximum random delay of renewals, spreading them across certificates
+	RenewalJitter time.Duration
+	renewal       renewalState
+	// Time a version restored by the rollback command is not renewed
+	RollbackRenewalHold time.Duration
+
+	// ID of this manager instance, stamped into the managed certificates
+	InstanceId          string
+	instanceIdGenerated bool
+	// Take over certificates not created by this instance
+	Adopt bool
+
+	// React to changes in Rancher as they happen
+	WatchEvents bool
+	// Interval of the periodic comparison with Rancher, 0 to disable
+	ReconcileInterval time.Duration
+
+	// Verification of the certificate served by the endpoints
+	Verify    VerifyOpts
+	verifyNow chan struct{}
+	// State reported by the health endpoint and metrics served on StatusPort
+	Status     *Status
+	StatusPort int
 
 	Debug    bool
 	TestMode bool
+
+	// Issue from the staging CA into throwaway storage and only report other changes
+	DryRun         bool
+	dryRunDir      string
+	plannedChanges []string
+
+	// Issue certificates without the domains failing validation
+	PartialIssuance      bool
+	PartialRetryInterval time.Duration
+
+	// Splitting of the domains into several certificates
+	Split SplitOpts
+	// Names of all certificates the domains are split into
+	ShardGroup []string
+
+	// Election of the replica managing the certificates
+	Leader LeaderOpts
+	// Settings of the ACME clients, which are only created by the leader
+	acmeOpts acmeOpts
+
+	// Guards the certificate state against concurrent reconciliation,
+	// shared by all certificates the domains are split into
+	mu *sync.Mutex
+}
+
+// acmeOpts holds the settings the ACME clients are created with
+type acmeOpts struct {
+	accountName      string
+	emails           []string
+	keyType          letsencrypt.KeyType
+	apiVersion       letsencrypt.ApiVersion
+	dnsResolvers     []string
+	providerOpts     letsencrypt.ProviderOpts
+	historyRetention string
+	stagingRehearsal bool
 }
 
 // InitContext initializes the application context from environmental variables
 func (c *Context) InitContext() {
 	var err error
+	c.mu = &sync.Mutex{}
 	c.Debug = debug
 	c.TestMode = testMode
 	cattleUrl := getEnvOption("CATTLE_URL", true)
@@ -46,6 +142,7 @@ func (c *Context) InitContext() {
 	eulaParam := getEnvOption("EULA", false)
 	apiVerParam := getEnvOption("API_VERSION", true)
 	emailParam := getEnvOption("EMAIL", true)
+	accountParam := getEnvOption("ACCOUNT_NAME", false)
 	domainParam := getEnvOption("DOMAINS", true)
 	keyTypeParam := getEnvOption("PUBLIC_KEY_TYPE", true)
 	certNameParam := getEnvOption("CERT_NAME", true)
@@ -54,6 +151,7 @@ func (c *Context) InitContext() {
 	resolversParam := getEnvOption("DNS_RESOLVERS", false)
 	renewalDays := getEnvOption("RENEWAL_PERIOD_DAYS", false)
 	runOnce := getEnvOption("RUN_ONCE", false)
+	historyRetention := getEnvOption("CERT_HISTORY_RETENTION", false)
 
 	if b, err := strconv.ParseBool(runOnce); err == nil {
 		c.RunOnce = b
@@ -61,6 +159,19 @@ func (c *Context) InitContext() {
 		c.RunOnce = false
 	}
 
+	if b, err := strconv.ParseBool(getEnvOption("RANCHER_EVENTS", false)); err == nil {
+		c.WatchEvents = b
+	}
+
+	c.ReconcileInterval = RECONCILE_INTERVAL_MINUTES * time.Minute
+	if reconcile := getEnvOption("RECONCILE_INTERVAL", false); len(reconcile) > 0 {
+		i, err := strconv.Atoi(reconcile)
+		if err != nil || i < 0 {
+			logrus.Fatalf("Invalid value for RECONCILE_INTERVAL: %s", reconcile)
+		}
+		c.ReconcileInterval = time.Duration(i) * time.Minute
+	}
+
 	if i, err := strconv.Atoi(renewalDays); err == nil {
 		c.RenewalPeriodDays = i
 	} else {
@@ -91,14 +202,21 @@ func (c *Context) InitContext() {
 	if err != nil || c.RenewalDayTime < 0 || c.RenewalDayTime > 23 {
 		logrus.Fatalf("Invalid value for RENEWAL_TIME: %s", dayTimeParam)
 	}
+	c.InitSchedules()
+	c.InitRenewal()
 
 	apiVersion := letsencrypt.ApiVersion(apiVerParam)
+	c.DryRun = getEnvBool("DRY_RUN")
+	if c.DryRun {
+		apiVersion = letsencrypt.Sandbox
+	}
 	keyType := letsencrypt.KeyType(keyTypeParam)
 
 	c.Rancher, err = rancher.NewClient(cattleUrl, cattleApiKey, cattleSecretKey)
 	if err != nil {
 		logrus.Fatalf("Could not connect to Rancher API: %v", err)
 	}
+	c.InitTargets(cattleApiKey, cattleSecretKey)
 
 	providerOpts := letsencrypt.ProviderOpts{
 		Provider:             letsencrypt.Provider(providerParam),
@@ -128,13 +246,62 @@ func (c *Context) InitContext() {
 		NS1ApiKey:            getEnvOption("NS1_API_KEY", false),
 	}
 
-	c.Acme, err = letsencrypt.NewClient(emailParam, keyType, apiVersion, dnsResolvers, providerOpts)
-	if err != nil {
-		logrus.Fatalf("LetsEncrypt client: %v", err)
+	emails := listToSlice(emailParam)
+	c.InitStorage()
+	if c.DryRun {
+		c.initDryRunStorage()
+	} else {
+		c.InitLeader()
+	}
+	if c.Leader.Enabled && providerOpts.Provider == letsencrypt.HTTP {
+		providerOpts.HTTPStorage = c.Storage
+		c.Leader.HTTPChallenges = letsencrypt.NewSharedHTTPProvider(c.Storage)
+	}
+
+	c.acmeOpts = acmeOpts{
+		accountName:      accountParam,
+		emails:           emails,
+		keyType:          keyType,
+		apiVersion:       apiVersion,
+		dnsResolvers:     dnsResolvers,
+		providerOpts:     providerOpts,
+		historyRetention: historyRetention,
+		stagingRehearsal: getEnvBool("STAGING_REHEARSAL") && apiVersion == letsencrypt.Production,
+	}
+	// Followers must not register accounts or change them, see Run
+	if !c.Leader.Enabled {
+		c.InitAcme()
+	}
+
+	c.InstanceId = getEnvOption("INSTANCE_ID", false)
+	if strings.ContainsAny(c.InstanceId, " \t[]") {
+		logrus.Fatalf("Invalid value for INSTANCE_ID: %s", c.InstanceId)
+	}
+	if len(c.InstanceId) == 0 {
+		c.InstanceId, c.instanceIdGenerated, err = loadInstanceId(c.Storage)
+		if err != nil {
+			logrus.Fatalf("Could not load instance ID: %v", err)
+		}
+	}
+	if b, err := strconv.ParseBool(getEnvOption("ADOPT_CERTIFICATE", false)); err == nil {
+		c.Adopt = b
+	}
+
+	c.InitExport()
+	c.InitRancherSecrets()
+	c.InitKubernetes()
+	c.InitHooks()
+	c.InitRollout()
+	c.InitStatus()
+	c.InitSplit()
+
+	c.PartialIssuance = getEnvBool("PARTIAL_ISSUANCE")
+	c.PartialRetryInterval = PARTIAL_RETRY_INTERVAL_MINUTES * time.Minute
+	if interval := getEnvInt("PARTIAL_RETRY_INTERVAL"); interval > 0 {
+		c.PartialRetryInterval = time.Duration(interval) * time.Minute
 	}
 
 	logrus.Infof("Using Let's Encrypt %s API", apiVersion)
-	c.Acme.EnableLogs()
 
 	// Enable debug mode
 	if c.Debug {
@@ -142,6 +309,332 @@ func (c *Context) InitContext() {
 	}
 }
 
+// InitAcme creates the ACME clients, which registers the account with the CA
+// or updates its contacts if necessary
+func (c *Context) InitAcme() {
+	opts := c.acmeOpts
+	var err error
+	c.Acme, err = letsencrypt.NewClient(c.Storage, opts.accountName, opts.emails, opts.keyType, opts.apiVersion, opts.dnsResolvers, opts.providerOpts)
+	if err != nil {
+		logrus.Fatalf("LetsEncrypt client: %v", err)
+	}
+
+	if i, err := strconv.Atoi(opts.historyRetention); err == nil {
+		c.Acme.SetHistoryRetention(i)
+	}
+
+	c.initRateLimits(opts.apiVersion)
+
+	if opts.stagingRehearsal {
+		c.Staging = newStagingClient(c.Storage, opts.accountName, opts.emails, opts.keyType, opts.dnsResolvers, opts.providerOpts)
+	}
+	c.Acme.EnableLogs()
+}
+
+// InitStorage initializes the storage backend from environmental variables
+func (c *Context) InitStorage() {
+	storageOpts := letsencrypt.StorageOpts{
+		Backend:       letsencrypt.StorageBackend(getEnvOption("STORAGE_BACKEND", false)),
+		Path:          getEnvOption("STORAGE_PATH", false),
+		S3Endpoint:    getEnvOption("S3_ENDPOINT", false),
+		S3Region:      getEnvOption("S3_REGION", false),
+		S3Bucket:      getEnvOption("S3_BUCKET", false),
+		S3Prefix:      getEnvOption("S3_PREFIX", false),
+		S3AccessKey:   getEnvOption("S3_ACCESS_KEY", false),
+		S3SecretKey:   getEnvOption("S3_SECRET_KEY", false),
+		ConsulAddress: getEnvOption("CONSUL_ADDRESS", false),
+		ConsulPrefix:  getEnvOption("CONSUL_PREFIX", false),
+		ConsulToken:   getEnvOption("CONSUL_TOKEN", false),
+
+		EncryptionPassphrase: getEnvOption("ENCRYPTION_PASSPHRASE", false),
+		EncryptionKeyFile:    getEnvOption("ENCRYPTION_KEY_FILE", false),
+
+		PreviousEncryptionPassphrase: getEnvOption("ENCRYPTION_PREVIOUS_PASSPHRASE", false),
+		PreviousEncryptionKeyFile:    getEnvOption("ENCRYPTION_PREVIOUS_KEY_FILE", false),
+	}
+
+	storage, err := letsencrypt.NewStorage(storageOpts)
+	if err != nil {
+		logrus.Fatalf("Could not initialize storage: %v", err)
+	}
+
+	logrus.Infof("Using storage %s", storage)
+	c.Storage = storage
+}
+
+// InitLeader configures the leader election from environmental variables
+func (c *Context) InitLeader() {
+	c.Leader.Enabled = getEnvBool("LEADER_ELECTION")
+	if !c.Leader.Enabled {
+		return
+	}
+	c.Leader.Key = leaderKey(c.CertificateName)
+	if err := letsencrypt.ProbeVersionedStorage(c.Storage, c.Leader.Key); err != nil {
+		logrus.Fatalf("Storage does not support leader election: %v", err)
+	}
+
+	c.Leader.LeaseDuration = LEADER_LEASE_SECONDS * time.Second
+	if seconds := getEnvInt("LEADER_LEASE_DURATION"); seconds > 0 {
+		if seconds < LEADER_LEASE_MIN_SECONDS {
+			logrus.Fatalf("Invalid value for LEADER_LEASE_DURATION: Must be at least %d seconds", LEADER_LEASE_MIN_SECONDS)
+		}
+		c.Leader.LeaseDuration = time.Duration(seconds) * time.Second
+	}
+	c.Leader.RetryPeriod = c.Leader.LeaseDuration / 3
+	c.Leader.Holder = newLeaderHolder()
+	logrus.Infof("Leader election enabled for replica %s", c.Leader.Holder)
+}
+
+// InitExport configures the export of certificate files from environmental variables
+func (c *Context) InitExport() {
+	formatsParam := getEnvOption("EXPORT_FORMATS", false)
+	if len(formatsParam) == 0 {
+		return
+	}
+
+	opts := letsencrypt.ExportOpts{
+		Dir:      getEnvOption("EXPORT_DIR", false),
+		Password: getEnvOption("EXPORT_PASSWORD", false),
+		Uid:      -1,
+		Gid:      -1,
+		Mode:     0600,
+	}
+
+	for _, format := range listToSlice(formatsParam) {
+		opts.Formats = append(opts.Formats, letsencrypt.ExportFormat(format))
+	}
+
+	if len(opts.Dir) == 0 {
+		fileStorage, ok := c.Storage.(*letsencrypt.FileStorage)
+		if !ok {
+			logrus.Fatalf("EXPORT_DIR must be set when not using the file storage backend")
+		}
+		opts.Dir = filepath.Join(fileStorage.Root(), "export")
+	}
+
+	if owner := getEnvOption("EXPORT_OWNER", false); len(owner) > 0 {
+		parts := strings.SplitN(owner, ":", 2)
+		uid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			logrus.Fatalf("Invalid value for EXPORT_OWNER: %s", owner)
+		}
+		opts.Uid = uid
+		if len(parts) == 2 {
+			gid, err := strconv.Atoi(parts[1])
+			if err != nil {
+				logrus.Fatalf("Invalid value for EXPORT_OWNER: %s", owner)
+			}
+			opts.Gid = gid
+		}
+	}
+
+	if mode := getEnvOption("EXPORT_MODE", false); len(mode) > 0 {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			logrus.Fatalf("Invalid value for EXPORT_MODE: %s", mode)
+		}
+		opts.Mode = os.FileMode(m)
+	}
+
+	logrus.Infof("Exporting certificates as %s to %s", formatsParam, opts.Dir)
+	c.Export = opts
+}
+
+// InitRancherSecrets configures the publishing of Rancher secrets from environmental variables
+func (c *Context) InitRancherSecrets() {
+	if b, err := strconv.ParseBool(getEnvOption("RANCHER_SECRETS", false)); err == nil {
+		c.RancherSecrets = b
+	}
+
+	c.RancherSecretName = getEnvOption("RANCHER_SECRET_NAME", false)
+	if len(c.RancherSecretName) == 0 {
+		c.RancherSecretName = c.CertificateName
+	}
+}
+
+// InitKubernetes configures the publishing of Kubernetes TLS secrets from environmental variables
+func (c *Context) InitKubernetes() {
+	if enabled, _ := strconv.ParseBool(getEnvOption("KUBERNETES_SECRETS", false)); !enabled {
+		return
+	}
+
+	client, err := kubernetes.NewClient(kubernetes.ClientOpts{
+		Url:    getEnvOption("KUBERNETES_URL", false),
+		Token:  getEnvOption("KUBERNETES_TOKEN", false),
+		CAFile: getEnvOption("KUBERNETES_CA_FILE", false),
+	})
+	if err != nil {
+		logrus.Fatalf("Could not initialize Kubernetes client: %v", err)
+	}
+
+	opts := KubernetesSecretOpts{
+		Namespaces:  splitList(getEnvOption("KUBERNETES_SECRET_NAMESPACE", false)),
+		Name:        getEnvOption("KUBERNETES_SECRET_NAME", false),
+		Annotations: map[string]string{},
+		Adopt:       getEnvBool("KUBERNETES_SECRET_ADOPT"),
+	}
+	if len(opts.Namespaces) == 0 {
+		opts.Namespaces = []string{"default"}
+	}
+	if len(opts.Name) == 0 {
+		opts.Name = kubernetesName(c.CertificateName)
+	}
+	for _, annotation := range splitList(getEnvOption("KUBERNETES_SECRET_ANNOTATIONS", false)) {
+		parts := strings.SplitN(annotation, "=", 2)
+		if len(parts) != 2 {
+			logrus.Fatalf("Invalid value for KUBERNETES_SECRET_ANNOTATIONS: %s", annotation)
+		}
+		opts.Annotations[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	logrus.Infof("Publishing Kubernetes secret '%s' to %s", opts.Name, client)
+	c.Kubernetes = client
+	c.KubernetesSecret = opts
+}
+
+// InitHooks configures the post-renewal hooks from environmental variables
+func (c *Context) InitHooks() {
+	c.Hooks = HookOpts{
+		Command:          getEnvOption("HOOK_COMMAND", false),
+		RestartServices:  splitList(getEnvOption("HOOK_RESTART_SERVICES", false)),
+		UpgradeServices:  splitList(getEnvOption("HOOK_UPGRADE_SERVICES", false)),
+		SignalContainers: splitList(getEnvOption("HOOK_SIGNAL_CONTAINERS", false)),
+		Signal:           strings.TrimPrefix(strings.ToUpper(getEnvOption("HOOK_SIGNAL", false)), "SIG"),
+		Timeout:          HOOK_TIMEOUT_SECONDS * time.Second,
+	}
+
+	if len(c.Hooks.Signal) == 0 {
+		c.Hooks.Signal = HOOK_SIGNAL
+	}
+
+	if timeout := getEnvOption("HOOK_TIMEOUT", false); len(timeout) > 0 {
+		i, err := strconv.Atoi(timeout)
+		if err != nil || i <= 0 {
+			logrus.Fatalf("Invalid value for HOOK_TIMEOUT: %s", timeout)
+		}
+		c.Hooks.Timeout = time.Duration(i) * time.Second
+	}
+}
+
+// InitStatus configures the health endpoint and the verification
+// of the deployed certificate from environmental variables
+func (c *Context) InitStatus() {
+	c.Status = newStatus()
+	c.StatusPort = getEnvInt("STATUS_PORT")
+	c.verifyNow = make(chan struct{}, 1)
+
+	c.Verify = VerifyOpts{
+		Port:     VERIFY_PORT,
+		Interval: VERIFY_INTERVAL_MINUTES * time.Minute,
+	}
+	for _, endpoints := range listToSlice(getEnvOption("VERIFY_ENDPOINTS", false)) {
+		switch endpoints {
+		case "domains":
+			c.Verify.Domains = true
+		case "loadbalancers":
+			c.Verify.LoadBalancers = true
+		case "":
+		default:
+			logrus.Fatalf("Invalid value for VERIFY_ENDPOINTS: %s", endpoints)
+		}
+	}
+	if port := getEnvInt("VERIFY_PORT"); port > 0 {
+		c.Verify.Port = port
+	}
+	if interval := getEnvInt("VERIFY_INTERVAL"); interval > 0 {
+		c.Verify.Interval = time.Duration(interval) * time.Minute
+	}
+}
+
+// InitSchedules configures the timezone and the renewal and rollout schedules
+func (c *Context) InitSchedules() {
+	c.Location = time.UTC
+	if tz := getEnvOption("RENEWAL_TIMEZONE", false); len(tz) > 0 {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			logrus.Fatalf("Invalid value for RENEWAL_TIMEZONE: %v", err)
+		}
+		c.Location = loc
+	}
+
+	schedules := map[string]*Schedule{
+		"RENEWAL_SCHEDULE": &c.RenewalSchedule,
+		"ROLLOUT_SCHEDULE": &c.RolloutSchedule,
+	}
+	for name, schedule := range schedules {
+		spec := getEnvOption(name, false)
+		if len(spec) == 0 {
+			continue
+		}
+		s, err := ParseSchedule(spec, c.Location)
+		if err != nil {
+			logrus.Fatalf("Invalid value for %s: %v", name, err)
+		}
+		if s.Next(time.Now()).IsZero() {
+			logrus.Fatalf("Invalid value for %s: Schedule never matches", name)
+		}
+		logrus.Infof("Using %s %s", strings.ToLower(strings.Replace(name, "_", " ", -1)), s)
+		*schedule = s
+	}
+}
+
+// InitRenewal configures how the renewal time is derived from the certificate
+func (c *Context) InitRenewal() {
+	c.RenewalLifetimePercent = getEnvInt("RENEWAL_LIFETIME_PERCENT")
+	if c.RenewalLifetimePercent >= 100 {
+		logrus.Fatalf("Invalid value for RENEWAL_LIFETIME_PERCENT: %d", c.RenewalLifetimePercent)
+	}
+
+	c.RenewalInfo = true
+	if len(getEnvOption("RENEWAL_INFO", false)) > 0 {
+		c.RenewalInfo = getEnvBool("RENEWAL_INFO")
+	}
+
+	c.RenewalJitter = time.Duration(getEnvInt("RENEWAL_JITTER")) * time.Minute
+	rand.Seed(time.Now().UnixNano())
+
+	c.RollbackRenewalHold = REVERT_RENEWAL_DELAY
+	if hours := getEnvInt("ROLLBACK_RENEWAL_HOLD"); hours > 0 {
+		c.RollbackRenewalHold = time.Duration(hours) * time.Hour
+	}
+}
+
+// InitSplit configures the splitting of the domains from environmental variables
+func (c *Context) InitSplit() {
+	c.Split = SplitOpts{
+		Mode:       SplitMode(strings.ToLower(getEnvOption("SPLIT_CERTIFICATES", false))),
+		MaxDomains: SPLIT_MAX_DOMAINS,
+	}
+	switch c.Split.Mode {
+	case SplitNone, SplitByCount, SplitByDomain:
+	default:
+		logrus.Fatalf("Invalid value for SPLIT_CERTIFICATES: %s", c.Split.Mode)
+	}
+	if max := getEnvInt("SPLIT_MAX_DOMAINS"); max > 0 {
+		c.Split.MaxDomains = max
+	}
+}
+
+// InitRollout configures the rollout to load balancers from environmental variables
+func (c *Context) InitRollout() {
+	c.Rollout = RolloutOpts{
+		Canary:        getEnvBool("ROLLOUT_CANARY"),
+		BatchSize:     getEnvInt("ROLLOUT_BATCH_SIZE"),
+		BatchInterval: time.Duration(getEnvInt("ROLLOUT_BATCH_INTERVAL")) * time.Second,
+		Verify:        getEnvBool("ROLLOUT_VERIFY"),
+		VerifyTimeout: ROLLOUT_VERIFY_TIMEOUT_SECONDS * time.Second,
+		Revert:        getEnvBool("ROLLOUT_REVERT"),
+	}
+	if timeout := getEnvInt("ROLLOUT_VERIFY_TIMEOUT"); timeout > 0 {
+		c.Rollout.VerifyTimeout = time.Duration(timeout) * time.Second
+	}
+
+	if c.Rollout.Enabled() {
+		logrus.Infof("Rolling out certificates to load balancers (canary: %t, batch size: %d, verify: %t, revert: %t)",
+			c.Rollout.Canary, c.Rollout.BatchSize, c.Rollout.Verify, c.Rollout.Revert)
+	}
+}
+
 func getEnvOption(name string, required bool) string {
 	val := os.Getenv(name)
 	if required && len(val) == 0 {
@@ -150,7 +643,44 @@ func getEnvOption(name string, required bool) string {
 	return strings.TrimSpace(val)
 }
 
+// getEnvBool returns the boolean value of the named variable, false if not set
+func getEnvBool(name string) bool {
+	val := getEnvOption(name, false)
+	if len(val) == 0 {
+		return false
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		logrus.Fatalf("Invalid value for %s: %s", name, val)
+	}
+	return b
+}
+
+// getEnvInt returns the non-negative integer value of the named variable, 0 if not set
+func getEnvInt(name string) int {
+	val := getEnvOption(name, false)
+	if len(val) == 0 {
+		return 0
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil || i < 0 {
+		logrus.Fatalf("Invalid value for %s: %s", name, val)
+	}
+	return i
+}
+
 func listToSlice(str string) []string {
 	str = strings.ToLower(strings.Join(strings.Fields(str), ""))
 	return strings.Split(str, ",")
 }
+
+// splitList splits a comma separated list preserving case
+func splitList(str string) []string {
+	var list []string
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
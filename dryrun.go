@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+// dryRun issues a certificate from the staging CA into throwaway storage,
+// renews it and reports the changes a real run would make without applying them
+func (c *Context) dryRun() {
+	logrus.Info("Dry run: Issuing certificate from the staging CA, no changes are made")
+	c.startup()
+	if c.issuancePending() {
+		logrus.Infof("Dry run: Certificate request deferred until %s", c.RenewalDeferredUntil.UTC().Format(time.UnixDate))
+		return
+	}
+
+	logrus.Info("Dry run: Renewing certificate")
+	c.renew()
+
+	logrus.Infof("Dry run: Finished, %d planned changes", len(c.plannedChanges))
+	for _, change := range c.plannedChanges {
+		fmt.Fprintln(os.Stdout, "  "+change)
+	}
+}
+
+// initDryRunStorage keeps the configured storage unchanged
+// by writing all changes to a temporary directory instead
+func (c *Context) initDryRunStorage() {
+	dir, err := ioutil.TempDir("", "rancher-letsencrypt-dry-run")
+	if err != nil {
+		logrus.Fatalf("Could not create temporary storage: %v", err)
+	}
+	c.dryRunDir = dir
+	c.Storage = letsencrypt.NewOverlayStorage(c.Storage, letsencrypt.NewFileStorage(dir))
+
+	// The directory holds private keys. Deferred calls are skipped by os.Exit,
+	// so it's removed by an exit handler of logrus.Fatal and logrus.Exit as well.
+	logrus.RegisterExitHandler(c.removeDryRunStorage)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		logrus.Infof("Received %s: Shutting down", sig)
+		logrus.Exit(1)
+	}()
+}
+
+// removeDryRunStorage deletes the temporary directory of the dry run
+func (c *Context) removeDryRunStorage() {
+	if len(c.dryRunDir) == 0 {
+		return
+	}
+	if err := os.RemoveAll(c.dryRunDir); err != nil {
+		logrus.Warnf("Could not remove temporary storage '%s': %v", c.dryRunDir, err)
+	}
+}
+
+// planChange records a change that would be made outside of the throwaway storage
+func (c *Context) planChange(format string, args ...interface{}) {
+	change := fmt.Sprintf(format, args...)
+	logrus.Infof("Dry run: Would %s", change)
+	c.plannedChanges = append(c.plannedChanges, change)
+}
+
+// planPublish records the outputs publishCert would update
+func (c *Context) planPublish() {
+	if c.Export.Enabled() {
+		c.planChange("export certificate to '%s'", c.Export.CertDir(c.CertificateName))
+	}
+	if c.RancherSecrets {
+		c.planChange("replace Rancher secrets '%s-key', '%s-cert', '%s-chain' and '%s-fullchain'",
+			c.RancherSecretName, c.RancherSecretName, c.RancherSecretName, c.RancherSecretName)
+	}
+	if c.Kubernetes != nil {
+		for _, namespace := range c.KubernetesSecret.Namespaces {
+			c.planChange("apply Kubernetes secret %s/%s", namespace, c.KubernetesSecret.Name)
+		}
+	}
+}
+
+// planTarget records the changes syncTarget would make in the Rancher target
+func (c *Context) planTarget(target *RancherTarget, acmeCert *letsencrypt.AcmeCertificate) error {
+	rancherCert, err := target.Client.FindCertByName(c.CertificateName)
+	if err != nil {
+		return fmt.Errorf("Could not lookup certificate in Rancher API: %v", err)
+	}
+
+	if rancherCert == nil {
+		c.planChange("[%s] create certificate '%s' with serial %s", target.Name, c.CertificateName, acmeCert.SerialNumber)
+		return nil
+	}
+
+	if err := c.checkOwnership(target, rancherCert); err != nil {
+		return err
+	}
+
+	if rancherCert.SerialNumber == acmeCert.SerialNumber {
+		logrus.Infof("Dry run: [%s] Rancher certificate '%s' is up to date", target.Name, c.CertificateName)
+		return nil
+	}
+
+	c.planChange("[%s] update certificate '%s' (%s) from serial %s to %s",
+		target.Name, c.CertificateName, rancherCert.Id, rancherCert.SerialNumber, acmeCert.SerialNumber)
+
+	lbs, err := target.Client.LoadBalancerEndpoints(rancherCert.Id)
+	if err != nil {
+		return fmt.Errorf("Could not lookup load balancers: %v", err)
+	}
+	var names []string
+	for name := range lbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) > 0 {
+		c.planChange("[%s] upgrade load balancers %s", target.Name, strings.Join(names, ", "))
+	}
+	return nil
+}
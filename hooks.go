@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+const (
+	HOOK_TIMEOUT_SECONDS = 120
+	HOOK_SIGNAL          = "HUP"
+)
+
+// HookOpts configures the actions run after a certificate has been
+// issued or renewed, to notify consumers other than load balancers
+type HookOpts struct {
+	// Shell command executed locally
+	Command string
+	// Selectors of Rancher services to restart or upgrade
+	RestartServices []string
+	UpgradeServices []string
+	// Selectors of containers to send Signal to
+	SignalContainers []string
+	Signal           string
+	// Maximum duration of each action
+	Timeout time.Duration
+}
+
+// Enabled returns true if any hooks are configured
+func (h HookOpts) Enabled() bool {
+	return len(h.Command) > 0 || len(h.RestartServices) > 0 ||
+		len(h.UpgradeServices) > 0 || len(h.SignalContainers) > 0
+}
+
+// runHooks runs the configured hooks for the certificate. Failing
+// hooks are logged but don't interrupt the certificate management.
+func (c *Context) runHooks(acmeCert *letsencrypt.AcmeCertificate) {
+	if !c.Hooks.Enabled() {
+		return
+	}
+	if c.DryRun {
+		c.planChange("run post-renewal hooks for certificate '%s'", c.CertificateName)
+		return
+	}
+
+	logrus.Infof("Running post-renewal hooks for certificate '%s'", c.CertificateName)
+
+	if len(c.Hooks.Command) > 0 {
+		c.runHookCommand(acmeCert)
+	}
+
+	for _, selector := range c.Hooks.RestartServices {
+		c.restartServices(selector, false)
+	}
+
+	for _, selector := range c.Hooks.UpgradeServices {
+		c.restartServices(selector, true)
+	}
+
+	for _, selector := range c.Hooks.SignalContainers {
+		c.signalContainers(selector)
+	}
+}
+
+func (c *Context) runHookCommand(acmeCert *letsencrypt.AcmeCertificate) {
+	var output bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", c.Hooks.Command)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Run in its own process group so that children are killed on timeout as well
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(),
+		"CERT_NAME="+c.CertificateName,
+		"CERT_DOMAINS="+strings.Replace(acmeCert.DnsNames, "|", ",", -1),
+		"CERT_SERIAL="+acmeCert.SerialNumber,
+		"CERT_EXPIRY_DATE="+acmeCert.ExpiryDate.UTC().Format(time.RFC3339),
+	)
+	if c.Export.Enabled() {
+		cmd.Env = append(cmd.Env, "CERT_EXPORT_DIR="+c.Export.CertDir(c.CertificateName))
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		logrus.Errorf("Failed to run hook command: %v", err)
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(c.Hooks.Timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		logrus.Errorf("Hook command timed out after %s: %s", c.Hooks.Timeout, strings.TrimSpace(output.String()))
+		return
+	}
+
+	if err != nil {
+		logrus.Errorf("Hook command failed: %v: %s", err, strings.TrimSpace(output.String()))
+		return
+	}
+
+	logrus.Infof("Hook command completed in %s", time.Since(start))
+	if output.Len() > 0 {
+		logrus.Debugf("Hook command output: %s", strings.TrimSpace(output.String()))
+	}
+}
+
+func (c *Context) restartServices(selector string, upgrade bool) {
+	action := "restart"
+	if upgrade {
+		action = "upgrade"
+	}
+
+	services, err := c.Rancher.FindServices(selector)
+	if err != nil {
+		logrus.Errorf("Failed to look up services matching '%s': %v", selector, err)
+		return
+	}
+	if len(services) == 0 {
+		logrus.Warnf("No services matching '%s' to %s", selector, action)
+		return
+	}
+
+	for i := range services {
+		service := &services[i]
+		if upgrade {
+			err = c.Rancher.UpgradeService(service, c.Hooks.Timeout)
+		} else {
+			err = c.Rancher.RestartService(service, c.Hooks.Timeout)
+		}
+		if err != nil {
+			logrus.Errorf("Failed to %s service '%s': %v", action, service.Name, err)
+			continue
+		}
+		logrus.Infof("Completed %s of service '%s'", action, service.Name)
+	}
+}
+
+func (c *Context) signalContainers(selector string) {
+	containers, err := c.Rancher.FindContainers(selector)
+	if err != nil {
+		logrus.Errorf("Failed to look up containers matching '%s': %v", selector, err)
+		return
+	}
+	if len(containers) == 0 {
+		logrus.Warnf("No running containers matching '%s' to signal", selector)
+		return
+	}
+
+	for i := range containers {
+		container := &containers[i]
+		output, err := c.Rancher.SignalContainer(container, c.Hooks.Signal, c.Hooks.Timeout)
+		if err != nil {
+			logrus.Errorf("Failed to send signal %s to container '%s': %v", c.Hooks.Signal, container.Name, err)
+			continue
+		}
+		if len(output) > 0 {
+			logrus.Warnf("Signal %s sent to container '%s': %s", c.Hooks.Signal, container.Name, output)
+			continue
+		}
+		logrus.Infof("Sent signal %s to container '%s'", c.Hooks.Signal, container.Name)
+	}
+}
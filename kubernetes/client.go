@@ -0,0 +1,152 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// ClientOpts is used to configure the Kubernetes API client
+type ClientOpts struct {
+	// URL of the API server. Defaults to the in-cluster API server.
+	Url string
+	// Bearer token, defaults to the token of the pod's service account
+	Token string
+	// CA certificate file used to verify the API server
+	CAFile string
+}
+
+// Client is a minimal client for the Kubernetes API
+type Client struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewClient returns a new client for the Kubernetes API
+func NewClient(opts ClientOpts) (*Client, error) {
+	url := opts.Url
+	token := opts.Token
+	caFile := opts.CAFile
+
+	if len(url) == 0 {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if len(host) == 0 || len(port) == 0 {
+			return nil, fmt.Errorf("Kubernetes API URL not set and not running in a cluster")
+		}
+		url = "https://" + net.JoinHostPort(host, port)
+		if len(token) == 0 {
+			data, err := ioutil.ReadFile(serviceAccountDir + "/token")
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read service account token: %v", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		if len(caFile) == 0 {
+			caFile = serviceAccountDir + "/ca.crt"
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	if len(caFile) > 0 {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &Client{
+		url:   strings.TrimRight(url, "/"),
+		token: token,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+// String describes the API server for log messages
+func (k *Client) String() string {
+	return k.url
+}
+
+// apiError is the Status object returned by the API server on errors
+type apiError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Kubernetes API error %d (%s): %s", e.Code, e.Reason, e.Message)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// do sends a request with the JSON encoded body and decodes the response into out
+func (k *Client) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, k.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if method == "PATCH" {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	} else if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(k.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &apiError{Code: resp.StatusCode}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, apiErr) != nil || len(apiErr.Message) == 0 {
+			apiErr.Reason = resp.Status
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,124 @@
+package kubernetes
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+)
+
+const (
+	SecretTypeTLS = "kubernetes.io/tls"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "rancher-letsencrypt"
+)
+
+// ObjectMeta is the subset of the Kubernetes object metadata used by this client
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// Secret is a Kubernetes secret
+type Secret struct {
+	ApiVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
+// GetSecret retrieves a secret, returning nil if it doesn't exist
+func (k *Client) GetSecret(namespace, name string) (*Secret, error) {
+	secret := &Secret{}
+	err := k.do("GET", secretPath(namespace, name), nil, secret)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// ApplyTLSSecret creates or updates a secret of type kubernetes.io/tls holding the PEM
+// encoded certificate chain and private key. Annotations are merged with existing ones.
+// An existing secret without the managed-by label is only updated if adopt is true.
+// Returns true if the secret was created or changed.
+func (k *Client) ApplyTLSSecret(namespace, name string, annotations map[string]string, cert, key []byte, adopt bool) (bool, error) {
+	existing, err := k.GetSecret(namespace, name)
+	if err != nil {
+		return false, err
+	}
+
+	data := map[string][]byte{
+		"tls.crt": cert,
+		"tls.key": key,
+	}
+
+	if existing == nil {
+		secret := &Secret{
+			ApiVersion: "v1",
+			Kind:       "Secret",
+			Metadata: ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Labels:      map[string]string{managedByLabel: managedByValue},
+				Annotations: annotations,
+			},
+			Type: SecretTypeTLS,
+			Data: data,
+		}
+		return true, k.do("POST", secretPath(namespace, ""), secret, nil)
+	}
+
+	if existing.Type != SecretTypeTLS {
+		return false, fmt.Errorf("Secret %s/%s exists with type '%s'", namespace, name, existing.Type)
+	}
+	managed := existing.Metadata.Labels[managedByLabel] == managedByValue
+	if !managed && !adopt {
+		return false, fmt.Errorf("Secret %s/%s exists and is not managed by %s", namespace, name, managedByValue)
+	}
+
+	patch := map[string]interface{}{}
+	metadata := map[string]interface{}{}
+	for file, value := range data {
+		if !bytes.Equal(existing.Data[file], value) {
+			patch["data"] = data
+		}
+	}
+
+	changedAnnotations := map[string]string{}
+	for key, value := range annotations {
+		if existing.Metadata.Annotations[key] != value {
+			changedAnnotations[key] = value
+		}
+	}
+	if len(changedAnnotations) > 0 {
+		metadata["annotations"] = changedAnnotations
+	}
+	if !managed {
+		metadata["labels"] = map[string]string{managedByLabel: managedByValue}
+	}
+	if len(metadata) > 0 {
+		patch["metadata"] = metadata
+	}
+
+	if len(patch) == 0 {
+		return false, nil
+	}
+
+	// A merge patch leaves other keys and metadata of the secret untouched
+	return true, k.do("PATCH", secretPath(namespace, name), patch, nil)
+}
+
+func secretPath(namespace, name string) string {
+	p := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets"
+	if len(name) > 0 {
+		p += "/" + url.PathEscape(name)
+	}
+	return p
+}
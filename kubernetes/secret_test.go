@@ -0,0 +1,312 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAPIServer is a minimal stand-in for the secrets API of a Kubernetes API server
+type fakeAPIServer struct {
+	mu         sync.Mutex
+	namespaces map[string]bool
+	// Secrets as generic JSON objects by namespace/name
+	secrets map[string]map[string]interface{}
+	patches int
+}
+
+func newFakeAPIServer(namespaces ...string) *fakeAPIServer {
+	f := &fakeAPIServer{namespaces: map[string]bool{}, secrets: map[string]map[string]interface{}{}}
+	for _, namespace := range namespaces {
+		f.namespaces[namespace] = true
+	}
+	return f
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		writeStatus(w, http.StatusUnauthorized, "Unauthorized", "Unauthorized")
+		return
+	}
+
+	// /api/v1/namespaces/<namespace>/secrets[/<name>]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) < 2 || parts[1] != "secrets" {
+		writeStatus(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+		return
+	}
+	namespace := parts[0]
+	name := ""
+	if len(parts) > 2 {
+		name = parts[2]
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == "GET" && name != "":
+		secret, ok := f.secrets[namespace+"/"+name]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("secrets \"%s\" not found", name))
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	case r.Method == "POST" && name == "":
+		if !f.namespaces[namespace] {
+			writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("namespaces \"%s\" not found", namespace))
+			return
+		}
+		secret := map[string]interface{}{}
+		if err := json.Unmarshal(body, &secret); err != nil {
+			writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		name = secret["metadata"].(map[string]interface{})["name"].(string)
+		if _, ok := f.secrets[namespace+"/"+name]; ok {
+			writeStatus(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("secrets \"%s\" already exists", name))
+			return
+		}
+		f.secrets[namespace+"/"+name] = secret
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(secret)
+	case r.Method == "PATCH" && name != "":
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			writeStatus(w, http.StatusUnsupportedMediaType, "UnsupportedMediaType", r.Header.Get("Content-Type"))
+			return
+		}
+		secret, ok := f.secrets[namespace+"/"+name]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("secrets \"%s\" not found", name))
+			return
+		}
+		patch := map[string]interface{}{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		mergePatch(secret, patch)
+		f.patches++
+		json.NewEncoder(w).Encode(secret)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to the object
+func mergePatch(object, patch map[string]interface{}) {
+	for key, value := range patch {
+		if value == nil {
+			delete(object, key)
+			continue
+		}
+		patchObject, ok := value.(map[string]interface{})
+		if !ok {
+			object[key] = value
+			continue
+		}
+		target, ok := object[key].(map[string]interface{})
+		if !ok {
+			target = map[string]interface{}{}
+			object[key] = target
+		}
+		mergePatch(target, patchObject)
+	}
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":    "Status",
+		"status":  "Failure",
+		"code":    code,
+		"reason":  reason,
+		"message": message,
+	})
+}
+
+func newTestClient(t *testing.T, fake *fakeAPIServer) (*Client, func()) {
+	server := httptest.NewServer(fake)
+	client, err := NewClient(ClientOpts{Url: server.URL, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server.Close
+}
+
+func TestApplyTLSSecretCreate(t *testing.T) {
+	fake := newFakeAPIServer("default")
+	k, done := newTestClient(t, fake)
+	defer done()
+
+	changed, err := k.ApplyTLSSecret("default", "example", map[string]string{"team": "web"}, []byte("cert"), []byte("key"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("Expected the secret to be created")
+	}
+
+	secret, err := k.GetSecret("default", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == nil {
+		t.Fatal("Secret has not been created")
+	}
+	if secret.Type != SecretTypeTLS {
+		t.Errorf("Expected type %s, got %s", SecretTypeTLS, secret.Type)
+	}
+	if string(secret.Data["tls.crt"]) != "cert" || string(secret.Data["tls.key"]) != "key" {
+		t.Errorf("Unexpected data %q", secret.Data)
+	}
+	if secret.Metadata.Labels[managedByLabel] != managedByValue {
+		t.Errorf("Expected label %s=%s, got %v", managedByLabel, managedByValue, secret.Metadata.Labels)
+	}
+	if secret.Metadata.Annotations["team"] != "web" {
+		t.Errorf("Expected annotation team=web, got %v", secret.Metadata.Annotations)
+	}
+
+	changed, err = k.ApplyTLSSecret("default", "example", map[string]string{"team": "web"}, []byte("cert"), []byte("key"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || fake.patches != 0 {
+		t.Error("Expected an unchanged secret not to be patched")
+	}
+}
+
+func TestApplyTLSSecretPatch(t *testing.T) {
+	fake := newFakeAPIServer("default")
+	fake.secrets["default/example"] = map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":        "example",
+			"namespace":   "default",
+			"labels":      map[string]interface{}{"app": "ingress", managedByLabel: managedByValue},
+			"annotations": map[string]interface{}{"owner": "ops", "team": "db"},
+		},
+		"type": SecretTypeTLS,
+		"data": map[string]interface{}{
+			"tls.crt": "b2xk",
+			"tls.key": "b2xk",
+			"ca.crt":  "Y2E=",
+		},
+	}
+	k, done := newTestClient(t, fake)
+	defer done()
+
+	changed, err := k.ApplyTLSSecret("default", "example", map[string]string{"team": "web"}, []byte("cert"), []byte("key"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || fake.patches != 1 {
+		t.Fatalf("Expected the secret to be patched once, got %d patches", fake.patches)
+	}
+
+	secret, err := k.GetSecret("default", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["tls.crt"]) != "cert" || string(secret.Data["tls.key"]) != "key" {
+		t.Errorf("Unexpected data %q", secret.Data)
+	}
+	if string(secret.Data["ca.crt"]) != "ca" {
+		t.Errorf("Expected other keys to be kept, got %q", secret.Data)
+	}
+	if secret.Metadata.Labels["app"] != "ingress" {
+		t.Errorf("Expected labels to be kept, got %v", secret.Metadata.Labels)
+	}
+	if secret.Metadata.Annotations["owner"] != "ops" || secret.Metadata.Annotations["team"] != "web" {
+		t.Errorf("Expected annotations to be merged, got %v", secret.Metadata.Annotations)
+	}
+}
+
+func TestApplyTLSSecretWrongType(t *testing.T) {
+	fake := newFakeAPIServer("default")
+	fake.secrets["default/example"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "example"},
+		"type":     "Opaque",
+	}
+	k, done := newTestClient(t, fake)
+	defer done()
+
+	if _, err := k.ApplyTLSSecret("default", "example", nil, []byte("cert"), []byte("key"), false); err == nil {
+		t.Error("Expected an error for a secret of another type")
+	}
+	if fake.patches != 0 {
+		t.Error("Expected the secret not to be patched")
+	}
+}
+
+func TestApplyTLSSecretNotManaged(t *testing.T) {
+	fake := newFakeAPIServer("default")
+	fake.secrets["default/example"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "example", "labels": map[string]interface{}{"app": "ingress"}},
+		"type":     SecretTypeTLS,
+		"data":     map[string]interface{}{"tls.crt": "b2xk", "tls.key": "b2xk"},
+	}
+	k, done := newTestClient(t, fake)
+	defer done()
+
+	if _, err := k.ApplyTLSSecret("default", "example", nil, []byte("cert"), []byte("key"), false); err == nil {
+		t.Error("Expected an error for a secret not managed by this manager")
+	}
+	if fake.patches != 0 {
+		t.Fatal("Expected the secret not to be patched")
+	}
+
+	changed, err := k.ApplyTLSSecret("default", "example", nil, []byte("cert"), []byte("key"), true)
+	if err != nil || !changed {
+		t.Fatalf("Expected the secret to be adopted, got %v, %v", changed, err)
+	}
+	secret, err := k.GetSecret("default", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["tls.crt"]) != "cert" {
+		t.Errorf("Unexpected data %q", secret.Data)
+	}
+	if secret.Metadata.Labels[managedByLabel] != managedByValue || secret.Metadata.Labels["app"] != "ingress" {
+		t.Errorf("Expected the managed-by label to be added, got %v", secret.Metadata.Labels)
+	}
+
+	// Adopted secrets are updated without adopting them again
+	if _, err := k.ApplyTLSSecret("default", "example", nil, []byte("cert2"), []byte("key"), false); err != nil {
+		t.Errorf("Expected the adopted secret to be updated: %v", err)
+	}
+}
+
+func TestApplyTLSSecretNamespaceNotFound(t *testing.T) {
+	fake := newFakeAPIServer("default")
+	k, done := newTestClient(t, fake)
+	defer done()
+
+	_, err := k.ApplyTLSSecret("missing", "example", nil, []byte("cert"), []byte("key"), false)
+	if err == nil {
+		t.Fatal("Expected an error for a missing namespace")
+	}
+	apiErr, ok := err.(*apiError)
+	if !ok || apiErr.Code != http.StatusNotFound || !strings.Contains(apiErr.Message, "namespaces") {
+		t.Errorf("Expected the namespace error of the API server, got %v", err)
+	}
+}
+
+func TestApplyTLSSecretUnauthorized(t *testing.T) {
+	fake := newFakeAPIServer("default")
+	k, done := newTestClient(t, fake)
+	defer done()
+	k.token = "wrong"
+
+	if _, err := k.ApplyTLSSecret("default", "example", nil, []byte("cert"), []byte("key"), false); err == nil {
+		t.Error("Expected an error for a rejected token")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+const (
+	LEADER_LEASE_SECONDS     = 30
+	LEADER_LEASE_MIN_SECONDS = 6
+	HTTP_CHALLENGE_PORT      = 80
+)
+
+// LeaderOpts configures the election of the replica managing the certificates
+type LeaderOpts struct {
+	Enabled bool
+	// Storage key of the lease
+	Key string
+	// Identity of this replica
+	Holder string
+	// A new leader takes over within LeaseDuration and RetryPeriod
+	// after the leader stopped renewing the lease
+	LeaseDuration time.Duration
+	RetryPeriod   time.Duration
+	// Answers HTTP challenges presented by the leader, nil for DNS challenges
+	HTTPChallenges http.Handler
+}
+
+// newLeaderHolder returns an identity unique to this replica
+func newLeaderHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hostname + "-" + hex.EncodeToString(b)
+}
+
+// leaderKey returns the storage key of the lease for the certificate name
+func leaderKey(certName string) string {
+	return path.Join("leases", certName)
+}
+
+// lead blocks until this replica has been elected leader and keeps renewing
+// the lease afterwards. In run once mode it returns false right away if
+// another replica is the leader.
+func (c *Context) lead() bool {
+	go c.releaseOnSignal()
+	if c.Leader.HTTPChallenges != nil {
+		go c.serveHTTPChallenges(HTTP_CHALLENGE_PORT)
+	}
+
+	var leader string
+	for {
+		ok, lease, err := letsencrypt.AcquireLease(c.Storage, c.Leader.Key, c.Leader.Holder, c.Leader.LeaseDuration)
+		switch {
+		case err != nil:
+			logrus.Errorf("Leader election failed: %v", err)
+		case ok:
+			logrus.Infof("Elected as leader %s", c.Leader.Holder)
+			c.Status.SetLeader(c.Leader.Holder, true)
+			c.reloadInstanceId()
+			go c.keepLease(lease.Expires)
+			return true
+		case lease != nil && lease.Holder != leader:
+			leader = lease.Holder
+			logrus.Infof("Following leader %s", leader)
+			c.Status.SetLeader(leader, false)
+		}
+
+		if c.RunOnce {
+			logrus.Info("Run once: Not the leader")
+			return false
+		}
+		time.Sleep(c.Leader.RetryPeriod)
+	}
+}
+
+// keepLease renews the lease of the leader. The process exits if the lease
+// is lost or can't be renewed before it expires, so that no two replicas
+// ever act as leader at the same time.
+func (c *Context) keepLease(expires time.Time) {
+	for {
+		time.Sleep(c.Leader.RetryPeriod)
+
+		ok, lease, err := letsencrypt.AcquireLease(c.Storage, c.Leader.Key, c.Leader.Holder, c.Leader.LeaseDuration)
+		switch {
+		case err != nil:
+			logrus.Errorf("Could not renew leader lease: %v", err)
+		case !ok:
+			holder := "another replica"
+			if lease != nil {
+				holder = lease.Holder
+			}
+			logrus.Fatalf("Lost leadership to %s", holder)
+		default:
+			expires = lease.Expires
+			continue
+		}
+
+		if !time.Now().Add(c.Leader.RetryPeriod).Before(expires) {
+			logrus.Fatalf("Stepping down as leader: Lease expires on %s", expires.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// releaseOnSignal gives up the lease on shutdown so that
+// another replica takes over without waiting for it to expire
+func (c *Context) releaseOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	logrus.Infof("Received %s: Shutting down", sig)
+	c.releaseLease()
+	os.Exit(0)
+}
+
+func (c *Context) releaseLease() {
+	if err := letsencrypt.ReleaseLease(c.Storage, c.Leader.Key, c.Leader.Holder); err != nil {
+		logrus.Errorf("Could not release leader lease: %v", err)
+	}
+}
+
+// reloadInstanceId reads the instance ID from the storage again, since
+// replicas starting at the same time may have generated different IDs
+func (c *Context) reloadInstanceId() {
+	if !c.instanceIdGenerated {
+		return
+	}
+	id, _, err := loadInstanceId(c.Storage)
+	if err != nil {
+		logrus.Fatalf("Could not load instance ID: %v", err)
+	}
+	c.InstanceId = id
+}
+
+// serveHTTPChallenges answers validation requests of the CA for HTTP challenges
+// presented by the leader, which may be routed to any of the replicas
+func (c *Context) serveHTTPChallenges(port int) {
+	mux := http.NewServeMux()
+	mux.Handle(letsencrypt.HTTPChallengePath, c.Leader.HTTPChallenges)
+
+	address := net.JoinHostPort("", strconv.Itoa(port))
+	logrus.Infof("Answering HTTP challenges on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logrus.Fatalf("Failed to serve HTTP challenges: %v", err)
+	}
+}
@@ -4,49 +4,54 @@ import (
 	"crypto"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path"
-	"strings"
 
 	"github.com/Sirupsen/logrus"
 	lego "github.com/xenolf/lego/acme"
 )
 
+const (
+	AccountStatusValid       = "valid"
+	AccountStatusDeactivated = "deactivated"
+)
+
 type Account struct {
 	Email        string                     `json:"email"`
+	Contacts     []string                   `json:"contacts,omitempty"`
+	Status       string                     `json:"status,omitempty"`
 	Registration *lego.RegistrationResource `json:"registrations"`
 
-	key  crypto.PrivateKey
-	path string
+	key     crypto.PrivateKey
+	path    string
+	storage Storage
 }
 
-// NewAccount creates a new or gets a stored LE account for the given email
-func NewAccount(email string, apiVer ApiVersion, keyType lego.KeyType) (*Account, error) {
-	accPath := accountPath(email, apiVer)
+// NewAccount creates a new or gets a stored LE account with the given name.
+// The name defaults to the primary email address of the account.
+func NewAccount(storage Storage, name, email string, apiVer ApiVersion, keyType lego.KeyType) (*Account, error) {
+	accPath := accountKey(apiVer, name)
 	keyFile := path.Join(accPath, "account.key")
 	accountFile := path.Join(accPath, "account.json")
 
-	var privKey crypto.PrivateKey
-	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+	privKey, err := loadPrivateKey(storage, keyFile)
+	if err == ErrNotFound {
 		logrus.Infof("Generating private key (%s) for %s.", keyType, email)
-		privKey, err = generatePrivateKey(keyType, keyFile)
+		privKey, err = generatePrivateKey(keyType)
 		if err != nil {
 			return nil, fmt.Errorf("Error generating private key: %v", err)
 		}
-		logrus.Debugf("Saved account key to %s", keyFile)
-	} else {
-		privKey, err = loadPrivateKey(keyFile)
-		if err != nil {
-			return nil, fmt.Errorf("Error loading private key from %s: %v", keyFile, err)
+		if err = savePrivateKey(storage, keyFile, privKey); err != nil {
+			return nil, fmt.Errorf("Error saving private key: %v", err)
 		}
+		logrus.Debugf("Saved account key to %s", keyFile)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error loading private key from %s: %v", keyFile, err)
 	}
 
-	if _, err := os.Stat(accountFile); os.IsNotExist(err) {
-		return &Account{Email: email, key: privKey, path: accPath}, nil
+	fileBytes, err := storage.Get(accountFile)
+	if err == ErrNotFound {
+		return &Account{Email: email, Status: AccountStatusValid, key: privKey, path: accPath, storage: storage}, nil
 	}
-
-	fileBytes, err := ioutil.ReadFile(accountFile)
 	if err != nil {
 		return nil, fmt.Errorf("Could not load account config file: %v", err)
 	}
@@ -59,17 +64,17 @@ func NewAccount(email string, apiVer ApiVersion, keyType lego.KeyType) (*Account
 
 	acc.key = privKey
 	acc.path = accPath
+	acc.storage = storage
 	return &acc, nil
 }
 
-// Save the account to disk
+// Save the account to the storage
 func (a *Account) Save() error {
 	jsonBytes, err := json.MarshalIndent(a, "", "\t")
 	if err != nil {
 		return err
 	}
-	accountFile := path.Join(a.path, "account.json")
-	return ioutil.WriteFile(accountFile, jsonBytes, 0700)
+	return a.storage.Put(path.Join(a.path, "account.json"), jsonBytes)
 }
 
 /* Methods implementing the lego.User interface*/
@@ -89,8 +94,16 @@ func (a *Account) GetRegistration() *lego.RegistrationResource {
 	return a.Registration
 }
 
-func accountPath(email string, apiVer ApiVersion) string {
-	path := path.Join(StorageDir, strings.ToLower(string(apiVer)), "accounts", email)
-	maybeCreatePath(path)
-	return path
+// ContactEmails returns all email addresses registered for the account,
+// starting with the primary email address.
+func (a *Account) ContactEmails() []string {
+	if len(a.Contacts) == 0 {
+		return []string{a.Email}
+	}
+	return a.Contacts
+}
+
+// IsDeactivated returns true if the account has been deactivated on the server
+func (a *Account) IsDeactivated() bool {
+	return a.Status == AccountStatusDeactivated
 }
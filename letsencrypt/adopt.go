@@ -0,0 +1,106 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	lego "github.com/xenolf/lego/acme"
+)
+
+// ImportCertificate validates an existing certificate and its private key and stores
+// it as the current version of the named certificate, so that it is renewed
+// instead of requesting a new certificate. The certificate must be issued by the
+// configured CA, cover all domains and be valid for at least minValidity.
+func (c *Client) ImportCertificate(certName string, domains []string, certPEM, keyPEM []byte, minValidity time.Duration) (*AcmeCertificate, error) {
+	certs, err := parsePEMCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf := certs[0]
+
+	privateKey, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key: %v", err)
+	}
+	if !publicKeyMatches(leaf, privateKey) {
+		return nil, fmt.Errorf("Private key does not match the certificate")
+	}
+
+	if apiVer := apiVersionOfCertificate(certs); apiVer != c.apiVersion {
+		return nil, fmt.Errorf("Certificate was issued by the Let's Encrypt %s CA, not by the %s CA", apiVer, c.apiVersion)
+	}
+
+	for _, domain := range domains {
+		if err := leaf.VerifyHostname(domain); err != nil {
+			return nil, fmt.Errorf("Certificate does not cover domain %s", domain)
+		}
+	}
+
+	if left := leaf.NotAfter.Sub(time.Now()); left < minValidity {
+		return nil, fmt.Errorf("Certificate expires on %s", leaf.NotAfter.UTC().Format(time.UnixDate))
+	}
+
+	certRes := lego.CertificateResource{
+		Domain:      domains[0],
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+	}
+
+	acmeCert, err := c.saveCertificate(certName, dnsNamesIdentifier(domains), certRes)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Imported certificate '%s' with serial %s expiring on %s", certName,
+		acmeCert.SerialNumber, acmeCert.ExpiryDate.UTC().Format(time.UnixDate))
+	return acmeCert, nil
+}
+
+// stagingNames identify the intermediates and roots of the staging CA. Older
+// ones are named "Fake LE ...", current ones are prefixed with "(STAGING)".
+var stagingNames = []string{"Fake LE", "(STAGING)"}
+
+// apiVersionOfCertificate returns the API version of the CA that issued the
+// certificate, given the certificate followed by its chain
+func apiVersionOfCertificate(chain []*x509.Certificate) ApiVersion {
+	for _, cert := range chain {
+		for _, name := range []string{cert.Issuer.CommonName, cert.Subject.CommonName} {
+			for _, staging := range stagingNames {
+				if strings.Contains(name, staging) {
+					return Sandbox
+				}
+			}
+		}
+	}
+	return Production
+}
+
+// publicKeyMatches returns true if the private key belongs to the certificate
+func publicKeyMatches(cert *x509.Certificate, privateKey crypto.PrivateKey) bool {
+	var public crypto.PublicKey
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		public = &key.PublicKey
+	case *ecdsa.PrivateKey:
+		public = &key.PublicKey
+	default:
+		return false
+	}
+
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false
+	}
+	privKey, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(certKey, privKey)
+}
@@ -0,0 +1,60 @@
+package letsencrypt
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// HTTPChallengePath is the path validation requests of the CA are sent to
+	HTTPChallengePath = "/.well-known/acme-challenge/"
+
+	httpChallengeDir = "challenges/http-01"
+)
+
+var challengeTokenRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// SharedHTTPProvider presents HTTP challenges by keeping the key authorizations
+// in the storage, so that every instance sharing it can answer the validation
+type SharedHTTPProvider struct {
+	storage Storage
+}
+
+// NewSharedHTTPProvider returns a HTTP challenge provider using the given storage
+func NewSharedHTTPProvider(storage Storage) *SharedHTTPProvider {
+	return &SharedHTTPProvider{storage: storage}
+}
+
+// Present stores the key authorization of the challenge token
+func (p *SharedHTTPProvider) Present(domain, token, keyAuth string) error {
+	return p.storage.Put(path.Join(httpChallengeDir, token), []byte(keyAuth))
+}
+
+// CleanUp removes the key authorization of the challenge token
+func (p *SharedHTTPProvider) CleanUp(domain, token, keyAuth string) error {
+	return p.storage.Delete(path.Join(httpChallengeDir, token))
+}
+
+// ServeHTTP answers validation requests with the stored key authorizations
+func (p *SharedHTTPProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, HTTPChallengePath)
+	if !strings.HasPrefix(r.URL.Path, HTTPChallengePath) || !challengeTokenRegexp.MatchString(token) {
+		http.NotFound(w, r)
+		return
+	}
+
+	keyAuth, err := p.storage.Get(path.Join(httpChallengeDir, token))
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(keyAuth)
+}
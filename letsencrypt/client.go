@@ -1,6 +1,7 @@
 package letsencrypt
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -50,17 +52,31 @@ type AcmeCertificate struct {
 	DnsNames     string    `json:"dnsNames"`
 	ExpiryDate   time.Time `json:"expiryDate"`
 	SerialNumber string    `json:"serialNumber"`
+	// Configured domains left out because they failed validation, with the errors
+	ExcludedDomains map[string]string `json:"excludedDomains,omitempty"`
+	// Not renewed before this time, set when the version is restored by a rollback
+	RenewalHoldUntil time.Time `json:"renewalHoldUntil,omitempty"`
 }
 
 // Client represents a Lets Encrypt client
 type Client struct {
-	client     *lego.Client
-	apiVersion ApiVersion
-	provider   Provider
+	client       *lego.Client
+	storage      Storage
+	account      *Account
+	apiVersion   ApiVersion
+	serverUri    string
+	keyType      lego.KeyType
+	provider     Provider
+	providerOpts ProviderOpts
+
+	historyRetention int
+	// Optional ledger enforcing the rate limits of the CA
+	ledger *Ledger
 }
 
-// NewClient returns a new Lets Encrypt client
-func NewClient(email string, kt KeyType, apiVer ApiVersion, dnsResolvers []string, provider ProviderOpts) (*Client, error) {
+// NewClient returns a new Lets Encrypt client for the account with the given
+// name. The first of the given emails is used as primary account email.
+func NewClient(storage Storage, accountName string, emails []string, kt KeyType, apiVer ApiVersion, dnsResolvers []string, provider ProviderOpts) (*Client, error) {
 	var keyType lego.KeyType
 	switch kt {
 	case RSA2048:
@@ -87,28 +103,52 @@ func NewClient(email string, kt KeyType, apiVer ApiVersion, dnsResolvers []strin
 		return nil, fmt.Errorf("Invalid API version: %s", string(apiVer))
 	}
 
-	acc, err := NewAccount(email, apiVer, keyType)
-	if err != nil {
-		return nil, fmt.Errorf("Could not initialize account store for %s: %v", email, err)
+	if len(emails) == 0 {
+		return nil, fmt.Errorf("No account email specified")
+	}
+	email := emails[0]
+	if accountName == "" {
+		accountName = email
 	}
 
-	client, err := lego.NewClient(serverUri, acc, keyType)
+	acc, err := NewAccount(storage, accountName, email, apiVer, keyType)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create client: %v", err)
+		return nil, fmt.Errorf("Could not initialize account store for %s: %v", accountName, err)
+	}
+
+	if acc.IsDeactivated() {
+		return nil, fmt.Errorf("Account %s has been deactivated. Remove the account data from %s/%s to register a new account",
+			accountName, storage, acc.path)
+	}
+
+	c := &Client{
+		storage:          storage,
+		account:          acc,
+		apiVersion:       apiVer,
+		serverUri:        serverUri,
+		keyType:          keyType,
+		provider:         provider.Provider,
+		providerOpts:     provider,
+		historyRetention: DefaultHistoryRetention,
+	}
+
+	if err := c.reloadClient(); err != nil {
+		return nil, err
 	}
 
 	lego.Logger = log.New(ioutil.Discard, "", 0)
 
 	if acc.Registration == nil {
 		logrus.Infof("Creating Let's Encrypt account for %s", email)
-		reg, err := client.Register()
+		acc.Email = email
+		reg, err := c.client.Register()
 		if err != nil {
 			return nil, fmt.Errorf("Failed to register account: %v", err)
 		}
 
 		acc.Registration = reg
 		if acc.Registration.Body.Agreement == "" {
-			err = client.AgreeToTOS()
+			err = c.client.AgreeToTOS()
 			if err != nil {
 				return nil, fmt.Errorf("Could not agree to TOS: %v", err)
 			}
@@ -119,17 +159,40 @@ func NewClient(email string, kt KeyType, apiVer ApiVersion, dnsResolvers []strin
 			logrus.Errorf("Could not save account data: %v", err)
 		}
 	} else {
-		logrus.Infof("Using locally stored Let's Encrypt account for %s", email)
+		logrus.Infof("Using locally stored Let's Encrypt account for %s", acc.Email)
+	}
+
+	// Keep the registered contacts in sync with the configured emails
+	if !equalStrings(acc.ContactEmails(), emails) {
+		logrus.Infof("Account contacts changed from %s to %s", strings.Join(acc.ContactEmails(), ","),
+			strings.Join(emails, ","))
+		if err := c.UpdateContacts(emails); err != nil {
+			logrus.Errorf("Could not update account contacts: %v", err)
+		}
+	}
+
+	if len(dnsResolvers) > 0 {
+		lego.RecursiveNameservers = dnsResolvers
 	}
 
-	prov, challenge, err := getProvider(provider)
+	return c, nil
+}
+
+// reloadClient (re)creates the upstream lego client using the current account key
+func (c *Client) reloadClient() error {
+	client, err := lego.NewClient(c.serverUri, c.account, c.keyType)
 	if err != nil {
-		return nil, fmt.Errorf("Could not get provider: %v", err)
+		return fmt.Errorf("Could not create client: %v", err)
+	}
+
+	prov, challenge, err := getProvider(c.providerOpts)
+	if err != nil {
+		return fmt.Errorf("Could not get provider: %v", err)
 	}
 
 	err = client.SetChallengeProvider(challenge, prov)
 	if err != nil {
-		return nil, fmt.Errorf("Could not set provider: %v", err)
+		return fmt.Errorf("Could not set provider: %v", err)
 	}
 
 	if challenge == lego.DNS01 {
@@ -138,15 +201,8 @@ func NewClient(email string, kt KeyType, apiVer ApiVersion, dnsResolvers []strin
 		client.ExcludeChallenges([]lego.Challenge{lego.TLSSNI01, lego.DNS01})
 	}
 
-	if len(dnsResolvers) > 0 {
-		lego.RecursiveNameservers = dnsResolvers
-	}
-
-	return &Client{
-		client:     client,
-		apiVersion: apiVer,
-		provider:   provider.Provider,
-	}, nil
+	c.client = client
+	return nil
 }
 
 // EnableLogs prints logs from the upstream lego library
@@ -158,10 +214,25 @@ func (c *Client) EnableLogs() {
 
 // Issue obtains a new SAN certificate from the Lets Encrypt CA
 func (c *Client) Issue(certName string, domains []string) (*AcmeCertificate, map[string]error) {
+	if err := c.CheckRateLimits(domains, false); err != nil {
+		return nil, map[string]error{"rate-limit": err}
+	}
+
+	c.recordRateLimit(ledgerOrder, domains, false)
 	certRes, failures := c.client.ObtainCertificate(domains, true, nil, false)
 	if len(failures) > 0 {
+		var failed []string
+		for domain, err := range failures {
+			if isValidationFailure(err) {
+				failed = append(failed, domain)
+			}
+		}
+		if len(failed) > 0 {
+			c.recordRateLimit(ledgerFailure, failed, false)
+		}
 		return nil, failures
 	}
+	c.recordRateLimit(ledgerIssuance, domains, false)
 
 	dnsNames := dnsNamesIdentifier(domains)
 	acmeCert, err := c.saveCertificate(certName, dnsNames, certRes)
@@ -179,17 +250,33 @@ func (c *Client) Renew(certName string) (*AcmeCertificate, error) {
 		return nil, fmt.Errorf("Error loading certificate '%s': %v", certName, err)
 	}
 
+	domains := strings.Split(acmeCert.DnsNames, "|")
+	if err := c.CheckRateLimits(domains, true); err != nil {
+		return nil, err
+	}
+
+	c.recordRateLimit(ledgerOrder, domains, true)
 	certRes := acmeCert.CertificateResource
 	newCertRes, err := c.client.RenewCertificate(certRes, true, false)
 	if err != nil {
+		if isValidationFailure(err) {
+			c.recordRateLimit(ledgerFailure, domains, true)
+		}
 		return nil, err
 	}
+	c.recordRateLimit(ledgerIssuance, domains, true)
 
 	newAcmeCert, err := c.saveCertificate(certName, acmeCert.DnsNames, newCertRes)
 	if err != nil {
 		logrus.Fatalf("Error saving certificate '%s': %v", certName, err)
 	}
 
+	if len(acmeCert.ExcludedDomains) > 0 {
+		if err := c.SetExcludedDomains(certName, newAcmeCert, acmeCert.ExcludedDomains); err != nil {
+			logrus.Errorf("Error saving excluded domains of certificate '%s': %v", certName, err)
+		}
+	}
+
 	return newAcmeCert, nil
 }
 
@@ -208,7 +295,7 @@ func (c *Client) GetStoredCertificate(certName string, domains []string) (bool,
 	}
 
 	// check if the DNS names are a match
-	if dnsNames := dnsNamesIdentifier(domains); acmeCert.DnsNames != dnsNames {
+	if !sameDomains(acmeCert.DnsNames, domains) {
 		logrus.Infof("Stored certificate does not have matching domain names: '%s' ", acmeCert.DnsNames)
 		return false, nil
 	}
@@ -218,7 +305,15 @@ func (c *Client) GetStoredCertificate(certName string, domains []string) (bool,
 
 func (c *Client) haveCertificateByName(certName string) bool {
 	certPath := c.CertPath(certName)
-	if _, err := os.Stat(path.Join(certPath, "metadata.json")); err != nil {
+	ok, err := c.storage.Exists(currentKey(certPath))
+	if err == nil && !ok {
+		// Stored before versions were switched using the current pointer
+		ok, err = c.storage.Exists(path.Join(certPath, "metadata.json"))
+	}
+	if err != nil {
+		logrus.Errorf("Failed to look up certificate in path '%s': %v", certPath, err)
+	}
+	if !ok {
 		logrus.Debugf("No certificate in path '%s'", certPath)
 		return false
 	}
@@ -232,21 +327,29 @@ func (c *Client) loadCertificateByName(certName string) (AcmeCertificate, error)
 
 	logrus.Debugf("Loading certificate '%s' from '%s'", certName, certPath)
 
+	serial, err := c.storage.Get(currentKey(certPath))
+	if err == nil {
+		return loadCurrentCertificate(c.storage, certPath, string(serial))
+	}
+	if err != ErrNotFound {
+		return acmeCert, fmt.Errorf("Failed to load current version of '%s': %v", certPath, err)
+	}
+
 	certIn := path.Join(certPath, "fullchain.pem")
 	privIn := path.Join(certPath, "privkey.pem")
 	metaIn := path.Join(certPath, "metadata.json")
 
-	certBytes, err := ioutil.ReadFile(certIn)
+	certBytes, err := c.storage.Get(certIn)
 	if err != nil {
 		return acmeCert, fmt.Errorf("Failed to load certificate from '%s': %v", certIn, err)
 	}
 
-	metaBytes, err := ioutil.ReadFile(metaIn)
+	metaBytes, err := c.storage.Get(metaIn)
 	if err != nil {
 		return acmeCert, fmt.Errorf("Failed to load meta data from '%s': %v", metaIn, err)
 	}
 
-	keyBytes, err := ioutil.ReadFile(privIn)
+	keyBytes, err := c.storage.Get(privIn)
 	if err != nil {
 		return acmeCert, fmt.Errorf("Failed to load private key from '%s': %v", privIn, err)
 	}
@@ -262,6 +365,12 @@ func (c *Client) loadCertificateByName(certName string) (AcmeCertificate, error)
 }
 
 func (c *Client) saveCertificate(certName, dnsNames string, certRes lego.CertificateResource) (*AcmeCertificate, error) {
+	return storeCertificate(c.storage, c.CertPath(certName), certName, dnsNames, certRes, c.historyRetention)
+}
+
+// storeCertificate archives the certificate and makes it the current version in certPath.
+// At most retention archived versions are kept.
+func storeCertificate(storage Storage, certPath, certName, dnsNames string, certRes lego.CertificateResource, retention int) (*AcmeCertificate, error) {
 	expiryDate, err := lego.GetPEMCertExpiration(certRes.Certificate)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read certificate expiry date: %v", err)
@@ -278,46 +387,91 @@ func (c *Client) saveCertificate(certName, dnsNames string, certRes lego.Certifi
 		DnsNames:            dnsNames,
 	}
 
-	certPath := c.CertPath(certName)
-	maybeCreatePath(certPath)
+	archivePath := path.Join(certPath, "archive", serialNumber)
+	logrus.Debugf("Archiving certificate '%s' to path '%s'", certName, archivePath)
+	if err := writeCertificate(storage, archivePath, &acmeCert); err != nil {
+		return nil, err
+	}
 
 	logrus.Debugf("Saving certificate '%s' to path '%s'", certName, certPath)
+	if err := activateCertificate(storage, certPath, &acmeCert); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Certificate saved to '%s'", path.Join(certPath, "fullchain.pem"))
+
+	if err := pruneHistory(storage, certPath, retention); err != nil {
+		logrus.Warnf("Failed to prune history of certificate '%s': %v", certName, err)
+	}
+
+	return &acmeCert, nil
+}
+
+// currentKey returns the storage key of the pointer to the archived current version
+func currentKey(certPath string) string {
+	return path.Join(certPath, "current")
+}
+
+// activateCertificate makes an archived version the current one. Switching the
+// current pointer is a single write, so the current version is always complete.
+// The files in certPath are copies of the current version for other consumers.
+func activateCertificate(storage Storage, certPath string, acmeCert *AcmeCertificate) error {
+	if err := storage.Put(currentKey(certPath), []byte(acmeCert.SerialNumber)); err != nil {
+		return fmt.Errorf("Failed to switch current version of '%s': %v", certPath, err)
+	}
+	return writeCertificate(storage, certPath, acmeCert)
+}
 
+// loadCurrentCertificate loads the archived version the current pointer refers to
+// and restores the copies in certPath if a previous write was interrupted
+func loadCurrentCertificate(storage Storage, certPath, serial string) (AcmeCertificate, error) {
+	acmeCert, err := loadArchivedCertificate(storage, path.Join(certPath, "archive", serial))
+	if err != nil {
+		return acmeCert, fmt.Errorf("Failed to load current version %s of '%s': %v", serial, certPath, err)
+	}
+
+	current, err := json.MarshalIndent(&acmeCert, "", "\t")
+	if err != nil {
+		return acmeCert, err
+	}
+	if copied, err := storage.Get(path.Join(certPath, "metadata.json")); err != nil || !bytes.Equal(copied, current) {
+		logrus.Warnf("Restoring files of current version %s in '%s'", serial, certPath)
+		if err := writeCertificate(storage, certPath, &acmeCert); err != nil {
+			logrus.Errorf("Failed to restore files in '%s': %v", certPath, err)
+		}
+	}
+	return acmeCert, nil
+}
+
+// writeCertificate writes the certificate, private key and meta data to certPath.
+// The meta data is written last, so that an interrupted write never yields a
+// meta data file that doesn't match the certificate.
+func writeCertificate(storage Storage, certPath string, acmeCert *AcmeCertificate) error {
 	certOut := path.Join(certPath, "fullchain.pem")
 	privOut := path.Join(certPath, "privkey.pem")
 	metaOut := path.Join(certPath, "metadata.json")
 
-	err = ioutil.WriteFile(certOut, acmeCert.Certificate, 0600)
+	err := storage.Put(certOut, acmeCert.Certificate)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to save certificate to '%s': %v", certOut, err)
+		return fmt.Errorf("Failed to save certificate to '%s': %v", certOut, err)
 	}
 
-	logrus.Infof("Certificate saved to '%s'", certOut)
-
-	err = ioutil.WriteFile(privOut, acmeCert.PrivateKey, 0600)
+	err = storage.Put(privOut, acmeCert.PrivateKey)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to save private key to '%s': %v", privOut, err)
+		return fmt.Errorf("Failed to save private key to '%s': %v", privOut, err)
 	}
 
-	logrus.Infof("Private key saved to '%s'", privOut)
-
 	jsonBytes, err := json.MarshalIndent(acmeCert, "", "\t")
 	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal meta data for certificate '%s': %v", certName, err)
+		return fmt.Errorf("Failed to marshal meta data for certificate '%s': %v", certPath, err)
 	}
 
-	err = ioutil.WriteFile(metaOut, jsonBytes, 0600)
+	err = storage.Put(metaOut, jsonBytes)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to save meta data to '%s': %v", metaOut, err)
+		return fmt.Errorf("Failed to save meta data to '%s': %v", metaOut, err)
 	}
 
-	return &acmeCert, nil
-}
-
-func (c *Client) ConfigPath() string {
-	path := path.Join(StorageDir, strings.ToLower(string(c.apiVersion)))
-	maybeCreatePath(path)
-	return path
+	return nil
 }
 
 func (c *Client) ProviderName() string {
@@ -328,14 +482,42 @@ func (c *Client) ApiVersion() string {
 	return string(c.apiVersion)
 }
 
+// CertPath returns the storage key prefix of the named certificate
 func (c *Client) CertPath(certName string) string {
-	return path.Join(c.ConfigPath(), "certs", safeFileName(certName))
+	return certKey(c.apiVersion, certName)
+}
+
+// Storage returns the storage backend used by the client
+func (c *Client) Storage() Storage {
+	return c.storage
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func dnsNamesIdentifier(domains []string) string {
 	return strings.Join(domains, "|")
 }
 
+// sameDomains returns true if the DNS names identifier lists the domains in any order.
+// Imported certificates list the common name first, which may differ from DOMAINS.
+func sameDomains(dnsNames string, domains []string) bool {
+	names := strings.Split(dnsNames, "|")
+	sorted := append([]string{}, domains...)
+	sort.Strings(names)
+	sort.Strings(sorted)
+	return equalStrings(names, sorted)
+}
+
 func maybeCreatePath(path string) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		err = os.MkdirAll(path, 0700)
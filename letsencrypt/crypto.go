@@ -9,13 +9,11 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
-	"io/ioutil"
-	"os"
 
 	lego "github.com/xenolf/lego/acme"
 )
 
-func generatePrivateKey(keyType lego.KeyType, file string) (crypto.PrivateKey, error) {
+func generatePrivateKey(keyType lego.KeyType) (crypto.PrivateKey, error) {
 	var privateKey crypto.PrivateKey
 	var err error
 
@@ -38,6 +36,11 @@ func generatePrivateKey(keyType lego.KeyType, file string) (crypto.PrivateKey, e
 		return nil, err
 	}
 
+	return privateKey, nil
+}
+
+// savePrivateKey stores the given private key PEM encoded under key
+func savePrivateKey(storage Storage, key string, privateKey crypto.PrivateKey) error {
 	var pemBlock *pem.Block
 
 	switch key := privateKey.(type) {
@@ -46,26 +49,28 @@ func generatePrivateKey(keyType lego.KeyType, file string) (crypto.PrivateKey, e
 		pemBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}
 	case *rsa.PrivateKey:
 		pemBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		return fmt.Errorf("Unsupported private key type %T", privateKey)
 	}
 
-	certOut, err := os.Create(file)
-	if err != nil {
-		return nil, err
-	}
-
-	pem.Encode(certOut, pemBlock)
-	certOut.Close()
-
-	return privateKey, nil
+	return storage.Put(key, pem.EncodeToMemory(pemBlock))
 }
 
-func loadPrivateKey(file string) (crypto.PrivateKey, error) {
-	keyBytes, err := ioutil.ReadFile(file)
+// loadPrivateKey loads a PEM encoded private key stored under key
+func loadPrivateKey(storage Storage, key string) (crypto.PrivateKey, error) {
+	keyBytes, err := storage.Get(key)
 	if err != nil {
 		return nil, err
 	}
 
+	return parsePrivateKey(keyBytes)
+}
+
+func parsePrivateKey(keyBytes []byte) (crypto.PrivateKey, error) {
 	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("Pem decode did not yield a valid block")
+	}
 
 	switch keyBlock.Type {
 	case "RSA PRIVATE KEY":
@@ -77,6 +82,12 @@ func loadPrivateKey(file string) (crypto.PrivateKey, error) {
 	return nil, fmt.Errorf("Unknown private key type.")
 }
 
+// PEMCertSerialNumber returns the serial number of the first certificate
+// in a PEM bundle, in the format used in the certificate metadata
+func PEMCertSerialNumber(cert []byte) (string, error) {
+	return getPEMCertSerialNumber(cert)
+}
+
 func getPEMCertSerialNumber(cert []byte) (string, error) {
 	pemBlock, _ := pem.Decode(cert)
 	if pemBlock == nil {
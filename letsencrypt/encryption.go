@@ -0,0 +1,396 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	envelopeVersion  = 1
+	pbkdf2Iterations = 100000
+
+	kdfPBKDF2 = "pbkdf2-sha256"
+	kdfSHA256 = "sha256"
+)
+
+// envelopeMarker identifies encrypted objects in the storage
+var envelopeMarker = []byte(`{"envelope":`)
+
+// envelope holds data encrypted with a random data key,
+// which is in turn encrypted (wrapped) with the key encryption key.
+type envelope struct {
+	Version    int    `json:"envelope"`
+	Kdf        string `json:"kdf"`
+	Salt       []byte `json:"salt,omitempty"`
+	WrapNonce  []byte `json:"wrapNonce"`
+	WrappedKey []byte `json:"wrappedKey"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// KeyEncryptionKey is the secret used to wrap the data keys
+// of encrypted objects. It's derived from a passphrase or a key file.
+type KeyEncryptionKey struct {
+	kdf    string
+	secret []byte
+
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// NewKeyEncryptionKey returns the key encryption key derived from either
+// a passphrase or a key file. It returns nil if neither is given.
+func NewKeyEncryptionKey(passphrase, keyFile string) (*KeyEncryptionKey, error) {
+	if len(passphrase) > 0 && len(keyFile) > 0 {
+		return nil, fmt.Errorf("Only one of encryption passphrase and key file may be set")
+	}
+	if len(keyFile) > 0 {
+		return NewKeyFileKey(keyFile)
+	}
+	if len(passphrase) > 0 {
+		return NewPassphraseKey(passphrase), nil
+	}
+	return nil, nil
+}
+
+// NewPassphraseKey returns a key encryption key derived from passphrase
+func NewPassphraseKey(passphrase string) *KeyEncryptionKey {
+	return &KeyEncryptionKey{kdf: kdfPBKDF2, secret: []byte(passphrase), cache: map[string][]byte{}}
+}
+
+// NewKeyFileKey returns a key encryption key derived from the contents of file
+func NewKeyFileKey(file string) (*KeyEncryptionKey, error) {
+	secret, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read encryption key file: %v", err)
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("Encryption key file '%s' must contain at least 16 bytes", file)
+	}
+	return &KeyEncryptionKey{kdf: kdfSHA256, secret: secret, cache: map[string][]byte{}}, nil
+}
+
+// derive returns the AES-256 key for the given kdf and salt
+func (k *KeyEncryptionKey) derive(kdf string, salt []byte) ([]byte, error) {
+	if kdf != k.kdf {
+		return nil, fmt.Errorf("Object was encrypted using %s, configured key uses %s", kdf, k.kdf)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, ok := k.cache[string(salt)]; ok {
+		return key, nil
+	}
+
+	var key []byte
+	switch kdf {
+	case kdfPBKDF2:
+		key = pbkdf2SHA256(k.secret, salt, pbkdf2Iterations, 32)
+	case kdfSHA256:
+		sum := sha256.Sum256(k.secret)
+		key = sum[:]
+	}
+
+	k.cache[string(salt)] = key
+	return key, nil
+}
+
+// EncryptedStorage encrypts private keys before handing them to the
+// wrapped storage and decrypts them transparently when loading.
+// Objects stored in plaintext are returned as they are.
+type EncryptedStorage struct {
+	Storage
+	kek *KeyEncryptionKey
+	// Key objects not rekeyed yet may still be encrypted with
+	previous *KeyEncryptionKey
+}
+
+// NewEncryptedStorage returns a storage encrypting key material using kek
+func NewEncryptedStorage(storage Storage, kek *KeyEncryptionKey) *EncryptedStorage {
+	return &EncryptedStorage{Storage: storage, kek: kek}
+}
+
+func (s *EncryptedStorage) Get(key string) ([]byte, error) {
+	data, err := s.Storage.Get(key)
+	if err != nil || !isEnvelope(data) {
+		return data, err
+	}
+
+	env, dataKey, err := s.unwrap(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt '%s': %v", key, err)
+	}
+	plaintext, err := aesGCMOpen(dataKey, env.Nonce, env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt '%s': %v", key, err)
+	}
+	return plaintext, nil
+}
+
+// SetPreviousKey configures the key encryption key used before the
+// last rekey, which is tried if the current one doesn't fit
+func (s *EncryptedStorage) SetPreviousKey(kek *KeyEncryptionKey) {
+	s.previous = kek
+}
+
+// unwrap returns the envelope and its data key using the
+// current or else the previous key encryption key
+func (s *EncryptedStorage) unwrap(data []byte) (*envelope, []byte, error) {
+	env, dataKey, err := unwrapDataKey(s.kek, data)
+	if err != nil && s.previous != nil {
+		if env, dataKey, prevErr := unwrapDataKey(s.previous, data); prevErr == nil {
+			return env, dataKey, nil
+		}
+	}
+	return env, dataKey, err
+}
+
+func (s *EncryptedStorage) Put(key string, data []byte) error {
+	if !isKeyMaterial(key) {
+		return s.Storage.Put(key, data)
+	}
+
+	sealed, err := sealEnvelope(s.kek, data)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt '%s': %v", key, err)
+	}
+	return s.Storage.Put(key, sealed)
+}
+
+// GetVersioned passes through to the wrapped storage, leases are not encrypted
+func (s *EncryptedStorage) GetVersioned(key string) ([]byte, string, error) {
+	vs, ok := s.Storage.(VersionedStorage)
+	if !ok {
+		return nil, "", fmt.Errorf("Storage %s does not support versioning", s.Storage)
+	}
+	return vs.GetVersioned(key)
+}
+
+// PutVersioned passes through to the wrapped storage, leases are not encrypted
+func (s *EncryptedStorage) PutVersioned(key string, data []byte, version string) error {
+	vs, ok := s.Storage.(VersionedStorage)
+	if !ok {
+		return fmt.Errorf("Storage %s does not support versioning", s.Storage)
+	}
+	return vs.PutVersioned(key, data, version)
+}
+
+func (s *EncryptedStorage) String() string {
+	return s.Storage.String() + " (encrypted)"
+}
+
+// Rekey re-wraps the data keys of all encrypted objects with newKek
+// and encrypts key material that is still stored in plaintext.
+// All objects are re-encrypted before the first one is written and
+// objects already using newKek are skipped, so an interrupted rekey can
+// be run again. Until it has completed, the objects can be read by setting
+// the old key as previous key. Returns the number of objects rewritten.
+func (s *EncryptedStorage) Rekey(newKek *KeyEncryptionKey) (int, error) {
+	keys, err := s.Storage.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	var staged []string
+	rewritten := map[string][]byte{}
+	for _, key := range keys {
+		data, err := s.Storage.Get(key)
+		if err != nil {
+			return 0, err
+		}
+
+		if isEnvelope(data) {
+			if _, _, err := unwrapDataKey(newKek, data); err == nil {
+				// Rekeyed by an interrupted run
+				continue
+			}
+			env, dataKey, err := s.unwrap(data)
+			if err == nil {
+				err = wrapDataKey(newKek, env, dataKey)
+			}
+			if err == nil {
+				data, err = json.Marshal(env)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("Failed to rekey '%s': %v", key, err)
+			}
+		} else if isKeyMaterial(key) {
+			if data, err = sealEnvelope(newKek, data); err != nil {
+				return 0, fmt.Errorf("Failed to encrypt '%s': %v", key, err)
+			}
+		} else {
+			continue
+		}
+		staged = append(staged, key)
+		rewritten[key] = data
+	}
+
+	count := 0
+	for _, key := range staged {
+		if err := s.Storage.Put(key, rewritten[key]); err != nil {
+			return count, err
+		}
+		logrus.Debugf("Rekeyed '%s'", key)
+		count++
+	}
+
+	s.previous = s.kek
+	s.kek = newKek
+	return count, nil
+}
+
+// isKeyMaterial returns true for storage keys holding private keys
+func isKeyMaterial(key string) bool {
+	name := path.Base(key)
+	return strings.HasPrefix(name, "account.key") || strings.HasPrefix(name, "privkey.pem")
+}
+
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, envelopeMarker)
+}
+
+func sealEnvelope(kek *KeyEncryptionKey, plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	env := &envelope{Version: envelopeVersion}
+	var err error
+	env.Nonce, env.Ciphertext, err = aesGCMSeal(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wrapDataKey(kek, env, dataKey); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(env)
+}
+
+func wrapDataKey(kek *KeyEncryptionKey, env *envelope, dataKey []byte) error {
+	env.Kdf = kek.kdf
+	env.Salt = nil
+	if kek.kdf == kdfPBKDF2 {
+		env.Salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, env.Salt); err != nil {
+			return err
+		}
+	}
+
+	wrappingKey, err := kek.derive(env.Kdf, env.Salt)
+	if err != nil {
+		return err
+	}
+
+	env.WrapNonce, env.WrappedKey, err = aesGCMSeal(wrappingKey, dataKey)
+	return err
+}
+
+func unwrapDataKey(kek *KeyEncryptionKey, data []byte) (*envelope, []byte, error) {
+	if kek == nil {
+		return nil, nil, fmt.Errorf("Object is encrypted but no encryption key is configured")
+	}
+
+	env := &envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, nil, err
+	}
+	if env.Version != envelopeVersion {
+		return nil, nil, fmt.Errorf("Unsupported envelope version %d", env.Version)
+	}
+
+	wrappingKey, err := kek.derive(env.Kdf, env.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := aesGCMOpen(wrappingKey, env.WrapNonce, env.WrappedKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Wrong encryption key")
+	}
+
+	return env, dataKey, nil
+}
+
+func aesGCMSeal(key, plaintext []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func aesGCMOpen(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("Invalid nonce size")
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 2898) with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
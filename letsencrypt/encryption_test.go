@@ -0,0 +1,94 @@
+package letsencrypt
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// failingStorage fails all writes after the given number of successful ones
+type failingStorage struct {
+	Storage
+	puts int
+}
+
+func (s *failingStorage) Put(key string, data []byte) error {
+	if s.puts == 0 {
+		return errors.New("Disk full")
+	}
+	s.puts--
+	return s.Storage.Put(key, data)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	kek := NewPassphraseKey("secret")
+	storage := NewEncryptedStorage(NewFileStorage(dir), kek)
+	testStorage(t, storage)
+
+	if err := storage.Put("production/certs/a/privkey.pem", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := storage.Storage.Get("production/certs/a/privkey.pem")
+	if !isEnvelope(raw) {
+		t.Fatalf("Private key stored in plaintext: %q", raw)
+	}
+	raw, _ = storage.Storage.Get("production/certs/a/fullchain.pem")
+	if isEnvelope(raw) {
+		t.Fatal("Certificate stored encrypted")
+	}
+
+	wrong := NewEncryptedStorage(NewFileStorage(dir), NewPassphraseKey("wrong"))
+	if _, err := wrong.Get("production/certs/a/privkey.pem"); err == nil {
+		t.Fatal("Expected decryption with the wrong key to fail")
+	}
+}
+
+func TestRekeyInterrupted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	oldKek := testKeyEncryptionKey("old")
+	newKek := testKeyEncryptionKey("new")
+	keys := []string{"production/account.key", "production/certs/a/privkey.pem", "production/certs/b/privkey.pem"}
+
+	storage := NewEncryptedStorage(NewFileStorage(dir), oldKek)
+	for _, key := range keys {
+		if err := storage.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failing := &failingStorage{Storage: NewFileStorage(dir), puts: 1}
+	if count, err := NewEncryptedStorage(failing, oldKek).Rekey(newKek); err == nil || count != 1 {
+		t.Fatalf("Expected rekey to fail after 1 object, got %d, %v", count, err)
+	}
+
+	// Objects using either key are readable with the old key as previous key
+	mixed := NewEncryptedStorage(NewFileStorage(dir), newKek)
+	mixed.SetPreviousKey(oldKek)
+	for _, key := range keys {
+		if data, err := mixed.Get(key); err != nil || string(data) != key {
+			t.Fatalf("Get %s after interrupted rekey: got %q, %v", key, data, err)
+		}
+	}
+
+	// Running the rekey again completes it
+	count, err := NewEncryptedStorage(NewFileStorage(dir), oldKek).Rekey(newKek)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected to rekey the 2 remaining objects, got %d, %v", count, err)
+	}
+	rekeyed := NewEncryptedStorage(NewFileStorage(dir), newKek)
+	for _, key := range keys {
+		if data, err := rekeyed.Get(key); err != nil || string(data) != key {
+			t.Fatalf("Get %s after rekey: got %q, %v", key, data, err)
+		}
+	}
+}
+
+// testKeyEncryptionKey returns a key file based key, which is fast to derive
+func testKeyEncryptionKey(secret string) *KeyEncryptionKey {
+	return &KeyEncryptionKey{kdf: kdfSHA256, secret: []byte(secret + "-0123456789abcdef"), cache: map[string][]byte{}}
+}
@@ -0,0 +1,207 @@
+package letsencrypt
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type ExportFormat string
+
+const (
+	// cert.pem: the leaf certificate
+	ExportCert = ExportFormat("cert")
+	// chain.pem: the intermediate certificates
+	ExportChain = ExportFormat("chain")
+	// fullchain.pem and privkey.pem
+	ExportFullchain = ExportFormat("fullchain")
+	// combined.pem: certificate chain followed by the private key (HAProxy)
+	ExportCombined = ExportFormat("combined")
+	// cert.der: the DER encoded leaf certificate
+	ExportDER = ExportFormat("der")
+	// cert.p12: PKCS#12 archive with key and chain
+	ExportPKCS12 = ExportFormat("pkcs12")
+	// keystore.jks: Java keystore with key and chain
+	ExportJKS = ExportFormat("jks")
+)
+
+// ExportOpts configures the files written for consumers
+// of the certificate other than Rancher load balancers
+type ExportOpts struct {
+	// Directory the files are written to
+	Dir     string
+	Formats []ExportFormat
+	// Password protecting PKCS#12 archives and Java keystores
+	Password string
+	// Owner of the written files, -1 keeps the current owner
+	Uid int
+	Gid int
+	// Permissions of the written files
+	Mode os.FileMode
+}
+
+// Enabled returns true if any export formats are configured
+func (o ExportOpts) Enabled() bool {
+	return len(o.Formats) > 0
+}
+
+// CertDir returns the directory the files of the named certificate are written to
+func (o ExportOpts) CertDir(certName string) string {
+	return filepath.Join(o.Dir, safeFileName(certName))
+}
+
+// ExportCertificate writes the certificate in the configured formats to a
+// directory named after the certificate below opts.Dir
+func ExportCertificate(certName string, acmeCert *AcmeCertificate, opts ExportOpts) error {
+	if !opts.Enabled() {
+		return nil
+	}
+
+	dir := opts.CertDir(certName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Failed to create export directory '%s': %v", dir, err)
+	}
+
+	// Make the directory accessible to everyone that may read the files
+	dirMode := os.ModeDir | 0700 | (opts.Mode&0044)>>2 | (opts.Mode & 0044)
+	if err := setOwnership(dir, dirMode, opts); err != nil {
+		return err
+	}
+
+	privateKey, err := parsePrivateKey(acmeCert.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("Failed to parse private key: %v", err)
+	}
+
+	certs, err := parsePEMCertificates(acmeCert.Certificate)
+	if err != nil {
+		return err
+	}
+
+	var chainPEM []byte
+	for _, cert := range certs[1:] {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	files := map[string][]byte{}
+	for _, format := range opts.Formats {
+		switch format {
+		case ExportCert:
+			files["cert.pem"] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[0].Raw})
+		case ExportChain:
+			files["chain.pem"] = chainPEM
+		case ExportFullchain:
+			files["fullchain.pem"] = acmeCert.Certificate
+			files["privkey.pem"] = acmeCert.PrivateKey
+		case ExportCombined:
+			files["combined.pem"] = append(append([]byte{}, acmeCert.Certificate...), acmeCert.PrivateKey...)
+		case ExportDER:
+			files["cert.der"] = certs[0].Raw
+		case ExportPKCS12:
+			data, err := encodePKCS12(privateKey, certs, certName, opts.Password)
+			if err != nil {
+				return fmt.Errorf("Failed to encode PKCS#12 archive: %v", err)
+			}
+			files["cert.p12"] = data
+		case ExportJKS:
+			if len(opts.Password) < 6 {
+				return fmt.Errorf("Java keystores require a password of at least 6 characters")
+			}
+			data, err := encodeJKS(privateKey, certs, certName, opts.Password, time.Now())
+			if err != nil {
+				return fmt.Errorf("Failed to encode Java keystore: %v", err)
+			}
+			files["keystore.jks"] = data
+		default:
+			return fmt.Errorf("Unsupported export format: %s", format)
+		}
+	}
+
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := writeExportFile(file, data, opts); err != nil {
+			return fmt.Errorf("Failed to export '%s': %v", file, err)
+		}
+		logrus.Debugf("Exported certificate '%s' to '%s'", certName, file)
+	}
+
+	logrus.Infof("Exported certificate '%s' to '%s'", certName, dir)
+	return nil
+}
+
+// writeExportFile replaces file atomically with data
+func writeExportFile(file string, data []byte, opts ExportOpts) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = setOwnership(tmp.Name(), opts.Mode, opts)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func setOwnership(file string, mode os.FileMode, opts ExportOpts) error {
+	if opts.Uid >= 0 || opts.Gid >= 0 {
+		if err := os.Chown(file, opts.Uid, opts.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(file, mode)
+}
+
+// SplitCertificateChain returns the PEM encoded leaf certificate
+// and intermediate certificates of a certificate bundle
+func SplitCertificateChain(bundle []byte) (cert, chain []byte, err error) {
+	certs, err := parsePEMCertificates(bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[0].Raw})
+	for _, c := range certs[1:] {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return cert, chain, nil
+}
+
+func parsePEMCertificates(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificates found in bundle")
+	}
+	return certs, nil
+}
@@ -0,0 +1,167 @@
+package letsencrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultHistoryRetention is the number of archived certificate versions kept by default
+const DefaultHistoryRetention = 5
+
+// SetHistoryRetention sets the number of archived versions kept per certificate
+func (c *Client) SetHistoryRetention(retention int) {
+	if retention < 1 {
+		retention = 1
+	}
+	c.historyRetention = retention
+}
+
+// CertificateHistory returns the archived versions of the named certificate, newest first
+func (c *Client) CertificateHistory(certName string) ([]AcmeCertificate, error) {
+	return loadHistory(c.storage, c.CertPath(certName))
+}
+
+// Rollback restores an archived version of the named certificate as the current
+// version. If serial is empty, the newest version preceding the current one is restored.
+// The restored version is not renewed before holdUntil, so that a version due for
+// renewal isn't replaced right away.
+func (c *Client) Rollback(certName, serial string, holdUntil time.Time) (*AcmeCertificate, error) {
+	current, err := c.loadCertificateByName(certName)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := c.CertificateHistory(certName)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *AcmeCertificate
+	for i, version := range history {
+		if serial == "" && version.SerialNumber != current.SerialNumber && version.ExpiryDate.Before(current.ExpiryDate) {
+			target = &history[i]
+			break
+		}
+		if serial != "" && version.SerialNumber == serial {
+			target = &history[i]
+			break
+		}
+	}
+
+	if target == nil {
+		if serial == "" {
+			return nil, fmt.Errorf("No previous version of certificate '%s' found", certName)
+		}
+		return nil, fmt.Errorf("No version with serial %s of certificate '%s' found", serial, certName)
+	}
+
+	// The hold is archived as well, since the current version is loaded from the archive
+	target.RenewalHoldUntil = holdUntil
+	certPath := c.CertPath(certName)
+	if err := writeCertificate(c.storage, path.Join(certPath, "archive", target.SerialNumber), target); err != nil {
+		return nil, err
+	}
+	if err := activateCertificate(c.storage, certPath, target); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Rolled back certificate '%s' from serial %s to %s", certName, current.SerialNumber, target.SerialNumber)
+	return target, nil
+}
+
+func loadHistory(storage Storage, certPath string) ([]AcmeCertificate, error) {
+	archivePath := path.Join(certPath, "archive")
+	keys, err := storage.List(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list archive '%s': %v", archivePath, err)
+	}
+
+	var history []AcmeCertificate
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/metadata.json") {
+			continue
+		}
+
+		versionPath := path.Dir(key)
+		acmeCert, err := loadArchivedCertificate(storage, versionPath)
+		if err != nil {
+			logrus.Warnf("Skipping archived certificate in '%s': %v", versionPath, err)
+			continue
+		}
+		history = append(history, acmeCert)
+	}
+
+	sort.Sort(byExpiryDesc(history))
+	return history, nil
+}
+
+func loadArchivedCertificate(storage Storage, versionPath string) (AcmeCertificate, error) {
+	var acmeCert AcmeCertificate
+
+	metaBytes, err := storage.Get(path.Join(versionPath, "metadata.json"))
+	if err != nil {
+		return acmeCert, err
+	}
+	if err := json.Unmarshal(metaBytes, &acmeCert); err != nil {
+		return acmeCert, err
+	}
+
+	acmeCert.Certificate, err = storage.Get(path.Join(versionPath, "fullchain.pem"))
+	if err != nil {
+		return acmeCert, err
+	}
+	acmeCert.PrivateKey, err = storage.Get(path.Join(versionPath, "privkey.pem"))
+	if err != nil {
+		return acmeCert, err
+	}
+
+	return acmeCert, nil
+}
+
+// pruneHistory removes all but the newest retention archived versions,
+// the current version is always kept
+func pruneHistory(storage Storage, certPath string, retention int) error {
+	if retention < 1 {
+		return nil
+	}
+	current, err := storage.Get(currentKey(certPath))
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	history, err := loadHistory(storage, certPath)
+	if err != nil {
+		return err
+	}
+
+	if len(history) <= retention {
+		return nil
+	}
+
+	for _, version := range history[retention:] {
+		if version.SerialNumber == string(current) {
+			continue
+		}
+		versionPath := path.Join(certPath, "archive", version.SerialNumber)
+		logrus.Debugf("Removing archived certificate '%s'", versionPath)
+		for _, file := range []string{"metadata.json", "fullchain.pem", "privkey.pem"} {
+			if err := storage.Delete(path.Join(versionPath, file)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type byExpiryDesc []AcmeCertificate
+
+func (h byExpiryDesc) Len() int           { return len(h) }
+func (h byExpiryDesc) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h byExpiryDesc) Less(i, j int) bool { return h[i].ExpiryDate.After(h[j].ExpiryDate) }
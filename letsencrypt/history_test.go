@@ -0,0 +1,125 @@
+package letsencrypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	lego "github.com/xenolf/lego/acme"
+)
+
+// testCertificate returns a self-signed certificate resource with the given serial
+func testCertificate(t *testing.T, serial int64, notBefore time.Time) lego.CertificateResource {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lego.CertificateResource{
+		Domain:      "example.com",
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		PrivateKey:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func newTestClient(storage Storage) *Client {
+	return &Client{storage: storage, apiVersion: Production, historyRetention: DefaultHistoryRetention}
+}
+
+func TestStoreCertificateInterrupted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newTestClient(NewFileStorage(dir))
+	certPath := client.CertPath("example")
+	start := time.Now().Add(-time.Hour)
+
+	if _, err := client.saveCertificate("example", "example.com", testCertificate(t, 1, start)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupted before switching the current pointer: the previous version stays current
+	failing := &failingStorage{Storage: NewFileStorage(dir), puts: 3}
+	if _, err := storeCertificate(failing, certPath, "example", "example.com", testCertificate(t, 2, start.Add(time.Minute)), 5); err == nil {
+		t.Fatal("Expected store to fail")
+	}
+	acmeCert, err := client.loadCertificateByName("example")
+	if err != nil || acmeCert.SerialNumber != "1" {
+		t.Fatalf("Expected serial 1 to be current, got %s, %v", acmeCert.SerialNumber, err)
+	}
+
+	// Interrupted while copying the files: the new version is current and the copies are restored
+	failing = &failingStorage{Storage: NewFileStorage(dir), puts: 5}
+	if _, err := storeCertificate(failing, certPath, "example", "example.com", testCertificate(t, 3, start.Add(2*time.Minute)), 5); err == nil {
+		t.Fatal("Expected store to fail")
+	}
+	acmeCert, err = client.loadCertificateByName("example")
+	if err != nil || acmeCert.SerialNumber != "3" {
+		t.Fatalf("Expected serial 3 to be current, got %s, %v", acmeCert.SerialNumber, err)
+	}
+	chain, _ := client.storage.Get(path.Join(certPath, "fullchain.pem"))
+	key, _ := client.storage.Get(path.Join(certPath, "privkey.pem"))
+	if string(chain) != string(acmeCert.Certificate) || string(key) != string(acmeCert.PrivateKey) {
+		t.Fatal("Copies of the current version were not restored")
+	}
+	meta := AcmeCertificate{}
+	data, _ := client.storage.Get(path.Join(certPath, "metadata.json"))
+	if err := json.Unmarshal(data, &meta); err != nil || meta.SerialNumber != "3" {
+		t.Fatalf("Meta data copy not restored: %s, %v", meta.SerialNumber, err)
+	}
+}
+
+func TestRollbackKeepsCurrentVersion(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newTestClient(NewFileStorage(dir))
+	client.SetHistoryRetention(2)
+	start := time.Now().Add(-time.Hour)
+	for serial := int64(1); serial <= 2; serial++ {
+		if _, err := client.saveCertificate("example", "example.com", testCertificate(t, serial, start.Add(time.Duration(serial)*time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hold := time.Now().Add(time.Hour).Truncate(time.Second)
+	rolledBack, err := client.Rollback("example", "", hold)
+	if err != nil || rolledBack.SerialNumber != "1" {
+		t.Fatalf("Expected rollback to serial 1, got %v", err)
+	}
+
+	// Pruning must not remove the current version although it's the oldest one
+	if err := pruneHistory(client.storage, client.CertPath("example"), 1); err != nil {
+		t.Fatal(err)
+	}
+	acmeCert, err := client.loadCertificateByName("example")
+	if err != nil || acmeCert.SerialNumber != "1" {
+		t.Fatalf("Expected serial 1 to be current, got %s, %v", acmeCert.SerialNumber, err)
+	}
+	if !acmeCert.RenewalHoldUntil.Equal(hold) {
+		t.Errorf("Expected renewal to be held until %s, got %s", hold, acmeCert.RenewalHoldUntil)
+	}
+}
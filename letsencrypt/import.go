@@ -0,0 +1,317 @@
+package letsencrypt
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	lego "github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// ImportSummary lists the accounts and certificates written by an import
+type ImportSummary struct {
+	Accounts     []string
+	Certificates []string
+}
+
+// ImportCertbot imports the accounts and current certificates from a certbot
+// configuration directory (e.g. /etc/letsencrypt of the certbot host) into storage.
+// Existing local data is only replaced if overwrite is true.
+func ImportCertbot(storage Storage, configDir string, overwrite bool) (*ImportSummary, error) {
+	summary := &ImportSummary{}
+
+	// accounts/<server>/directory/<account id>/{regr.json,private_key.json}
+	accountsDir := path.Join(configDir, "accounts")
+	err := filepath.Walk(accountsDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Name() != "regr.json" {
+			return err
+		}
+
+		accDir := filepath.Dir(p)
+		rel, _ := filepath.Rel(accountsDir, accDir)
+		apiVer := apiVersionFromServer(rel)
+
+		reg := &lego.RegistrationResource{}
+		if err := readJSON(p, reg); err != nil {
+			return err
+		}
+
+		keyFile := path.Join(accDir, "private_key.json")
+		var jwk jose.JsonWebKey
+		if err := readJSON(keyFile, &jwk); err != nil {
+			return err
+		}
+		if jwk.IsPublic() {
+			return fmt.Errorf("No private key found in '%s'", keyFile)
+		}
+
+		name, err := importAccount(storage, reg, jwk.Key, filepath.Base(accDir), apiVer, overwrite)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			summary.Accounts = append(summary.Accounts, name)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return summary, fmt.Errorf("Failed to import certbot accounts: %v", err)
+	}
+
+	// live/<name>/{fullchain.pem,privkey.pem}
+	liveDir := path.Join(configDir, "live")
+	entries, err := ioutil.ReadDir(liveDir)
+	if err != nil && !os.IsNotExist(err) {
+		return summary, fmt.Errorf("Failed to read certbot certificates: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		certName := entry.Name()
+		certDir := path.Join(liveDir, certName)
+		certBytes, err := ioutil.ReadFile(path.Join(certDir, "fullchain.pem"))
+		if err != nil {
+			logrus.Warnf("Skipping certbot certificate '%s': %v", certName, err)
+			continue
+		}
+		keyBytes, err := ioutil.ReadFile(path.Join(certDir, "privkey.pem"))
+		if err != nil {
+			logrus.Warnf("Skipping certbot certificate '%s': %v", certName, err)
+			continue
+		}
+
+		renewalConf := readCertbotRenewalConf(path.Join(configDir, "renewal", certName+".conf"))
+		certRes := lego.CertificateResource{
+			AccountRef:  renewalConf["account"],
+			PrivateKey:  keyBytes,
+			Certificate: certBytes,
+		}
+
+		imported, err := importCertificate(storage, certName, certRes, overwrite)
+		if err != nil {
+			return summary, err
+		}
+		if imported {
+			summary.Certificates = append(summary.Certificates, certName)
+		}
+	}
+
+	return summary, nil
+}
+
+// ImportLego imports the accounts and certificates from a lego CLI
+// data directory (usually named .lego) into storage.
+// Existing local data is only replaced if overwrite is true.
+func ImportLego(storage Storage, dataDir string, overwrite bool) (*ImportSummary, error) {
+	summary := &ImportSummary{}
+
+	// accounts/<server>/<email>/{account.json,keys/<email>.key}
+	accountsDir := path.Join(dataDir, "accounts")
+	err := filepath.Walk(accountsDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Name() != "account.json" {
+			return err
+		}
+
+		accDir := filepath.Dir(p)
+		rel, _ := filepath.Rel(accountsDir, accDir)
+		apiVer := apiVersionFromServer(rel)
+
+		legoAccount := struct {
+			Email        string                     `json:"email"`
+			Registration *lego.RegistrationResource `json:"registration"`
+		}{}
+		if err := readJSON(p, &legoAccount); err != nil {
+			return err
+		}
+		if legoAccount.Registration == nil {
+			logrus.Warnf("Skipping unregistered lego account in '%s'", accDir)
+			return nil
+		}
+
+		email := filepath.Base(accDir)
+		keyBytes, err := ioutil.ReadFile(path.Join(accDir, "keys", email+".key"))
+		if err != nil {
+			return fmt.Errorf("Failed to load account key for %s: %v", email, err)
+		}
+		key, err := parsePrivateKey(keyBytes)
+		if err != nil {
+			return fmt.Errorf("Failed to load account key for %s: %v", email, err)
+		}
+
+		name, err := importAccount(storage, legoAccount.Registration, key, email, apiVer, overwrite)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			summary.Accounts = append(summary.Accounts, name)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return summary, fmt.Errorf("Failed to import lego accounts: %v", err)
+	}
+
+	// certificates/<domain>.{crt,key,json}
+	certsDir := path.Join(dataDir, "certificates")
+	metaFiles, err := filepath.Glob(path.Join(certsDir, "*.json"))
+	if err != nil {
+		return summary, err
+	}
+
+	for _, metaFile := range metaFiles {
+		base := strings.TrimSuffix(metaFile, ".json")
+		certName := filepath.Base(base)
+
+		var certRes lego.CertificateResource
+		if err := readJSON(metaFile, &certRes); err != nil {
+			return summary, err
+		}
+
+		certRes.Certificate, err = ioutil.ReadFile(base + ".crt")
+		if err != nil {
+			logrus.Warnf("Skipping lego certificate '%s': %v", certName, err)
+			continue
+		}
+		certRes.PrivateKey, err = ioutil.ReadFile(base + ".key")
+		if err != nil {
+			logrus.Warnf("Skipping lego certificate '%s': %v", certName, err)
+			continue
+		}
+
+		imported, err := importCertificate(storage, certName, certRes, overwrite)
+		if err != nil {
+			return summary, err
+		}
+		if imported {
+			summary.Certificates = append(summary.Certificates, certName)
+		}
+	}
+
+	return summary, nil
+}
+
+// importAccount stores the given registration and account key in the account
+// store of the given API version. It returns the name of the imported account
+// or an empty string if the account was skipped.
+func importAccount(storage Storage, reg *lego.RegistrationResource, key crypto.PrivateKey, fallbackName string, apiVer ApiVersion, overwrite bool) (string, error) {
+	var emails []string
+	for _, contact := range reg.Body.Contact {
+		if strings.HasPrefix(contact, "mailto:") {
+			emails = append(emails, strings.TrimPrefix(contact, "mailto:"))
+		}
+	}
+
+	name := fallbackName
+	acc := &Account{Status: AccountStatusValid, Registration: reg, storage: storage}
+	if len(emails) > 0 {
+		name = emails[0]
+		acc.Email = emails[0]
+		acc.Contacts = emails
+	}
+
+	acc.path = accountKey(apiVer, name)
+	accountFile := path.Join(acc.path, "account.json")
+	if ok, _ := storage.Exists(accountFile); ok && !overwrite {
+		logrus.Warnf("Skipping account %s: Already exists in '%s'", name, acc.path)
+		return "", nil
+	}
+
+	if err := savePrivateKey(storage, path.Join(acc.path, "account.key"), key); err != nil {
+		return "", fmt.Errorf("Failed to save account key for %s: %v", name, err)
+	}
+	if err := acc.Save(); err != nil {
+		return "", fmt.Errorf("Failed to save account %s: %v", name, err)
+	}
+
+	logrus.Infof("Imported %s account %s", apiVer, name)
+	return name, nil
+}
+
+// importCertificate stores the given certificate under certName in the
+// certificate store matching its issuer.
+func importCertificate(storage Storage, certName string, certRes lego.CertificateResource, overwrite bool) (bool, error) {
+	chain, err := parsePEMCertificates(certRes.Certificate)
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse certificate '%s': %v", certName, err)
+	}
+	x509Cert := chain[0]
+
+	apiVer := apiVersionOfCertificate(chain)
+
+	// Same domain order as used by lego when renewing: common name first
+	domains := []string{x509Cert.Subject.CommonName}
+	for _, name := range x509Cert.DNSNames {
+		if name != x509Cert.Subject.CommonName {
+			domains = append(domains, name)
+		}
+	}
+	if certRes.Domain == "" {
+		certRes.Domain = domains[0]
+	}
+
+	certPath := certKey(apiVer, certName)
+	if ok, _ := storage.Exists(path.Join(certPath, "metadata.json")); ok && !overwrite {
+		logrus.Warnf("Skipping certificate '%s': Already exists in '%s'", certName, certPath)
+		return false, nil
+	}
+
+	if _, err := storeCertificate(storage, certPath, certName, dnsNamesIdentifier(domains), certRes, DefaultHistoryRetention); err != nil {
+		return false, err
+	}
+
+	logrus.Infof("Imported %s certificate '%s' for domains %s", apiVer, certName, strings.Join(domains, ","))
+	return true, nil
+}
+
+// apiVersionFromServer guesses the API version from a path
+// containing the CA server host name.
+func apiVersionFromServer(server string) ApiVersion {
+	if strings.Contains(server, "staging") {
+		return Sandbox
+	}
+	return Production
+}
+
+// readCertbotRenewalConf returns the top-level key/value pairs
+// of a certbot renewal configuration file.
+func readCertbotRenewalConf(file string) map[string]string {
+	conf := map[string]string{}
+	f, err := os.Open(file)
+	if err != nil {
+		return conf
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			break
+		}
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			conf[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return conf
+}
+
+func readJSON(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Failed to parse '%s': %v", file, err)
+	}
+	return nil
+}
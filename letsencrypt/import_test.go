@@ -0,0 +1,91 @@
+package letsencrypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	lego "github.com/xenolf/lego/acme"
+)
+
+func TestImportCertificateDomainOrder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewFileStorage(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"www.example.com", "example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certRes := lego.CertificateResource{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		PrivateKey:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+	if ok, err := importCertificate(storage, "example", certRes, false); err != nil || !ok {
+		t.Fatalf("Expected the certificate to be imported, got %v, %v", ok, err)
+	}
+
+	// DOMAINS lists the common name last
+	ok, acmeCert := newTestClient(storage).GetStoredCertificate("example", []string{"www.example.com", "example.com"})
+	if !ok {
+		t.Fatal("Expected the imported certificate to match the configured domains")
+	}
+	if acmeCert.SerialNumber != "1" {
+		t.Errorf("Unexpected serial %s", acmeCert.SerialNumber)
+	}
+
+	if ok, _ := newTestClient(storage).GetStoredCertificate("example", []string{"example.com"}); ok {
+		t.Error("Expected a different set of domains not to match")
+	}
+}
+
+func TestApiVersionOfCertificate(t *testing.T) {
+	issuedBy := func(issuer, subject string) *x509.Certificate {
+		return &x509.Certificate{Issuer: pkix.Name{CommonName: issuer}, Subject: pkix.Name{CommonName: subject}}
+	}
+
+	tests := []struct {
+		chain  []*x509.Certificate
+		apiVer ApiVersion
+	}{
+		{[]*x509.Certificate{issuedBy("Fake LE Intermediate X1", "example.com")}, Sandbox},
+		{[]*x509.Certificate{issuedBy("(STAGING) Counterfeit Cashew R10", "example.com")}, Sandbox},
+		// Only the root of the chain is recognizable
+		{[]*x509.Certificate{
+			issuedBy("Test R1", "example.com"),
+			issuedBy("(STAGING) Pretend Pear X1", "Test R1"),
+		}, Sandbox},
+		{[]*x509.Certificate{
+			issuedBy("R10", "example.com"),
+			issuedBy("ISRG Root X1", "R10"),
+		}, Production},
+	}
+
+	for _, test := range tests {
+		if apiVer := apiVersionOfCertificate(test.chain); apiVer != test.apiVer {
+			t.Errorf("Expected %s for the chain issued by %s, got %s", test.apiVer, test.chain[0].Issuer.CommonName, apiVer)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"time"
+	"unicode/utf16"
+)
+
+// Minimal encoder for the Java KeyStore (JKS) format, holding a single
+// private key entry with its certificate chain. The key is protected
+// using Sun's proprietary KeyProtector algorithm.
+
+const (
+	jksMagic   = 0xFEEDFEED
+	jksVersion = 2
+
+	jksPrivateKeyEntry = 1
+)
+
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// encodeJKS returns a Java keystore containing the private key and the
+// certificate chain (leaf first) under alias, protected with password.
+func encodeJKS(privateKey crypto.PrivateKey, certs []*x509.Certificate, alias, password string, created time.Time) ([]byte, error) {
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pwd := jksPassword(password)
+	protectedKey, err := jksProtectKey(pkcs8Key, pwd)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+
+	write(uint32(jksMagic))
+	write(uint32(jksVersion))
+	write(uint32(1))
+
+	write(uint32(jksPrivateKeyEntry))
+	writeJKSString(&buf, alias)
+	write(created.UnixNano() / int64(time.Millisecond))
+	write(uint32(len(protectedKey)))
+	buf.Write(protectedKey)
+
+	write(uint32(len(certs)))
+	for _, cert := range certs {
+		writeJKSString(&buf, "X.509")
+		write(uint32(len(cert.Raw)))
+		buf.Write(cert.Raw)
+	}
+
+	// Keyed integrity check over the whole keystore
+	h := sha1.New()
+	h.Write(pwd)
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+
+	return buf.Bytes(), nil
+}
+
+// jksProtectKey encrypts the PKCS#8 encoded key with the KeyProtector
+// algorithm and returns it wrapped in an EncryptedPrivateKeyInfo
+func jksProtectKey(plainKey, pwd []byte) ([]byte, error) {
+	salt, err := randomBytes(sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(plainKey))
+	digest := salt
+	for i := 0; i < len(plainKey); i += sha1.Size {
+		h := sha1.New()
+		h.Write(pwd)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(plainKey); j++ {
+			encrypted[i+j] = plainKey[i+j] ^ digest[j]
+		}
+	}
+
+	check := sha1.New()
+	check.Write(pwd)
+	check.Write(plainKey)
+
+	protected := append(append(salt, encrypted...), check.Sum(nil)...)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidJKSKeyProtector,
+			Parameters: asn1.NullRawValue,
+		},
+		EncryptedData: protected,
+	})
+}
+
+// jksPassword returns the password encoded as UTF-16BE without terminator
+func jksPassword(password string) []byte {
+	encoded := utf16.Encode([]rune(password))
+	out := make([]byte, 0, 2*len(encoded))
+	for _, r := range encoded {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return out
+}
+
+// writeJKSString writes s in Java's modified UTF-8 encoding
+func writeJKSString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
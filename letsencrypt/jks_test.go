@@ -0,0 +1,106 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestEncodeJKS(t *testing.T) {
+	key, certs := testKeyAndChain(t)
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	data, err := encodeJKS(key, certs, "example", "secret", created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pwd := jksPassword("secret")
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	h := sha1.New()
+	h.Write(pwd)
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		t.Fatal("Keystore integrity check does not match")
+	}
+
+	r := bytes.NewReader(body)
+	read := func(v interface{}) {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readString := func() string {
+		var n uint16
+		read(&n)
+		b := make([]byte, n)
+		read(b)
+		return string(b)
+	}
+
+	var magic, version, count, tag uint32
+	read(&magic)
+	read(&version)
+	read(&count)
+	read(&tag)
+	if magic != jksMagic || version != jksVersion || count != 1 || tag != jksPrivateKeyEntry {
+		t.Fatalf("Unexpected header %x %d %d %d", magic, version, count, tag)
+	}
+	if alias := readString(); alias != "example" {
+		t.Fatalf("Unexpected alias %s", alias)
+	}
+	var millis int64
+	read(&millis)
+	if millis != created.UnixNano()/int64(time.Millisecond) {
+		t.Fatalf("Unexpected creation date %d", millis)
+	}
+
+	var keyLen uint32
+	read(&keyLen)
+	protected := make([]byte, keyLen)
+	read(protected)
+	keyInfo := encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(protected, &keyInfo); err != nil || !keyInfo.Algorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		t.Fatalf("Unexpected protected key: %v", err)
+	}
+
+	// Reverse the KeyProtector algorithm
+	enc := keyInfo.EncryptedData
+	salt, encrypted, check := enc[:sha1.Size], enc[sha1.Size:len(enc)-sha1.Size], enc[len(enc)-sha1.Size:]
+	plain := make([]byte, len(encrypted))
+	digest = salt
+	for i := 0; i < len(encrypted); i += sha1.Size {
+		sum := sha1.Sum(append(append([]byte{}, pwd...), digest...))
+		digest = sum[:]
+		for j := 0; j < sha1.Size && i+j < len(encrypted); j++ {
+			plain[i+j] = encrypted[i+j] ^ digest[j]
+		}
+	}
+	if sum := sha1.Sum(append(append([]byte{}, pwd...), plain...)); !bytes.Equal(sum[:], check) {
+		t.Fatal("Key check digest does not match")
+	}
+	expected, _ := x509.MarshalPKCS8PrivateKey(key)
+	if !bytes.Equal(plain, expected) {
+		t.Fatal("Recovered private key does not match")
+	}
+
+	var certCount uint32
+	read(&certCount)
+	if int(certCount) != len(certs) {
+		t.Fatalf("Expected %d certificates, got %d", len(certs), certCount)
+	}
+	if certType := readString(); certType != "X.509" {
+		t.Fatalf("Unexpected certificate type %s", certType)
+	}
+	var certLen uint32
+	read(&certLen)
+	der := make([]byte, certLen)
+	read(der)
+	if !bytes.Equal(der, certs[0].Raw) {
+		t.Fatal("Certificate does not match")
+	}
+}
@@ -0,0 +1,161 @@
+package letsencrypt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrVersionConflict is returned by a VersionedStorage if the stored
+// data has been changed since it was read
+var ErrVersionConflict = errors.New("Version conflict")
+
+// VersionedStorage is implemented by storage backends supporting optimistic
+// concurrency control, which leader election relies on
+type VersionedStorage interface {
+	// GetVersioned returns the data stored under key and its version or ErrNotFound
+	GetVersioned(key string) ([]byte, string, error)
+	// PutVersioned stores data under key if the stored version is still
+	// the given one, or if nothing is stored when version is empty.
+	// Returns ErrVersionConflict otherwise.
+	PutVersioned(key string, data []byte, version string) error
+}
+
+// Lease grants the holder exclusive rights until it expires
+type Lease struct {
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Valid returns true if the lease has not expired
+func (l *Lease) Valid() bool {
+	return l != nil && len(l.Holder) > 0 && time.Now().Before(l.Expires)
+}
+
+// AcquireLease acquires or extends the lease stored under key for holder until
+// ttl from now. Returns false and the current lease if another holder owns it.
+func AcquireLease(storage Storage, key, holder string, ttl time.Duration) (bool, *Lease, error) {
+	vs, ok := storage.(VersionedStorage)
+	if !ok {
+		return false, nil, fmt.Errorf("Storage %s does not support leases", storage)
+	}
+
+	current, version, err := getLease(vs, key)
+	if err != nil {
+		return false, nil, err
+	}
+	if current.Valid() && current.Holder != holder {
+		return false, current, nil
+	}
+
+	now := time.Now()
+	lease := &Lease{Holder: holder, Acquired: now, Expires: now.Add(ttl)}
+	if current.Valid() {
+		lease.Acquired = current.Acquired
+	}
+	if err := putLease(vs, key, lease, version); err != nil {
+		if err == ErrVersionConflict {
+			// Another holder has been faster
+			current, _, err = getLease(vs, key)
+			return false, current, err
+		}
+		return false, nil, err
+	}
+	return true, lease, nil
+}
+
+// ReleaseLease gives up the lease stored under key if it's owned by holder
+func ReleaseLease(storage Storage, key, holder string) error {
+	vs, ok := storage.(VersionedStorage)
+	if !ok {
+		return fmt.Errorf("Storage %s does not support leases", storage)
+	}
+
+	current, version, err := getLease(vs, key)
+	if err != nil || current == nil || current.Holder != holder {
+		return err
+	}
+	return putLease(vs, key, &Lease{}, version)
+}
+
+func getLease(vs VersionedStorage, key string) (*Lease, string, error) {
+	data, version, err := vs.GetVersioned(key)
+	if err == ErrNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read lease '%s': %v", key, err)
+	}
+
+	lease := &Lease{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return nil, "", fmt.Errorf("Failed to parse lease '%s': %v", key, err)
+	}
+	return lease, version, nil
+}
+
+func putLease(vs VersionedStorage, key string, lease *Lease, version string) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	err = vs.PutVersioned(key, data, version)
+	if err != nil && err != ErrVersionConflict {
+		return fmt.Errorf("Failed to write lease '%s': %v", key, err)
+	}
+	return err
+}
+
+// ProbeVersionedStorage checks that the storage actually rejects conflicting writes
+// using a temporary object next to key. Some S3 compatible stores accept but ignore
+// If-Match and If-None-Match, which would let several holders acquire a lease.
+func ProbeVersionedStorage(storage Storage, key string) error {
+	vs, ok := storage.(VersionedStorage)
+	if !ok {
+		return fmt.Errorf("Storage %s does not support leases", storage)
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	probe := key + ".probe-" + token
+	defer storage.Delete(probe)
+
+	if err := vs.PutVersioned(probe, []byte("1"), ""); err != nil {
+		return fmt.Errorf("Failed to write '%s': %v", probe, err)
+	}
+	switch err := vs.PutVersioned(probe, []byte("2"), ""); err {
+	case ErrVersionConflict:
+	case nil:
+		return fmt.Errorf("Storage %s overwrote an existing object despite If-None-Match", storage)
+	default:
+		return fmt.Errorf("Failed to write '%s': %v", probe, err)
+	}
+
+	_, version, err := vs.GetVersioned(probe)
+	if err != nil {
+		return fmt.Errorf("Failed to read '%s': %v", probe, err)
+	}
+	if err := vs.PutVersioned(probe, []byte("3"), version); err != nil {
+		return fmt.Errorf("Failed to write '%s': %v", probe, err)
+	}
+	switch err := vs.PutVersioned(probe, []byte("4"), version); err {
+	case ErrVersionConflict:
+	case nil:
+		return fmt.Errorf("Storage %s overwrote a changed object despite If-Match", storage)
+	default:
+		return fmt.Errorf("Failed to write '%s': %v", probe, err)
+	}
+	return nil
+}
+
+// dataVersion returns a checksum of data for backends without native versions
+func dataVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
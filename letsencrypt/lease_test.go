@@ -0,0 +1,180 @@
+package letsencrypt
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquireLease(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewFileStorage(dir)
+
+	ok, lease, err := AcquireLease(storage, "leader", "a", time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("Expected the lease to be acquired, got %v, %v", ok, err)
+	}
+	acquired := lease.Acquired
+
+	ok, lease, err = AcquireLease(storage, "leader", "b", time.Hour)
+	if err != nil || ok {
+		t.Fatalf("Expected the lease of another holder to be refused, got %v, %v", ok, err)
+	}
+	if lease.Holder != "a" {
+		t.Errorf("Expected the current holder to be returned, got %+v", lease)
+	}
+
+	ok, lease, err = AcquireLease(storage, "leader", "a", time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("Expected the lease to be renewed, got %v, %v", ok, err)
+	}
+	if !lease.Acquired.Equal(acquired) {
+		t.Errorf("Expected a renewal to keep the acquisition time %s, got %s", acquired, lease.Acquired)
+	}
+
+	if err := ReleaseLease(storage, "leader", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := AcquireLease(storage, "leader", "b", time.Hour); ok {
+		t.Fatal("Expected a release by another holder to be ignored")
+	}
+
+	if err := ReleaseLease(storage, "leader", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := AcquireLease(storage, "leader", "b", time.Hour); err != nil || !ok {
+		t.Fatalf("Expected a released lease to be acquired, got %v, %v", ok, err)
+	}
+}
+
+func TestAcquireLeaseExpired(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewFileStorage(dir)
+
+	if ok, _, err := AcquireLease(storage, "leader", "a", 50*time.Millisecond); err != nil || !ok {
+		t.Fatalf("Expected the lease to be acquired, got %v, %v", ok, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ok, lease, err := AcquireLease(storage, "leader", "b", time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("Expected an expired lease to be taken over, got %v, %v", ok, err)
+	}
+	if time.Since(lease.Acquired) > time.Second {
+		t.Errorf("Expected a new acquisition time, got %s", lease.Acquired)
+	}
+}
+
+func TestAcquireLeaseConcurrent(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewFileStorage(dir)
+
+	holders := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	won := make(chan string, len(holders))
+	var wg sync.WaitGroup
+	for _, holder := range holders {
+		wg.Add(1)
+		go func(holder string) {
+			defer wg.Done()
+			ok, _, err := AcquireLease(storage, "leader", holder, time.Hour)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				won <- holder
+			}
+		}(holder)
+	}
+	wg.Wait()
+	close(won)
+
+	var winners []string
+	for holder := range won {
+		winners = append(winners, holder)
+	}
+	if len(winners) != 1 {
+		t.Errorf("Expected exactly one holder to acquire the lease, got %v", winners)
+	}
+}
+
+func TestProbeVersionedStorage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := ProbeVersionedStorage(NewFileStorage(dir), "leader"); err != nil {
+		t.Errorf("File storage: %v", err)
+	}
+
+	fake := newFakeS3("bucket")
+	s3, stop := newTestS3Storage(t, fake, "")
+	defer stop()
+	if err := ProbeVersionedStorage(s3, "leader"); err != nil {
+		t.Errorf("S3 storage: %v", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("Expected the probe object to be deleted, got %d objects", len(fake.objects))
+	}
+
+	consul, stop := newTestConsulStorage(t, newFakeConsul("token"), "token")
+	defer stop()
+	if err := ProbeVersionedStorage(consul, "leader"); err != nil {
+		t.Errorf("Consul storage: %v", err)
+	}
+}
+
+func TestProbeVersionedStorageUnconditional(t *testing.T) {
+	fake := newFakeS3("bucket")
+	fake.conditional = false
+	s3, stop := newTestS3Storage(t, fake, "")
+	defer stop()
+
+	if err := ProbeVersionedStorage(s3, "leader"); err == nil {
+		t.Error("Expected a store ignoring conditional writes to be refused")
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("Expected the probe object to be deleted, got %d objects", len(fake.objects))
+	}
+}
+
+func TestFileLockStale(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewFileStorage(dir)
+
+	// A lock file left behind by a crashed writer
+	stale, err := storage.lock("leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-2 * fileLockTimeout)
+	if err := os.Chtimes(stale.path, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := storage.lock("leader")
+	if err != nil {
+		t.Fatalf("Expected the stale lock file to be taken over: %v", err)
+	}
+	if stale.held() || !lock.held() {
+		t.Fatal("Expected the lock file to hold the token of the new writer")
+	}
+
+	// The crashed writer comes back and must not remove the lock of the new one
+	stale.release()
+	if !lock.held() {
+		t.Fatal("Expected the lock file to survive a release by its former owner")
+	}
+
+	lock.release()
+	if _, err := os.Stat(lock.path); !os.IsNotExist(err) {
+		t.Errorf("Expected the lock file to be removed, got %v", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		t.Errorf("Unexpected file %s left behind", file.Name())
+	}
+}
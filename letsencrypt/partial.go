@@ -0,0 +1,69 @@
+package letsencrypt
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// SetExcludedDomains records the configured domains missing from a partially
+// issued certificate in the meta data of the archived version and its copy
+func (c *Client) SetExcludedDomains(certName string, acmeCert *AcmeCertificate, excluded map[string]string) error {
+	acmeCert.ExcludedDomains = excluded
+
+	certPath := c.CertPath(certName)
+	for _, p := range []string{path.Join(certPath, "archive", acmeCert.SerialNumber), certPath} {
+		if err := writeCertificate(c.storage, p, acmeCert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetStoredPartialCertificate returns the locally stored certificate if it has been
+// issued for the given domains except for the domains that failed validation
+func (c *Client) GetStoredPartialCertificate(certName string, domains []string) (bool, *AcmeCertificate) {
+	if !c.haveCertificateByName(certName) {
+		return false, nil
+	}
+
+	acmeCert, err := c.loadCertificateByName(certName)
+	if err != nil {
+		logrus.Errorf("Error loading certificate '%s': %v", certName, err)
+		return false, nil
+	}
+	if len(acmeCert.ExcludedDomains) == 0 {
+		return false, nil
+	}
+
+	var included []string
+	for _, domain := range domains {
+		if _, ok := acmeCert.ExcludedDomains[domain]; !ok {
+			included = append(included, domain)
+		}
+	}
+	for domain := range acmeCert.ExcludedDomains {
+		if !containsString(domains, domain) {
+			return false, nil
+		}
+	}
+	if !sameDomains(acmeCert.DnsNames, included) {
+		return false, nil
+	}
+
+	logrus.Infof("Stored certificate '%s' lacks domains that failed validation: %s", certName,
+		strings.Join(acmeCert.ExcludedDomainNames(), ","))
+	return true, &acmeCert
+}
+
+// ExcludedDomainNames returns the sorted domains excluded from the certificate
+func (a *AcmeCertificate) ExcludedDomainNames() []string {
+	var names []string
+	for domain := range a.ExcludedDomains {
+		names = append(names, domain)
+	}
+	sort.Strings(names)
+	return names
+}
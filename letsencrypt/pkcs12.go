@@ -0,0 +1,326 @@
+package letsencrypt
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"unicode/utf16"
+)
+
+// Minimal PKCS#12 (RFC 7292) encoder. The private key is shrouded using
+// pbeWithSHAAnd3-KeyTripleDES-CBC, certificates are stored unencrypted
+// and the archive is integrity protected with HMAC-SHA1. This is the
+// layout produced by `openssl pkcs12 -export -certpbe NONE` and is
+// readable by OpenSSL, Java and Windows.
+
+const pkcs12Iterations = 2048
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS8ShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509Certificate  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidPBEWithSHAAnd3KeyTripleD = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidFriendlyName             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidSHA1                     = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12SafeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type pkcs12CertBag struct {
+	Id   asn1.ObjectIdentifier
+	Data asn1.RawValue
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// encodePKCS12 returns a PKCS#12 archive containing the private key and the
+// certificate chain (leaf first) protected with password.
+func encodePKCS12(privateKey crypto.PrivateKey, certs []*x509.Certificate, friendlyName, password string) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("No certificates to encode")
+	}
+
+	pwd := bmpString(password)
+	localKeyId := sha1.Sum(certs[0].Raw)
+
+	leafAttrs, err := bagAttributes(friendlyName, localKeyId[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificate bags
+	var certBags []pkcs12SafeBag
+	for i, cert := range certs {
+		bagBytes, err := asn1.Marshal(pkcs12CertBag{
+			Id:   oidCertTypeX509Certificate,
+			Data: explicitTag(mustMarshal(asn1.Marshal(cert.Raw))),
+		})
+		if err != nil {
+			return nil, err
+		}
+		bag := pkcs12SafeBag{Id: oidCertBag, Value: explicitTag(bagBytes)}
+		if i == 0 {
+			bag.Attributes = leafAttrs
+		}
+		certBags = append(certBags, bag)
+	}
+
+	// Shrouded key bag
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := pbeEncrypt(pkcs8Key, pwd, salt, pkcs12Iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := asn1.Marshal(pkcs12PBEParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyTripleD,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []pkcs12SafeBag{{Id: oidPKCS8ShroudedKeyBag, Value: explicitTag(keyInfo), Attributes: leafAttrs}}
+
+	// Authenticated safe
+	var authSafe []pkcs12ContentInfo
+	for _, bags := range [][]pkcs12SafeBag{certBags, keyBags} {
+		safeContents, err := asn1.Marshal(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, dataContentInfo(safeContents))
+	}
+
+	authSafeBytes, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	macKey := pkcs12KDF(macSalt, pwd, pkcs12Iterations, 3, 20)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authSafeBytes)
+
+	return asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: dataContentInfo(authSafeBytes),
+		MacData: pkcs12MacData{
+			Mac: pkcs12DigestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+func bagAttributes(friendlyName string, localKeyId []byte) ([]pkcs12Attribute, error) {
+	keyIdBytes, err := asn1.Marshal(localKeyId)
+	if err != nil {
+		return nil, err
+	}
+	attrs := []pkcs12Attribute{{Id: oidLocalKeyID, Value: setOf(keyIdBytes)}}
+
+	if friendlyName != "" {
+		name := bmpString(friendlyName)
+		// BMPString without the trailing null terminator
+		nameBytes, err := asn1.Marshal(asn1.RawValue{Tag: 30, Bytes: name[:len(name)-2]})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, pkcs12Attribute{Id: oidFriendlyName, Value: setOf(nameBytes)})
+	}
+
+	return attrs, nil
+}
+
+// dataContentInfo wraps content in a ContentInfo of type data
+func dataContentInfo(content []byte) pkcs12ContentInfo {
+	return pkcs12ContentInfo{
+		ContentType: oidDataContentType,
+		Content:     explicitTag(mustMarshal(asn1.Marshal(content))),
+	}
+}
+
+func explicitTag(content []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content}
+}
+
+func setOf(content []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: content}
+}
+
+func mustMarshal(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// pbeEncrypt encrypts data using pbeWithSHAAnd3-KeyTripleDES-CBC
+func pbeEncrypt(data, password, salt []byte, iterations int) ([]byte, error) {
+	key := pkcs12KDF(salt, password, iterations, 1, 24)
+	iv := pkcs12KDF(salt, password, iterations, 2, 8)
+
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padLen := block.BlockSize() - len(data)%block.BlockSize()
+	padded := make([]byte, len(data)+padLen)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+	return encrypted, nil
+}
+
+// pkcs12KDF implements the key derivation function of RFC 7292 appendix B.2 using SHA-1
+func pkcs12KDF(salt, password []byte, iterations int, id byte, size int) []byte {
+	const u = 20 // SHA-1 output size
+	const v = 64 // SHA-1 block size
+
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+
+	fill := func(in []byte) []byte {
+		if len(in) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(in)+v-1)/v))
+		for i := range out {
+			out[i] = in[i%len(in)]
+		}
+		return out
+	}
+	I := append(fill(salt), fill(password)...)
+
+	var result []byte
+	one := big.NewInt(1)
+	for len(result) < size {
+		h := sha1.New()
+		h.Write(D)
+		h.Write(I)
+		A := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(A)
+			A = sum[:]
+		}
+		result = append(result, A...)
+		if len(result) >= size {
+			break
+		}
+
+		B := make([]byte, v)
+		for i := range B {
+			B[i] = A[i%u]
+		}
+		Bn := new(big.Int).SetBytes(B)
+		mod := new(big.Int).Lsh(one, v*8)
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, Bn)
+			Ij.Add(Ij, one)
+			Ij.Mod(Ij, mod)
+			b := Ij.Bytes()
+			block := I[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(b):], b)
+		}
+	}
+
+	return result[:size]
+}
+
+// bmpString returns s encoded as null terminated UTF-16BE
+func bmpString(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	out := make([]byte, 0, 2*len(encoded)+2)
+	for _, r := range encoded {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}
@@ -0,0 +1,140 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPKCS12KDF(t *testing.T) {
+	salt := []byte("\xff\xff\xff\xff\xff\xff\xff\xff")
+	key := pkcs12KDF(salt, bmpString("sesame"), 2048, 1, 24)
+	expected := []byte("\x7c\xd9\xfd\x3e\x2b\x3b\xe7\x69\x1a\x44\xe3\xbe\xf0\xf9\xea\x0f\xb9\xb8\x97\xd4\xe3\x25\xd9\xd1")
+	if !bytes.Equal(key, expected) {
+		t.Fatalf("Expected key %x, got %x", expected, key)
+	}
+}
+
+// testKeyAndChain returns the parsed private key and certificates of a test certificate
+func testKeyAndChain(t *testing.T) (interface{}, []*x509.Certificate) {
+	certRes := testCertificate(t, 42, time.Now().Add(-time.Hour))
+	certs, err := parsePEMCertificates(certRes.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parsePrivateKey(certRes.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, certs
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	key, certs := testKeyAndChain(t)
+	data, err := encodePKCS12(key, certs, "example", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfx := pfxPdu{}
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		t.Fatalf("Failed to parse PFX: %v", err)
+	}
+	var authSafeBytes []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	pwd := bmpString("secret")
+	mac := hmac.New(sha1.New, pkcs12KDF(pfx.MacData.MacSalt, pwd, pfx.MacData.Iterations, 3, 20))
+	mac.Write(authSafeBytes)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Fatal("MAC does not match")
+	}
+
+	var authSafe []pkcs12ContentInfo
+	if _, err := asn1.Unmarshal(authSafeBytes, &authSafe); err != nil || len(authSafe) != 2 {
+		t.Fatalf("Failed to parse authenticated safe: %v", err)
+	}
+	bags := func(info pkcs12ContentInfo) []pkcs12SafeBag {
+		var content []byte
+		var bags []pkcs12SafeBag
+		if _, err := asn1.Unmarshal(info.Content.Bytes, &content); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := asn1.Unmarshal(content, &bags); err != nil {
+			t.Fatal(err)
+		}
+		return bags
+	}
+
+	certBags := bags(authSafe[0])
+	if len(certBags) != len(certs) {
+		t.Fatalf("Expected %d certificate bags, got %d", len(certs), len(certBags))
+	}
+	certBag := pkcs12CertBag{}
+	if _, err := asn1.Unmarshal(certBags[0].Value.Bytes, &certBag); err != nil {
+		t.Fatal(err)
+	}
+	var der []byte
+	if _, err := asn1.Unmarshal(certBag.Data.Bytes, &der); err != nil || !bytes.Equal(der, certs[0].Raw) {
+		t.Fatalf("Certificate bag does not hold the leaf certificate: %v", err)
+	}
+
+	keyBags := bags(authSafe[1])
+	keyInfo := encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(keyBags[0].Value.Bytes, &keyInfo); err != nil {
+		t.Fatal(err)
+	}
+	params := pkcs12PBEParams{}
+	if _, err := asn1.Unmarshal(keyInfo.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := des.NewTripleDESCipher(pkcs12KDF(params.Salt, pwd, params.Iterations, 1, 24))
+	decrypted := make([]byte, len(keyInfo.EncryptedData))
+	cipher.NewCBCDecrypter(block, pkcs12KDF(params.Salt, pwd, params.Iterations, 2, 8)).CryptBlocks(decrypted, keyInfo.EncryptedData)
+	decrypted = decrypted[:len(decrypted)-int(decrypted[len(decrypted)-1])]
+
+	expected, _ := x509.MarshalPKCS8PrivateKey(key)
+	if !bytes.Equal(decrypted, expected) {
+		t.Fatal("Decrypted private key does not match")
+	}
+}
+
+// TestEncodePKCS12OpenSSL checks that OpenSSL reads the archive, if it's installed
+func TestEncodePKCS12OpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not installed")
+	}
+
+	key, certs := testKeyAndChain(t)
+	data, err := encodePKCS12(key, certs, "example", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cert.p12")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(openssl, "pkcs12", "-in", file, "-passin", "pass:secret", "-nodes").CombinedOutput()
+	if err != nil {
+		t.Fatalf("OpenSSL failed to read the archive: %v\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte("PRIVATE KEY")) || !bytes.Contains(out, []byte("CERTIFICATE")) {
+		t.Fatalf("OpenSSL output lacks key or certificate:\n%s", out)
+	}
+}
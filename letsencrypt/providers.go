@@ -68,6 +68,10 @@ type ProviderOpts struct {
 
 	// Vultr credentials
 	VultrApiKey string
+
+	// Storage shared with other instances answering HTTP challenges,
+	// the challenges are answered by a temporary server if not set
+	HTTPStorage Storage
 }
 
 type Provider string
@@ -277,6 +281,9 @@ func makeGandiProvider(opts ProviderOpts) (lego.ChallengeProvider, error) {
 
 // returns a preconfigured HTTP lego.ChallengeProvider
 func makeHTTPProvider(opts ProviderOpts) (lego.ChallengeProvider, error) {
+	if opts.HTTPStorage != nil {
+		return NewSharedHTTPProvider(opts.HTTPStorage), nil
+	}
 	provider := lego.NewHTTPProviderServer("", "")
 	return provider, nil
 }
@@ -0,0 +1,358 @@
+package letsencrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	lego "github.com/xenolf/lego/acme"
+	"golang.org/x/net/publicsuffix"
+)
+
+// RateLimit allows Count events per sliding Window, a Count of 0 disables the limit
+type RateLimit struct {
+	Count  int
+	Window time.Duration
+}
+
+// RateLimits mirrors the limits published by the CA
+type RateLimits struct {
+	// Certificates per registered domain, renewals are exempt
+	CertificatesPerDomain RateLimit
+	// Certificates for the exact same set of domains
+	DuplicateCertificates RateLimit
+	// Failed validations per account and hostname
+	FailedValidations RateLimit
+	// New orders per account
+	NewOrders RateLimit
+}
+
+// DefaultRateLimits returns the limits of the Let's Encrypt production CA
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		CertificatesPerDomain: RateLimit{50, 7 * 24 * time.Hour},
+		DuplicateCertificates: RateLimit{5, 7 * 24 * time.Hour},
+		FailedValidations:     RateLimit{5, time.Hour},
+		NewOrders:             RateLimit{300, 3 * time.Hour},
+	}
+}
+
+// ParseRateLimits overrides limits with a comma separated list
+// of name=count/window, e.g. "failed_validations=5/1h"
+func ParseRateLimits(str string, limits RateLimits) (RateLimits, error) {
+	fields := map[string]*RateLimit{
+		"certificates_per_domain": &limits.CertificatesPerDomain,
+		"duplicate_certificates":  &limits.DuplicateCertificates,
+		"failed_validations":      &limits.FailedValidations,
+		"new_orders":              &limits.NewOrders,
+	}
+
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		limit, ok := fields[strings.TrimSpace(parts[0])]
+		if !ok || len(parts) != 2 {
+			return limits, fmt.Errorf("Invalid rate limit: %s", item)
+		}
+		value := strings.SplitN(strings.TrimSpace(parts[1]), "/", 2)
+		count, err := strconv.Atoi(value[0])
+		if err != nil || count < 0 || len(value) != 2 {
+			return limits, fmt.Errorf("Invalid rate limit: %s", item)
+		}
+		window, err := time.ParseDuration(value[1])
+		if err != nil || window <= 0 {
+			return limits, fmt.Errorf("Invalid rate limit window: %s", item)
+		}
+		*limit = RateLimit{count, window}
+	}
+	return limits, nil
+}
+
+// RateLimitError is returned if a request would exceed a rate limit
+type RateLimitError struct {
+	Limit string
+	Key   string
+	// Time the request is allowed again
+	RetryAfter time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Rate limit '%s' for %s exceeded until %s", e.Limit, e.Key, e.RetryAfter.UTC().Format(time.RFC3339))
+}
+
+// Quota describes the remaining requests within a rate limit
+type Quota struct {
+	Limit     string
+	Key       string
+	Remaining int
+	Max       int
+}
+
+const (
+	ledgerOrder    = "order"
+	ledgerIssuance = "issuance"
+	ledgerFailure  = "failure"
+)
+
+type ledgerEntry struct {
+	Kind    string    `json:"kind"`
+	Account string    `json:"account"`
+	Domains []string  `json:"domains"`
+	Renewal bool      `json:"renewal,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Ledger records the requests sent to a CA to enforce its rate limits locally
+type Ledger struct {
+	storage Storage
+	key     string
+	limits  RateLimits
+
+	mu      sync.Mutex
+	entries []ledgerEntry
+}
+
+// NewLedger loads the ledger of the CA from storage
+func NewLedger(storage Storage, apiVer ApiVersion, limits RateLimits) (*Ledger, error) {
+	l := &Ledger{
+		storage: storage,
+		key:     path.Join(strings.ToLower(string(apiVer)), "ratelimits.json"),
+		limits:  limits,
+	}
+
+	data, err := storage.Get(l.key)
+	if err == ErrNotFound {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load rate limit ledger: %v", err)
+	}
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		return nil, fmt.Errorf("Failed to parse rate limit ledger: %v", err)
+	}
+	return l, nil
+}
+
+// Check returns a RateLimitError if an order for the domains would exceed a limit
+func (l *Ledger) Check(account string, domains []string, renewal bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, q := range l.quota(account, domains, renewal, now) {
+		if q.Remaining <= 0 {
+			return &RateLimitError{Limit: q.Limit, Key: q.Key, RetryAfter: q.reset}
+		}
+	}
+	return nil
+}
+
+// Quota returns the remaining requests of all limits applying to an order for the domains
+func (l *Ledger) Quota(account string, domains []string) []Quota {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var quota []Quota
+	for _, q := range l.quota(account, domains, false, time.Now()) {
+		quota = append(quota, q.Quota)
+	}
+	return quota
+}
+
+type quotaState struct {
+	Quota
+	// Time the oldest counted event leaves the window
+	reset time.Time
+}
+
+func (l *Ledger) quota(account string, domains []string, renewal bool, now time.Time) []quotaState {
+	var quota []quotaState
+
+	add := func(name, key string, limit RateLimit, match func(e ledgerEntry) bool) {
+		if limit.Count == 0 {
+			return
+		}
+		q := quotaState{Quota: Quota{Limit: name, Key: key, Max: limit.Count}}
+		var times []time.Time
+		for _, e := range l.entries {
+			if now.Sub(e.Time) < limit.Window && match(e) {
+				times = append(times, e.Time)
+			}
+		}
+		q.Remaining = limit.Count - len(times)
+		if q.Remaining <= 0 {
+			// Wait until enough events have left the window,
+			// entries are recorded in chronological order
+			q.reset = times[len(times)-limit.Count].Add(limit.Window)
+		}
+		quota = append(quota, q)
+	}
+
+	add("new_orders", account, l.limits.NewOrders, func(e ledgerEntry) bool {
+		return e.Kind == ledgerOrder && e.Account == account
+	})
+
+	set := domainSet(domains)
+	add("duplicate_certificates", strings.Join(domains, ","), l.limits.DuplicateCertificates, func(e ledgerEntry) bool {
+		return e.Kind == ledgerIssuance && domainSet(e.Domains) == set
+	})
+
+	for _, domain := range domains {
+		hostname := domain
+		add("failed_validations", hostname, l.limits.FailedValidations, func(e ledgerEntry) bool {
+			return e.Kind == ledgerFailure && e.Account == account && containsString(e.Domains, hostname)
+		})
+	}
+
+	if !renewal {
+		for _, registered := range registeredDomains(domains) {
+			name := registered
+			add("certificates_per_domain", name, l.limits.CertificatesPerDomain, func(e ledgerEntry) bool {
+				return e.Kind == ledgerIssuance && !e.Renewal && containsString(registeredDomains(e.Domains), name)
+			})
+		}
+	}
+
+	return quota
+}
+
+// record adds an entry to the ledger, drops expired entries and saves it
+func (l *Ledger) record(kind, account string, domains []string, renewal bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	maxWindow := l.limits.maxWindow()
+	var entries []ledgerEntry
+	for _, e := range l.entries {
+		if now.Sub(e.Time) < maxWindow {
+			entries = append(entries, e)
+		}
+	}
+	l.entries = append(entries, ledgerEntry{
+		Kind:    kind,
+		Account: account,
+		Domains: domains,
+		Renewal: renewal,
+		Time:    now.UTC(),
+	})
+
+	data, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return l.storage.Put(l.key, data)
+}
+
+func (r RateLimits) maxWindow() time.Duration {
+	max := time.Duration(0)
+	for _, limit := range []RateLimit{r.CertificatesPerDomain, r.DuplicateCertificates, r.FailedValidations, r.NewOrders} {
+		if limit.Window > max {
+			max = limit.Window
+		}
+	}
+	return max
+}
+
+// RegisteredDomain returns the registered domain (eTLD+1) of a domain
+func RegisteredDomain(domain string) string {
+	domain = strings.TrimPrefix(domain, "*.")
+	if registered, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return registered
+	}
+	return domain
+}
+
+// registeredDomains returns the distinct registered domains of the domains
+func registeredDomains(domains []string) []string {
+	var registered []string
+	for _, domain := range domains {
+		if r := RegisteredDomain(domain); !containsString(registered, r) {
+			registered = append(registered, r)
+		}
+	}
+	return registered
+}
+
+// domainSet returns an order independent identifier of the domains
+func domainSet(domains []string) string {
+	sorted := append([]string{}, domains...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRateLimits enables the local enforcement of the rate limits of the CA
+func (c *Client) SetRateLimits(limits RateLimits) error {
+	ledger, err := NewLedger(c.storage, c.apiVersion, limits)
+	if err != nil {
+		return err
+	}
+	c.ledger = ledger
+	return nil
+}
+
+// CheckRateLimits returns a RateLimitError if ordering a certificate
+// for the domains would exceed a rate limit of the CA
+func (c *Client) CheckRateLimits(domains []string, renewal bool) error {
+	if c.ledger == nil {
+		return nil
+	}
+	return c.ledger.Check(c.account.path, domains, renewal)
+}
+
+// RateLimitQuota returns the remaining quota for ordering a certificate for the domains
+func (c *Client) RateLimitQuota(domains []string) []Quota {
+	if c.ledger == nil {
+		return nil
+	}
+	return c.ledger.Quota(c.account.path, domains)
+}
+
+// isValidationFailure returns true if err reports a challenge the CA failed to
+// validate. Other errors, e.g. of the DNS provider or the network, don't count
+// against the failed validations limit. The error type of lego is unexported,
+// it's the only error embedding a RemoteError besides TOSError and NonceError.
+func isValidationFailure(err error) bool {
+	switch err.(type) {
+	case nil, lego.RemoteError, lego.TOSError, lego.NonceError:
+		return false
+	}
+	v := reflect.ValueOf(err)
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	field := v.FieldByName("RemoteError")
+	if !field.IsValid() {
+		return false
+	}
+	_, ok := field.Interface().(lego.RemoteError)
+	return ok
+}
+
+func (c *Client) recordRateLimit(kind string, domains []string, renewal bool) {
+	if c.ledger == nil {
+		return
+	}
+	if err := c.ledger.record(kind, c.account.path, domains, renewal); err != nil {
+		logrus.Warnf("Failed to update rate limit ledger: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package letsencrypt
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	lego "github.com/xenolf/lego/acme"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("failed_validations=3/30m, new_orders=0/1h", DefaultRateLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.FailedValidations != (RateLimit{3, 30 * time.Minute}) {
+		t.Errorf("Unexpected failed_validations limit %v", limits.FailedValidations)
+	}
+	if limits.NewOrders.Count != 0 {
+		t.Errorf("Expected new_orders to be disabled, got %v", limits.NewOrders)
+	}
+	if limits.DuplicateCertificates != DefaultRateLimits().DuplicateCertificates {
+		t.Errorf("Expected duplicate_certificates to keep its default, got %v", limits.DuplicateCertificates)
+	}
+
+	for _, str := range []string{"unknown=1/1h", "new_orders", "new_orders=x/1h", "new_orders=-1/1h", "new_orders=1", "new_orders=1/0s", "new_orders=1/day"} {
+		if _, err := ParseRateLimits(str, DefaultRateLimits()); err == nil {
+			t.Errorf("Expected an error for %q", str)
+		}
+	}
+}
+
+func newTestLedger(t *testing.T, limits RateLimits) (*Ledger, Storage, func()) {
+	dir := tempDir(t)
+	storage := NewFileStorage(dir)
+	ledger, err := NewLedger(storage, Sandbox, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ledger, storage, func() { os.RemoveAll(dir) }
+}
+
+func expectRateLimit(t *testing.T, err error, limit, key string) {
+	rateLimitErr, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("Expected rate limit '%s' for %s to be exceeded, got %v", limit, key, err)
+	}
+	if rateLimitErr.Limit != limit || rateLimitErr.Key != key {
+		t.Errorf("Expected rate limit '%s' for %s to be exceeded, got %v", limit, key, err)
+	}
+}
+
+func TestLedgerDuplicateCertificates(t *testing.T) {
+	ledger, _, done := newTestLedger(t, RateLimits{DuplicateCertificates: RateLimit{2, time.Hour}})
+	defer done()
+
+	domains := []string{"example.com", "www.example.com"}
+	before := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := ledger.Check("account", domains, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := ledger.record(ledgerIssuance, "account", domains, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same set of domains in a different order
+	err := ledger.Check("account", []string{"www.example.com", "example.com"}, false)
+	expectRateLimit(t, err, "duplicate_certificates", "www.example.com,example.com")
+	if retry := err.(*RateLimitError).RetryAfter; retry.Before(before.Add(time.Hour)) || retry.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected the limit to reset an hour after the first issuance, got %s", retry)
+	}
+
+	if err := ledger.Check("account", []string{"example.com"}, false); err != nil {
+		t.Errorf("Expected a different set of domains to be allowed: %v", err)
+	}
+}
+
+func TestLedgerCertificatesPerDomain(t *testing.T) {
+	ledger, _, done := newTestLedger(t, RateLimits{CertificatesPerDomain: RateLimit{1, time.Hour}})
+	defer done()
+
+	if err := ledger.record(ledgerIssuance, "account", []string{"a.example.com"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ledger.Check("account", []string{"b.example.com"}, false)
+	expectRateLimit(t, err, "certificates_per_domain", "example.com")
+
+	if err := ledger.Check("account", []string{"b.example.com"}, true); err != nil {
+		t.Errorf("Expected renewals to be exempt: %v", err)
+	}
+	if err := ledger.Check("account", []string{"example.org"}, false); err != nil {
+		t.Errorf("Expected another registered domain to be allowed: %v", err)
+	}
+}
+
+func TestLedgerFailedValidations(t *testing.T) {
+	ledger, storage, done := newTestLedger(t, RateLimits{FailedValidations: RateLimit{2, time.Hour}})
+	defer done()
+
+	for i := 0; i < 2; i++ {
+		if err := ledger.record(ledgerFailure, "account", []string{"www.example.com"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := ledger.Check("account", []string{"example.com", "www.example.com"}, true)
+	expectRateLimit(t, err, "failed_validations", "www.example.com")
+
+	if err := ledger.Check("other", []string{"www.example.com"}, false); err != nil {
+		t.Errorf("Expected failures of another account not to count: %v", err)
+	}
+	if err := ledger.Check("account", []string{"example.com"}, false); err != nil {
+		t.Errorf("Expected another hostname to be allowed: %v", err)
+	}
+
+	// The ledger survives restarts
+	reloaded, err := NewLedger(storage, Sandbox, ledger.limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRateLimit(t, reloaded.Check("account", []string{"www.example.com"}, false), "failed_validations", "www.example.com")
+}
+
+func TestLedgerQuota(t *testing.T) {
+	ledger, _, done := newTestLedger(t, RateLimits{NewOrders: RateLimit{3, time.Hour}})
+	defer done()
+
+	if err := ledger.record(ledgerOrder, "account", []string{"example.com"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	quota := ledger.Quota("account", []string{"example.com"})
+	if len(quota) != 1 || quota[0].Limit != "new_orders" || quota[0].Remaining != 2 || quota[0].Max != 3 {
+		t.Errorf("Unexpected quota %+v", quota)
+	}
+}
+
+func TestLedgerDropsExpiredEntries(t *testing.T) {
+	ledger, _, done := newTestLedger(t, RateLimits{NewOrders: RateLimit{1, time.Hour}})
+	defer done()
+
+	ledger.entries = []ledgerEntry{{Kind: ledgerOrder, Account: "account", Time: time.Now().Add(-2 * time.Hour)}}
+	if err := ledger.Check("account", []string{"example.com"}, false); err != nil {
+		t.Errorf("Expected entries outside the window not to count: %v", err)
+	}
+
+	if err := ledger.record(ledgerOrder, "account", []string{"example.com"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(ledger.entries) != 1 {
+		t.Errorf("Expected the expired entry to be dropped, got %d entries", len(ledger.entries))
+	}
+}
+
+// challengeError mirrors the unexported error lego returns for invalid challenges
+type challengeError struct {
+	lego.RemoteError
+	records []string
+}
+
+func TestIsValidationFailure(t *testing.T) {
+	remote := lego.RemoteError{StatusCode: 403, Type: "urn:acme:error:unauthorized", Detail: "Invalid response"}
+
+	if !isValidationFailure(challengeError{RemoteError: remote}) {
+		t.Error("Expected a challenge error to be a validation failure")
+	}
+	for _, err := range []error{
+		nil,
+		errors.New("DNS provider failed"),
+		remote,
+		lego.TOSError{RemoteError: remote},
+		lego.NonceError{RemoteError: remote},
+		&RateLimitError{Limit: "new_orders"},
+	} {
+		if isValidationFailure(err) {
+			t.Errorf("Expected %#v not to be a validation failure", err)
+		}
+	}
+}
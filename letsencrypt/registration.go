@@ -0,0 +1,302 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	lego "github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// QueryRegistration fetches the current state of the account registration
+// from the CA and stores it in the local account.
+func (c *Client) QueryRegistration() (*lego.RegistrationResource, error) {
+	if err := c.checkRegistration(); err != nil {
+		return nil, err
+	}
+
+	reg, err := c.client.QueryRegistration()
+	if err != nil {
+		return nil, err
+	}
+
+	c.account.Registration = reg
+	c.account.Status = AccountStatusValid
+	if err := c.account.Save(); err != nil {
+		return nil, fmt.Errorf("Could not save account data: %v", err)
+	}
+
+	return reg, nil
+}
+
+// UpdateContacts replaces the contact email addresses of the account
+// registration. The first address becomes the primary account email.
+func (c *Client) UpdateContacts(emails []string) error {
+	if err := c.checkRegistration(); err != nil {
+		return err
+	}
+
+	if len(emails) == 0 {
+		return fmt.Errorf("At least one contact email is required")
+	}
+
+	contacts := make([]string, len(emails))
+	for i, email := range emails {
+		contacts[i] = "mailto:" + email
+	}
+
+	reg := c.account.Registration
+	regMsg := map[string]interface{}{
+		"resource": "reg",
+		"contact":  contacts,
+	}
+	if reg.Body.Agreement != "" {
+		regMsg["agreement"] = reg.Body.Agreement
+	}
+
+	var serverReg lego.Registration
+	_, err := c.postSigned(c.account.key, reg.URI, regMsg, &serverReg)
+	if err != nil {
+		return fmt.Errorf("Failed to update registration contacts: %v", err)
+	}
+
+	reg.Body = serverReg
+	c.account.Email = emails[0]
+	c.account.Contacts = emails
+	if err := c.account.Save(); err != nil {
+		return fmt.Errorf("Could not save account data: %v", err)
+	}
+
+	logrus.Infof("Updated account contacts to %s", strings.Join(emails, ","))
+	return nil
+}
+
+// RolloverKey replaces the account key with a newly generated key
+// of the same type and registers the new key with the CA.
+func (c *Client) RolloverKey() error {
+	if err := c.checkRegistration(); err != nil {
+		return err
+	}
+
+	dir, err := c.getDirectory()
+	if err != nil {
+		return err
+	}
+
+	keyChangeUrl := dir["key-change"]
+	if keyChangeUrl == "" {
+		return fmt.Errorf("CA does not support account key rollover")
+	}
+
+	keyFile := path.Join(c.account.path, "account.key")
+	newKeyFile := keyFile + ".new"
+	newKey, err := generatePrivateKey(c.keyType)
+	if err != nil {
+		return fmt.Errorf("Error generating private key: %v", err)
+	}
+	// Persist the new key before using it, so that it can't get lost
+	if err := savePrivateKey(c.storage, newKeyFile, newKey); err != nil {
+		return fmt.Errorf("Error saving private key: %v", err)
+	}
+
+	newJwk := &jose.JsonWebKey{Key: publicKey(newKey)}
+	inner, err := json.Marshal(map[string]interface{}{
+		"account": c.account.Registration.URI,
+		"newKey":  newJwk,
+	})
+	if err != nil {
+		c.storage.Delete(newKeyFile)
+		return err
+	}
+
+	innerJws, err := signPayload(newKey, inner, nil)
+	if err != nil {
+		c.storage.Delete(newKeyFile)
+		return fmt.Errorf("Failed to sign key change request: %v", err)
+	}
+
+	var keyChange map[string]interface{}
+	if err := json.Unmarshal([]byte(innerJws.FullSerialize()), &keyChange); err != nil {
+		c.storage.Delete(newKeyFile)
+		return err
+	}
+	keyChange["resource"] = "key-change"
+
+	_, err = c.postSigned(c.account.key, keyChangeUrl, keyChange, nil)
+	if err != nil {
+		c.storage.Delete(newKeyFile)
+		return fmt.Errorf("Failed to roll over account key: %v", err)
+	}
+
+	// The CA accepted the new key. Keep the old one around for reference.
+	if err := savePrivateKey(c.storage, keyFile+".old", c.account.key); err != nil {
+		logrus.Warnf("Failed to back up old account key: %v", err)
+	}
+	if err := savePrivateKey(c.storage, keyFile, newKey); err != nil {
+		return fmt.Errorf("Account key was rolled over but could not be saved to %s: %v", keyFile, err)
+	}
+	c.storage.Delete(newKeyFile)
+
+	c.account.key = newKey
+	if err := c.reloadClient(); err != nil {
+		return err
+	}
+
+	logrus.Infof("Rolled over account key for %s", c.account.Email)
+	return nil
+}
+
+// DeactivateAccount deactivates the account registration on the CA.
+// A deactivated account can not be used to obtain or renew certificates.
+func (c *Client) DeactivateAccount() error {
+	if err := c.checkRegistration(); err != nil {
+		return err
+	}
+
+	if err := c.client.DeleteRegistration(); err != nil {
+		return fmt.Errorf("Failed to deactivate account: %v", err)
+	}
+
+	c.account.Status = AccountStatusDeactivated
+	if err := c.account.Save(); err != nil {
+		return fmt.Errorf("Could not save account data: %v", err)
+	}
+
+	logrus.Infof("Deactivated account for %s", c.account.Email)
+	return nil
+}
+
+// Account returns the Let's Encrypt account used by the client
+func (c *Client) Account() *Account {
+	return c.account
+}
+
+func (c *Client) checkRegistration() error {
+	if c.account.Registration == nil {
+		return fmt.Errorf("Account for %s is not registered", c.account.Email)
+	}
+	if c.account.IsDeactivated() {
+		return fmt.Errorf("Account for %s has been deactivated", c.account.Email)
+	}
+	return nil
+}
+
+func (c *Client) getDirectory() (map[string]string, error) {
+	resp, err := http.Get(c.serverUri)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get directory at '%s': %v", c.serverUri, err)
+	}
+	defer resp.Body.Close()
+
+	dir := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return nil, fmt.Errorf("Failed to parse directory at '%s': %v", c.serverUri, err)
+	}
+
+	return dir, nil
+}
+
+// postSigned posts a JWS signed message to the given URL and
+// decodes the JSON response into respBody unless it is nil.
+func (c *Client) postSigned(key crypto.PrivateKey, url string, reqBody, respBody interface{}) (http.Header, error) {
+	payload, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := signPayload(key, payload, &nonceSource{c.serverUri})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(url, "application/jose+json", bytes.NewBufferString(signed.FullSerialize()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := ioutil.ReadAll(resp.Body)
+		problem := struct {
+			Type   string `json:"type"`
+			Detail string `json:"detail"`
+		}{}
+		if json.Unmarshal(body, &problem) == nil && problem.Detail != "" {
+			return resp.Header, fmt.Errorf("%d %s: %s", resp.StatusCode, problem.Type, problem.Detail)
+		}
+		return resp.Header, fmt.Errorf("%d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if respBody == nil {
+		return resp.Header, nil
+	}
+
+	return resp.Header, json.NewDecoder(resp.Body).Decode(respBody)
+}
+
+type nonceSource struct {
+	directoryUrl string
+}
+
+// Nonce fetches a fresh replay nonce from the CA
+func (n *nonceSource) Nonce() (string, error) {
+	resp, err := http.Head(n.directoryUrl)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get nonce: %v", err)
+	}
+	resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("Server did not respond with a nonce")
+	}
+	return nonce, nil
+}
+
+func signPayload(key crypto.PrivateKey, payload []byte, nonces jose.NonceSource) (*jose.JsonWebSignature, error) {
+	var alg jose.SignatureAlgorithm
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P256() {
+			alg = jose.ES256
+		} else if k.Curve == elliptic.P384() {
+			alg = jose.ES384
+		} else {
+			return nil, fmt.Errorf("Unsupported elliptic curve %s", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T", key)
+	}
+
+	signer, err := jose.NewSigner(alg, key)
+	if err != nil {
+		return nil, err
+	}
+	if nonces != nil {
+		signer.SetNonceSource(nonces)
+	}
+
+	return signer.Sign(payload)
+}
+
+func publicKey(key crypto.PrivateKey) crypto.PublicKey {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	}
+	return nil
+}
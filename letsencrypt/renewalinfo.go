@@ -0,0 +1,135 @@
+package letsencrypt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RenewalWindow is the time span in which the CA suggests
+// renewing a certificate (ACME Renewal Information, RFC 9773)
+type RenewalWindow struct {
+	Start time.Time
+	End   time.Time
+	// Optional page explaining why the window was moved, e.g. an upcoming revocation
+	ExplanationURL string
+	// When to ask the CA again, zero if the CA did not say
+	RetryAfter time.Time
+}
+
+var renewalInfoHttpClient = &http.Client{Timeout: 30 * time.Second}
+
+// ValidityPeriod returns the validity period of the leaf certificate
+func ValidityPeriod(acmeCert *AcmeCertificate) (notBefore, notAfter time.Time, err error) {
+	certs, err := parsePEMCertificates(acmeCert.Certificate)
+	if err != nil {
+		return notBefore, notAfter, err
+	}
+	if len(certs) == 0 {
+		return notBefore, notAfter, fmt.Errorf("No certificate found")
+	}
+	return certs[0].NotBefore, certs[0].NotAfter, nil
+}
+
+// RenewalInfo returns the renewal window suggested by the CA for the
+// given certificate, nil if the CA doesn't support renewal information
+func (c *Client) RenewalInfo(acmeCert *AcmeCertificate) (*RenewalWindow, error) {
+	uri, err := c.renewalInfoUri()
+	if err != nil || uri == "" {
+		return nil, err
+	}
+
+	certId, err := renewalCertId(acmeCert)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := renewalInfoHttpClient.Get(strings.TrimSuffix(uri, "/") + "/" + certId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get renewal information: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get renewal information: %s", resp.Status)
+	}
+
+	info := struct {
+		SuggestedWindow struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		} `json:"suggestedWindow"`
+		ExplanationURL string `json:"explanationURL"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("Failed to parse renewal information: %v", err)
+	}
+	if !info.SuggestedWindow.End.After(info.SuggestedWindow.Start) {
+		return nil, fmt.Errorf("Invalid renewal window from %s to %s", info.SuggestedWindow.Start, info.SuggestedWindow.End)
+	}
+
+	return &RenewalWindow{
+		Start:          info.SuggestedWindow.Start,
+		End:            info.SuggestedWindow.End,
+		ExplanationURL: info.ExplanationURL,
+		RetryAfter:     parseRetryAfter(resp.Header.Get("Retry-After")),
+	}, nil
+}
+
+// renewalInfoUri returns the renewal information endpoint listed
+// in the directory of the CA, empty if there is none
+func (c *Client) renewalInfoUri() (string, error) {
+	resp, err := renewalInfoHttpClient.Get(c.serverUri)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get directory at '%s': %v", c.serverUri, err)
+	}
+	defer resp.Body.Close()
+
+	dir := struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return "", fmt.Errorf("Failed to parse directory at '%s': %v", c.serverUri, err)
+	}
+	return dir.RenewalInfo, nil
+}
+
+// renewalCertId returns the identifier of the certificate in renewal information
+// requests, the authority key identifier and the DER encoded serial number
+func renewalCertId(acmeCert *AcmeCertificate) (string, error) {
+	certs, err := parsePEMCertificates(acmeCert.Certificate)
+	if err != nil {
+		return "", err
+	}
+	if len(certs) == 0 {
+		return "", fmt.Errorf("No certificate found")
+	}
+	leaf := certs[0]
+	if len(leaf.AuthorityKeyId) == 0 {
+		return "", fmt.Errorf("Certificate has no authority key identifier")
+	}
+
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(leaf.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as HTTP date
+func parseRetryAfter(val string) time.Time {
+	if val == "" {
+		return time.Time{}
+	}
+	if seconds, err := strconv.Atoi(val); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return t
+	}
+	return time.Time{}
+}
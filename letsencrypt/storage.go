@@ -0,0 +1,369 @@
+package letsencrypt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by a Storage if the requested key does not exist
+var ErrNotFound = errors.New("Not found")
+
+// fileLockTimeout is how long lock files of the FileStorage are respected.
+// Writers must finish within this time.
+const fileLockTimeout = 10 * time.Second
+
+// Storage persists account and certificate data.
+// Keys are slash separated paths relative to the storage root,
+// e.g. "production/certs/example.com/fullchain.pem".
+type Storage interface {
+	// Get returns the data stored under key or ErrNotFound
+	Get(key string) ([]byte, error)
+	// Put stores data under key, replacing existing data
+	Put(key string, data []byte) error
+	// Delete removes the data stored under key
+	Delete(key string) error
+	// Exists returns true if data is stored under key
+	Exists(key string) (bool, error)
+	// List returns all keys below the directory prefix, or all keys if it's empty
+	List(prefix string) ([]string, error)
+	// String describes the storage location for log messages
+	String() string
+}
+
+// StorageOpts is used to configure the storage backend
+type StorageOpts struct {
+	Backend StorageBackend
+
+	// Local filesystem
+	Path string
+
+	// S3 compatible object store
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3Prefix    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// Consul KV store
+	ConsulAddress string
+	ConsulPrefix  string
+	ConsulToken   string
+
+	// Encryption of private keys at rest
+	EncryptionPassphrase string
+	EncryptionKeyFile    string
+	// Key used before the last rekey, for reading objects not rekeyed yet
+	PreviousEncryptionPassphrase string
+	PreviousEncryptionKeyFile    string
+}
+
+type StorageBackend string
+
+const (
+	FILE   = StorageBackend("file")
+	S3     = StorageBackend("s3")
+	CONSUL = StorageBackend("consul")
+)
+
+// NewStorage returns the storage backend configured by opts
+func NewStorage(opts StorageOpts) (Storage, error) {
+	var storage Storage
+	var err error
+
+	switch opts.Backend {
+	case FILE, "":
+		root := opts.Path
+		if len(root) == 0 {
+			root = StorageDir
+		}
+		storage = NewFileStorage(root)
+	case S3:
+		storage, err = NewS3Storage(opts)
+	case CONSUL:
+		storage, err = NewConsulStorage(opts)
+	default:
+		return nil, fmt.Errorf("Unsupported storage backend: %s", opts.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kek, err := NewKeyEncryptionKey(opts.EncryptionPassphrase, opts.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := NewKeyEncryptionKey(opts.PreviousEncryptionPassphrase, opts.PreviousEncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && kek == nil {
+		return nil, fmt.Errorf("Previous encryption key is set without a current one")
+	}
+	if kek != nil {
+		encrypted := NewEncryptedStorage(storage, kek)
+		encrypted.SetPreviousKey(previous)
+		storage = encrypted
+	}
+
+	return storage, nil
+}
+
+// FileStorage stores data in a directory of the local filesystem
+type FileStorage struct {
+	root string
+}
+
+// NewFileStorage returns a storage using the given root directory
+func NewFileStorage(root string) *FileStorage {
+	return &FileStorage{root: root}
+}
+
+func (s *FileStorage) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.filePath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Put writes data to a temporary file and renames it to the target file,
+// so that readers never see partially written data.
+func (s *FileStorage) Put(key string, data []byte) error {
+	file := s.filePath(key)
+	dir := filepath.Dir(file)
+	maybeCreatePath(dir)
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *FileStorage) Delete(key string) error {
+	file := s.filePath(key)
+	err := os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		// Clean up the directory if it's empty now
+		os.Remove(filepath.Dir(file))
+	}
+	return err
+}
+
+func (s *FileStorage) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.filePath(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *FileStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	root := s.filePath(prefix)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && p != root && !strings.HasPrefix(info.Name(), ".") {
+			rel, _ := filepath.Rel(s.root, p)
+			keys = append(keys, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// GetVersioned returns the data stored under key and its checksum as version
+func (s *FileStorage) GetVersioned(key string) ([]byte, string, error) {
+	data, err := s.Get(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, dataVersion(data), nil
+}
+
+// PutVersioned serializes writers using an exclusively created lock file,
+// which also works for instances sharing the directory on a network volume
+func (s *FileStorage) PutVersioned(key string, data []byte, version string) error {
+	lock, err := s.lock(key)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	current, err := s.Get(key)
+	switch {
+	case err == ErrNotFound:
+		if version != "" {
+			return ErrVersionConflict
+		}
+	case err != nil:
+		return err
+	case dataVersion(current) != version:
+		return ErrVersionConflict
+	}
+
+	// The lock may have been taken over if this writer stalled for fileLockTimeout
+	if !lock.held() {
+		return fmt.Errorf("Lost lock file %s", lock.path)
+	}
+	return s.Put(key, data)
+}
+
+// fileLock is a lock file holding a token unique to its owner
+type fileLock struct {
+	path  string
+	token string
+}
+
+// lock creates the lock file of key. Lock files left behind by crashed
+// writers are taken over after fileLockTimeout.
+func (s *FileStorage) lock(key string) (*fileLock, error) {
+	file := s.filePath(key)
+	dir := filepath.Dir(file)
+	maybeCreatePath(dir)
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	lock := &fileLock{path: filepath.Join(dir, "."+filepath.Base(file)+".lock"), token: token}
+
+	deadline := time.Now().Add(fileLockTimeout)
+	for {
+		f, err := os.OpenFile(lock.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = f.WriteString(lock.token)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lock.path)
+				return nil, err
+			}
+			return lock, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// Read the token before checking the age, so that only the stale lock file is removed
+		stale, err := ioutil.ReadFile(lock.path)
+		if info, statErr := os.Stat(lock.path); err == nil && statErr == nil && time.Since(info.ModTime()) > fileLockTimeout {
+			removeLockFile(lock.path, string(stale))
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for lock file %s", lock.path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// held returns true if the lock file still holds the token of this lock
+func (l *fileLock) held() bool {
+	data, err := ioutil.ReadFile(l.path)
+	return err == nil && string(data) == l.token
+}
+
+// release removes the lock file unless another writer has taken it over
+func (l *fileLock) release() {
+	removeLockFile(l.path, l.token)
+}
+
+// removeLockFile removes the lock file if it holds token. The file is moved aside
+// before checking the token, so that a lock file created by another writer in the
+// meantime is never removed. Such a file is put back unless a new one exists.
+func removeLockFile(path, token string) bool {
+	suffix, err := randomToken()
+	if err != nil {
+		return false
+	}
+	aside := path + "." + suffix
+	if err := os.Rename(path, aside); err != nil {
+		return false
+	}
+	defer os.Remove(aside)
+
+	data, err := ioutil.ReadFile(aside)
+	if err == nil && string(data) == token {
+		return true
+	}
+	// Fails if another lock file has been created meanwhile
+	os.Link(aside, path)
+	return false
+}
+
+// randomToken returns a random hex string
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *FileStorage) String() string {
+	return s.root
+}
+
+// Root returns the root directory of the storage
+func (s *FileStorage) Root() string {
+	return s.root
+}
+
+// listPrefix returns the key prefix matching the keys below the directory dir,
+// so that listing "archive/1" doesn't return the keys of "archive/10"
+func listPrefix(dir string) string {
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+func (s *FileStorage) filePath(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func accountKey(apiVer ApiVersion, name string) string {
+	return path.Join(strings.ToLower(string(apiVer)), "accounts", name)
+}
+
+func certKey(apiVer ApiVersion, certName string) string {
+	return path.Join(strings.ToLower(string(apiVer)), "certs", safeFileName(certName))
+}
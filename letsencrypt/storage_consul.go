@@ -0,0 +1,204 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConsulStorage stores data in the key/value store of a Consul agent
+type ConsulStorage struct {
+	address string
+	prefix  string
+	token   string
+	client  *http.Client
+}
+
+// NewConsulStorage returns a storage for the Consul KV prefix configured in opts
+func NewConsulStorage(opts StorageOpts) (*ConsulStorage, error) {
+	address := opts.ConsulAddress
+	if len(address) == 0 {
+		address = "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	prefix := opts.ConsulPrefix
+	if len(prefix) == 0 {
+		prefix = "rancher-letsencrypt"
+	}
+
+	return &ConsulStorage{
+		address: strings.TrimRight(address, "/"),
+		prefix:  strings.Trim(prefix, "/"),
+		token:   opts.ConsulToken,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *ConsulStorage) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", s.kvUrl(key)+"?raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err := consulError(resp); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *ConsulStorage) Put(key string, data []byte) error {
+	resp, err := s.do("PUT", s.kvUrl(key), data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return consulError(resp)
+}
+
+func (s *ConsulStorage) Delete(key string) error {
+	resp, err := s.do("DELETE", s.kvUrl(key), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return consulError(resp)
+}
+
+func (s *ConsulStorage) Exists(key string) (bool, error) {
+	_, err := s.Get(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *ConsulStorage) List(prefix string) ([]string, error) {
+	resp, err := s.do("GET", s.kvUrl(prefix)+"/?keys", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := consulError(resp); err != nil {
+		return nil, err
+	}
+
+	var kvKeys []string
+	if err := json.NewDecoder(resp.Body).Decode(&kvKeys); err != nil {
+		return nil, fmt.Errorf("Failed to parse Consul key listing: %v", err)
+	}
+
+	keys := make([]string, 0, len(kvKeys))
+	for _, k := range kvKeys {
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+		keys = append(keys, strings.TrimPrefix(k, s.prefix+"/"))
+	}
+	return keys, nil
+}
+
+// GetVersioned returns the data stored under key and its modify index as version
+func (s *ConsulStorage) GetVersioned(key string) ([]byte, string, error) {
+	resp, err := s.do("GET", s.kvUrl(key), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", ErrNotFound
+	}
+	if err := consulError(resp); err != nil {
+		return nil, "", err
+	}
+
+	var pairs []struct {
+		ModifyIndex uint64
+		Value       []byte
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, "", fmt.Errorf("Failed to parse Consul key: %v", err)
+	}
+	if len(pairs) == 0 {
+		return nil, "", ErrNotFound
+	}
+	return pairs[0].Value, strconv.FormatUint(pairs[0].ModifyIndex, 10), nil
+}
+
+// PutVersioned stores data using a check-and-set operation on the modify index
+func (s *ConsulStorage) PutVersioned(key string, data []byte, version string) error {
+	if version == "" {
+		version = "0"
+	}
+	resp, err := s.do("PUT", s.kvUrl(key)+"?cas="+url.QueryEscape(version), data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := consulError(resp); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != "true" {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+func (s *ConsulStorage) String() string {
+	return fmt.Sprintf("%s/v1/kv/%s", s.address, s.prefix)
+}
+
+func (s *ConsulStorage) kvUrl(key string) string {
+	return fmt.Sprintf("%s/v1/kv/%s", s.address, path.Join(s.prefix, key))
+}
+
+func (s *ConsulStorage) do(method, url string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Consul request %s %s failed: %v", method, url, err)
+	}
+	return resp, nil
+}
+
+func consulError(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("Consul error %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,125 @@
+package letsencrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type consulPair struct {
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// fakeConsul is a local stand-in for the key/value API of a Consul agent
+type fakeConsul struct {
+	mu    sync.Mutex
+	token string
+	pairs map[string]consulPair
+	index uint64
+}
+
+func newFakeConsul(token string) *fakeConsul {
+	return &fakeConsul{token: token, pairs: map[string]consulPair{}}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("X-Consul-Token") != f.token {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+
+	switch r.Method {
+	case "GET":
+		if _, ok := query["keys"]; ok {
+			var keys []string
+			for k := range f.pairs {
+				if strings.HasPrefix(k, key) {
+					keys = append(keys, k)
+				}
+			}
+			if len(keys) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			sort.Strings(keys)
+			json.NewEncoder(w).Encode(keys)
+			return
+		}
+		pair, ok := f.pairs[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, ok := query["raw"]; ok {
+			w.Write(pair.Value)
+			return
+		}
+		json.NewEncoder(w).Encode([]consulPair{pair})
+	case "PUT":
+		if cas := query.Get("cas"); cas != "" {
+			index, _ := strconv.ParseUint(cas, 10, 64)
+			if f.pairs[key].ModifyIndex != index {
+				fmt.Fprint(w, "false")
+				return
+			}
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		f.index++
+		f.pairs[key] = consulPair{Value: body, ModifyIndex: f.index}
+		fmt.Fprint(w, "true")
+	case "DELETE":
+		delete(f.pairs, key)
+		fmt.Fprint(w, "true")
+	}
+}
+
+func newTestConsulStorage(t *testing.T, fake *fakeConsul, token string) (*ConsulStorage, func()) {
+	server := httptest.NewServer(fake)
+	storage, err := NewConsulStorage(StorageOpts{
+		ConsulAddress: strings.TrimPrefix(server.URL, "http://"),
+		ConsulPrefix:  "/letsencrypt/",
+		ConsulToken:   token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, server.Close
+}
+
+func TestConsulStorage(t *testing.T) {
+	fake := newFakeConsul("token")
+	storage, stop := newTestConsulStorage(t, fake, "token")
+	defer stop()
+
+	testStorage(t, storage)
+	if _, ok := fake.pairs["letsencrypt/production/certs/a/fullchain.pem"]; !ok {
+		t.Fatalf("Keys not stored under the prefix: %v", fake.pairs)
+	}
+}
+
+func TestConsulStorageErrors(t *testing.T) {
+	fake := newFakeConsul("token")
+	storage, stop := newTestConsulStorage(t, fake, "wrong")
+	defer stop()
+
+	_, err := storage.Get("production/account.json")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Expected permission error, got %v", err)
+	}
+	if err := storage.Put("production/account.json", []byte("{}")); err == nil {
+		t.Fatal("Expected Put to fail")
+	}
+}
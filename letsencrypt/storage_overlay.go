@@ -0,0 +1,86 @@
+package letsencrypt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// OverlayStorage reads data from a lower storage and writes all changes
+// to an upper storage, leaving the lower storage untouched
+type OverlayStorage struct {
+	lower Storage
+	upper Storage
+
+	mu sync.Mutex
+	// Keys deleted from the overlay that still exist in the lower storage
+	deleted map[string]bool
+}
+
+// NewOverlayStorage returns a storage writing changes of lower to upper
+func NewOverlayStorage(lower, upper Storage) *OverlayStorage {
+	return &OverlayStorage{lower: lower, upper: upper, deleted: map[string]bool{}}
+}
+
+func (s *OverlayStorage) Get(key string) ([]byte, error) {
+	data, err := s.upper.Get(key)
+	if err != ErrNotFound || s.isDeleted(key) {
+		return data, err
+	}
+	return s.lower.Get(key)
+}
+
+func (s *OverlayStorage) Put(key string, data []byte) error {
+	s.mu.Lock()
+	delete(s.deleted, key)
+	s.mu.Unlock()
+	return s.upper.Put(key, data)
+}
+
+func (s *OverlayStorage) Delete(key string) error {
+	s.mu.Lock()
+	s.deleted[key] = true
+	s.mu.Unlock()
+	return s.upper.Delete(key)
+}
+
+func (s *OverlayStorage) Exists(key string) (bool, error) {
+	exists, err := s.upper.Exists(key)
+	if err != nil || exists || s.isDeleted(key) {
+		return exists, err
+	}
+	return s.lower.Exists(key)
+}
+
+func (s *OverlayStorage) List(prefix string) ([]string, error) {
+	upperKeys, err := s.upper.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	lowerKeys, err := s.lower.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var keys []string
+	for _, key := range append(upperKeys, lowerKeys...) {
+		if seen[key] || s.isDeleted(key) {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *OverlayStorage) String() string {
+	return fmt.Sprintf("%s (changes written to %s)", s.lower, s.upper)
+}
+
+func (s *OverlayStorage) isDeleted(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleted[key]
+}
@@ -0,0 +1,271 @@
+package letsencrypt
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// S3Storage stores data in a bucket of an S3 compatible object store.
+// Objects are addressed path-style, which is supported by AWS S3 as well
+// as self-hosted implementations like Minio or Ceph.
+type S3Storage struct {
+	endpoint string
+	region   string
+	bucket   string
+	prefix   string
+	signer   *v4.Signer
+	client   *http.Client
+}
+
+// NewS3Storage returns a storage for the bucket configured in opts
+func NewS3Storage(opts StorageOpts) (*S3Storage, error) {
+	if len(opts.S3Bucket) == 0 {
+		return nil, fmt.Errorf("S3 bucket is not set")
+	}
+	if len(opts.S3AccessKey) == 0 {
+		return nil, fmt.Errorf("S3 access key is not set")
+	}
+	if len(opts.S3SecretKey) == 0 {
+		return nil, fmt.Errorf("S3 secret key is not set")
+	}
+
+	region := opts.S3Region
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+
+	endpoint := opts.S3Endpoint
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	creds := credentials.NewStaticCredentials(opts.S3AccessKey, opts.S3SecretKey, "")
+
+	return &S3Storage{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		region:   region,
+		bucket:   opts.S3Bucket,
+		prefix:   strings.Trim(opts.S3Prefix, "/"),
+		signer:   v4.NewSigner(creds),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *S3Storage) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", s.objectUrl(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err := s3Error(resp); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *S3Storage) Put(key string, data []byte) error {
+	resp, err := s.do("PUT", s.objectUrl(key), data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return s3Error(resp)
+}
+
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", s.objectUrl(key), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return s3Error(resp)
+}
+
+func (s *S3Storage) Exists(key string) (bool, error) {
+	resp, err := s.do("HEAD", s.objectUrl(key), nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := s3Error(resp); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3Storage) List(prefix string) ([]string, error) {
+	var keys []string
+	var token string
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", listPrefix(s.objectKey(prefix)))
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do("GET", fmt.Sprintf("%s/%s?%s", s.endpoint, s.bucket, query.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s3Error(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		result := struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse bucket listing: %v", err)
+		}
+
+		for _, obj := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(strings.TrimPrefix(obj.Key, s.prefix), "/"))
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return keys, nil
+}
+
+// GetVersioned returns the data stored under key and its ETag as version
+func (s *S3Storage) GetVersioned(key string) ([]byte, string, error) {
+	resp, err := s.do("GET", s.objectUrl(key), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", ErrNotFound
+	}
+	if err := s3Error(resp); err != nil {
+		return nil, "", err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, resp.Header.Get("ETag"), err
+}
+
+// PutVersioned stores data using a conditional write, which
+// requires an object store supporting If-Match and If-None-Match
+func (s *S3Storage) PutVersioned(key string, data []byte, version string) error {
+	header := http.Header{}
+	if version == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", version)
+	}
+
+	resp, err := s.doWithHeader("PUT", s.objectUrl(key), data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Concurrent conditional writes may also fail with 409 Conflict
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict {
+		return ErrVersionConflict
+	}
+	return s3Error(resp)
+}
+
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, s.prefix)
+}
+
+func (s *S3Storage) objectKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+func (s *S3Storage) objectUrl(key string) string {
+	u := url.URL{Path: path.Join("/", s.bucket, s.objectKey(key))}
+	return s.endpoint + u.EscapedPath()
+}
+
+func (s *S3Storage) do(method, url string, data []byte) (*http.Response, error) {
+	return s.doWithHeader(method, url, data, nil)
+}
+
+func (s *S3Storage) doWithHeader(method, url string, data []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	var body io.ReadSeeker
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+
+	if _, err := s.signer.Sign(req, body, "s3", s.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("Failed to sign S3 request: %v", err)
+	}
+	req.ContentLength = int64(len(data))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 request %s %s failed: %v", method, url, err)
+	}
+	return resp, nil
+}
+
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+
+	s3Err := struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("S3 error %d %s: %s", resp.StatusCode, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("S3 error %d", resp.StatusCode)
+}
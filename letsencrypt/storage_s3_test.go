@@ -0,0 +1,155 @@
+package letsencrypt
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a local stand-in for a path-style S3 bucket
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	etags   map[string]int
+	// Support If-Match and If-None-Match on PUT
+	conditional bool
+	pageSize    int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string][]byte{}, etags: map[string]int{}, conditional: true, pageSize: 2}
+}
+
+func (f *fakeS3) etag(key string) string {
+	return `"` + strconv.Itoa(f.etags[key]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket) {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code><Message>No such bucket</Message></Error>", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+
+	if key == "" && r.Method == "GET" {
+		f.list(w, r)
+		return
+	}
+
+	data, exists := f.objects[key]
+	switch r.Method {
+	case "GET", "HEAD":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", f.etag(key))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "PUT":
+		if f.conditional {
+			if r.Header.Get("If-None-Match") == "*" && exists ||
+				r.Header.Get("If-Match") != "" && (!exists || r.Header.Get("If-Match") != f.etag(key)) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = body
+		f.etags[key]++
+		w.Header().Set("ETag", f.etag(key))
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	end := start + f.pageSize
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []struct{ Key string }
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	} else {
+		end = len(keys)
+	}
+	for _, key := range keys[start:end] {
+		result.Contents = append(result.Contents, struct{ Key string }{key})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3Storage(t *testing.T, fake *fakeS3, prefix string) (*S3Storage, func()) {
+	server := httptest.NewServer(fake)
+	storage, err := NewS3Storage(StorageOpts{
+		S3Endpoint:  server.URL,
+		S3Bucket:    fake.bucket,
+		S3Prefix:    prefix,
+		S3AccessKey: "access",
+		S3SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, server.Close
+}
+
+func TestS3Storage(t *testing.T) {
+	fake := newFakeS3("certs")
+	storage, stop := newTestS3Storage(t, fake, "")
+	defer stop()
+
+	testStorage(t, storage)
+}
+
+func TestS3StoragePrefix(t *testing.T) {
+	fake := newFakeS3("certs")
+	storage, stop := newTestS3Storage(t, fake, "/cluster-a/")
+	defer stop()
+
+	testStorage(t, storage)
+	if _, ok := fake.objects["cluster-a/production/certs/a/fullchain.pem"]; !ok {
+		t.Fatalf("Objects not stored under the prefix: %v", fake.objects)
+	}
+}
+
+func TestS3StorageErrors(t *testing.T) {
+	fake := newFakeS3("certs")
+	storage, stop := newTestS3Storage(t, fake, "")
+	defer stop()
+	storage.bucket = "other"
+
+	_, err := storage.List("")
+	if err == nil || !strings.Contains(err.Error(), "NoSuchBucket") {
+		t.Fatalf("Expected NoSuchBucket error, got %v", err)
+	}
+}
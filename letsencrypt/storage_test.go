@@ -0,0 +1,105 @@
+package letsencrypt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testStorage runs the checks every storage backend has to pass
+func testStorage(t *testing.T, s Storage) {
+	if _, err := s.Get("production/certs/missing/metadata.json"); err != ErrNotFound {
+		t.Fatalf("Get of missing key: expected ErrNotFound, got %v", err)
+	}
+	if ok, err := s.Exists("production/certs/missing/metadata.json"); err != nil || ok {
+		t.Fatalf("Exists of missing key: got %v, %v", ok, err)
+	}
+	if err := s.Delete("production/certs/missing/metadata.json"); err != nil {
+		t.Fatalf("Delete of missing key: %v", err)
+	}
+
+	data := map[string]string{
+		"production/certs/a/fullchain.pem": "chain a",
+		"production/certs/a/privkey.pem":   "key a",
+		"production/certs/b/fullchain.pem": "chain b",
+		"production/certs/ab/privkey.pem":  "key ab",
+		"sandbox/certs/c/fullchain.pem":    "chain c",
+	}
+	for key, value := range data {
+		if err := s.Put(key, []byte(value)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	for key, value := range data {
+		got, err := s.Get(key)
+		if err != nil || string(got) != value {
+			t.Fatalf("Get %s: got %q, %v", key, got, err)
+		}
+		if ok, err := s.Exists(key); err != nil || !ok {
+			t.Fatalf("Exists %s: got %v, %v", key, ok, err)
+		}
+	}
+
+	if err := s.Put("production/certs/a/privkey.pem", []byte("key a2")); err != nil {
+		t.Fatalf("Put replacing data: %v", err)
+	}
+	if got, _ := s.Get("production/certs/a/privkey.pem"); string(got) != "key a2" {
+		t.Fatalf("Get after replacing data: got %q", got)
+	}
+
+	keys, err := s.List("production/certs")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	sort.Strings(keys)
+	expected := []string{"production/certs/a/fullchain.pem", "production/certs/a/privkey.pem", "production/certs/ab/privkey.pem", "production/certs/b/fullchain.pem"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("List: expected %v, got %v", expected, keys)
+	}
+	// Prefixes are directories, not strings
+	for _, prefix := range []string{"production/certs/a", "production/certs/a/"} {
+		keys, err := s.List(prefix)
+		if err != nil {
+			t.Fatalf("List %s: %v", prefix, err)
+		}
+		sort.Strings(keys)
+		expected := []string{"production/certs/a/fullchain.pem", "production/certs/a/privkey.pem"}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("List %s: expected %v, got %v", prefix, expected, keys)
+		}
+	}
+	if keys, err := s.List("production/certs/a/privkey.pem"); err != nil || len(keys) != 0 {
+		t.Fatalf("List of a key: got %v, %v", keys, err)
+	}
+	keys, err = s.List("")
+	if err != nil || len(keys) != len(data) {
+		t.Fatalf("List of all keys: expected %d keys, got %v, %v", len(data), keys, err)
+	}
+	if keys, err := s.List("nothing"); err != nil || len(keys) != 0 {
+		t.Fatalf("List of missing prefix: got %v, %v", keys, err)
+	}
+
+	if err := s.Delete("production/certs/b/fullchain.pem"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get("production/certs/b/fullchain.pem"); err != ErrNotFound {
+		t.Fatalf("Get after Delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	testStorage(t, NewFileStorage(dir))
+}
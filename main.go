@@ -24,9 +24,14 @@ func init() {
 }
 
 func main() {
+	flag.Usage = printUsage
 	flag.Parse()
 	logrus.Infof("Starting Let's Encrypt Certificate Manager %s %s", Version, Git)
 	context := &Context{}
+	if flag.NArg() > 0 {
+		context.RunCommand(flag.Args())
+		return
+	}
 	context.InitContext()
 	context.Run()
 }
@@ -1,20 +1,64 @@
 package main
 
 import (
-	"os"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
 )
 
 func (c *Context) Run() {
+	if c.DryRun {
+		defer c.removeDryRunStorage()
+		for _, shard := range c.splitShards() {
+			shard.dryRun()
+		}
+		return
+	}
+
+	if c.StatusPort > 0 {
+		go c.serveStatus(c.StatusPort)
+	}
+
+	// Followers only answer health checks and HTTP challenges
+	if c.Leader.Enabled {
+		if !c.lead() {
+			return
+		}
+		defer c.releaseLease()
+		c.InitAcme()
+	}
+
+	shards := c.splitShards()
+	if len(shards) > 1 {
+		runShards(shards)
+		return
+	}
+	c.run()
+}
+
+// run manages the certificate until the process exits
+func (c *Context) run() {
+	// Certificates are issued one after the other
+	c.mu.Lock()
 	c.startup()
+	c.mu.Unlock()
+
 	if c.RunOnce {
+		if c.issuancePending() {
+			logrus.Infof("Run once: Certificate request deferred until %s", c.RenewalDeferredUntil.UTC().Format(time.UnixDate))
+			return
+		}
 		// Renew certificate if it's about to expire
-		if time.Now().UTC().After(c.getRenewalDate()) {
+		c.refreshRenewalInfo()
+		c.mu.Lock()
+		due := c.renewalDue()
+		if due {
 			c.renew()
-		} else {
+		}
+		c.mu.Unlock()
+		if !due {
 			logrus.Infof("Not renewing certificate %s which expires on %s", c.CertificateName,
 				c.ExpiryDate.UTC().Format(time.UnixDate))
 		}
@@ -22,46 +66,68 @@ func (c *Context) Run() {
 		return
 	}
 
+	if c.WatchEvents {
+		c.watchTargets()
+	}
+	if c.ReconcileInterval > 0 {
+		go c.reconcileLoop(c.ReconcileInterval)
+	}
+	if c.Verify.Enabled() {
+		go c.verifyLoop(c.Verify.Interval)
+	}
+	if c.PartialIssuance {
+		go c.partialRetryLoop(c.PartialRetryInterval)
+	}
+	if c.RolloutSchedule != nil {
+		go c.rolloutLoop()
+	}
+
 	for {
+		c.refreshRenewalInfo()
 		<-c.timer()
-		c.renew()
+		// The renewal window suggested by the CA may have moved meanwhile
+		c.refreshRenewalInfo()
+		c.mu.Lock()
+		if c.issuancePending() && c.renewalDue() {
+			c.startup()
+		} else if c.renewalDue() {
+			c.renew()
+		}
+		c.mu.Unlock()
 	}
 }
 
 func (c *Context) startup() {
-	var storedLocally, storedInRancher bool
-	ok, acmeCert := c.Acme.GetStoredCertificate(c.CertificateName, c.Domains)
+	ok, acmeCert := c.storedCertificate()
 	if ok {
-		storedLocally = true
-		c.ExpiryDate = acmeCert.ExpiryDate
 		logrus.Infof("Found locally stored certificate '%s'", c.CertificateName)
+		c.manageStoredCert(acmeCert)
+		return
 	}
 
-	rancherCert, err := c.Rancher.FindCertByName(c.CertificateName)
-	if err != nil {
-		logrus.Fatalf("Could not lookup certificate in Rancher API: %v", err)
-	}
-
-	if rancherCert != nil {
-		storedInRancher = true
-		c.RancherCertId = rancherCert.Id
-		logrus.Infof("Found existing certificate '%s' in Rancher", c.CertificateName)
+	if acmeCert, err := c.recoverRancherCert(); err != nil {
+		// A new certificate would be refused by syncTargets as well
+		if _, ok := err.(recoveryRefusedError); ok {
+			logrus.Fatalf("Not recovering certificate '%s': %v", c.CertificateName, err)
+		}
+		logrus.Warnf("Could not recover certificate '%s' from Rancher: %v", c.CertificateName, err)
+	} else if acmeCert != nil {
+		c.manageStoredCert(acmeCert)
+		return
 	}
 
-	if storedLocally && storedInRancher {
-		if rancherCert.SerialNumber == acmeCert.SerialNumber {
-			logrus.Infof("Managing renewal of certificate '%s'", c.CertificateName)
+	if c.Adopt {
+		acmeCert, err := c.adoptRancherCert()
+		if err != nil {
+			logrus.Warnf("Could not adopt Rancher certificate '%s': %v", c.CertificateName, err)
+		} else if acmeCert != nil {
+			c.manageStoredCert(acmeCert)
 			return
 		}
-		logrus.Infof("Serial number mismatch between Rancher and local certificate '%s'", c.CertificateName)
-		c.updateRancherCert(acmeCert.PrivateKey, acmeCert.Certificate)
-		return
 	}
 
-	if storedLocally && !storedInRancher {
-		logrus.Debugf("Adding certificate '%s' to Rancher", c.CertificateName)
-		c.addRancherCert(acmeCert.PrivateKey, acmeCert.Certificate)
-		return
+	if err := c.checkTargetsOwnership(); err != nil {
+		logrus.Fatalf("Not requesting certificate '%s': %v", c.CertificateName, err)
 	}
 
 	if c.Acme.ProviderName() == "HTTP" {
@@ -71,74 +137,124 @@ func (c *Context) startup() {
 		time.Sleep(120 * time.Second)
 	}
 
-	logrus.Infof("Trying to obtain SSL certificate (%s) from Let's Encrypt %s CA", strings.Join(c.Domains, ","), c.Acme.ApiVersion())
+	// Retried by the renewal timer, see renewalTime
+	if c.deferForRateLimits(c.Domains) {
+		return
+	}
 
-	acmeCert, failures := c.Acme.Issue(c.CertificateName, c.Domains)
+	acmeCert, failures := c.issue()
 	if len(failures) > 0 {
 		for k, v := range failures {
 			logrus.Errorf("[%s] Error obtaining certificate: %s", k, v.Error())
 		}
-		os.Exit(1)
+		logrus.Exit(1)
 	}
 
 	logrus.Infof("Certificate obtained successfully")
+	c.reportQuota(c.Domains)
 
-	c.ExpiryDate = acmeCert.ExpiryDate
+	c.trackCertificate(acmeCert)
+	c.publishCert(acmeCert)
 
-	if storedInRancher {
-		logrus.Debugf("Overwriting Rancher certificate '%s'", c.CertificateName)
-		c.updateRancherCert(acmeCert.PrivateKey, acmeCert.Certificate)
+	if err := c.syncTargets(acmeCert); isReverted(err) {
 		return
+	} else if err != nil {
+		logrus.Fatal(err)
 	}
 
-	c.addRancherCert(acmeCert.PrivateKey, acmeCert.Certificate)
+	c.runHooks(acmeCert)
 }
 
-func (c *Context) addRancherCert(privateKey, cert []byte) {
-	rancherCert, err := c.Rancher.AddCertificate(c.CertificateName, CERT_DESCRIPTION, privateKey, cert)
-	if err != nil {
-		logrus.Fatalf("Failed to add Rancher certificate '%s': %v", c.CertificateName, err)
-	}
-	c.RancherCertId = rancherCert.Id
-	logrus.Infof("Certificate '%s' added to Rancher", c.CertificateName)
-}
+// manageStoredCert publishes the stored certificate and takes over its renewal
+func (c *Context) manageStoredCert(acmeCert *letsencrypt.AcmeCertificate) {
+	c.trackCertificate(acmeCert)
+	c.publishCert(acmeCert)
 
-func (c *Context) updateRancherCert(privateKey, cert []byte) {
-	err := c.Rancher.UpdateCertificate(c.RancherCertId, CERT_DESCRIPTION, privateKey, cert)
-	if err != nil {
-		logrus.Fatalf("Failed to update Rancher certificate '%s': %v", c.CertificateName, err)
-	}
-	logrus.Infof("Updated Rancher certificate '%s'", c.CertificateName)
-
-	err = c.Rancher.UpdateLoadBalancers(c.RancherCertId)
-	if err != nil {
-		logrus.Fatalf("Failed to upgrade load balancers: %v", err)
+	if err := c.syncTargets(acmeCert); err != nil && !isReverted(err) {
+		logrus.Fatal(err)
 	}
+	logrus.Infof("Managing renewal of certificate '%s'", c.CertificateName)
+	c.reportQuota(c.Domains)
 }
 
 func (c *Context) renew() {
 	logrus.Infof("Trying to obtain renewed SSL certificate (%s) from Let's Encrypt %s CA", strings.Join(c.Domains, ","), c.Acme.ApiVersion())
 
 	acmeCert, err := c.Acme.Renew(c.CertificateName)
+	if rateLimitErr, ok := err.(*letsencrypt.RateLimitError); ok {
+		logrus.Warnf("%v: Deferring certificate renewal", rateLimitErr)
+		c.RenewalDeferredUntil = rateLimitErr.RetryAfter
+		return
+	}
 	if err != nil {
 		logrus.Fatalf("Failed to renew certificate: %v", err)
 	}
 
 	logrus.Infof("Certificate renewed successfully")
+	c.reportQuota(c.Domains)
+
+	c.trackCertificate(acmeCert)
+	c.publishCert(acmeCert)
 
-	c.ExpiryDate = acmeCert.ExpiryDate
-	c.updateRancherCert(acmeCert.PrivateKey, acmeCert.Certificate)
+	if err := c.syncTargets(acmeCert); isReverted(err) {
+		return
+	} else if err != nil {
+		logrus.Fatal(err)
+	}
+
+	c.runHooks(acmeCert)
+}
+
+// rollback restores a previous version of the certificate locally
+// and in Rancher and updates the affected load balancers. The rollout
+// schedule doesn't apply, since a rollback is usually urgent. The restored
+// version is not renewed for the given time.
+func (c *Context) rollback(serial string, hold time.Duration) error {
+	acmeCert, err := c.Acme.Rollback(c.CertificateName, serial, time.Now().Add(hold))
+	if err != nil {
+		return err
+	}
+
+	c.rolloutNow = true
+	defer func() { c.rolloutNow = false }()
+
+	c.trackCertificate(acmeCert)
+	logrus.Infof("Renewal of certificate '%s' held until %s, next renewal on %s", c.CertificateName,
+		acmeCert.RenewalHoldUntil.In(c.Location).Format("2006/01/02 15:04 MST"),
+		c.renewalTime().In(c.Location).Format("2006/01/02 15:04 MST"))
+	c.publishCert(acmeCert)
+
+	if err := c.syncTargets(acmeCert); err != nil {
+		return err
+	}
+
+	c.runHooks(acmeCert)
+	return nil
 }
 
 func (c *Context) timer() <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	now := time.Now().UTC()
-	next := c.getRenewalDate()
+	next := c.renewalTime()
 	left := next.Sub(now)
 	if left <= 0 {
 		left = 10 * time.Second
 	}
 
-	logrus.Infof("Certificate renewal scheduled for %s", next.Format("2006/01/02 15:04 MST"))
+	logrus.Infof("Certificate renewal scheduled for %s", next.In(c.Location).Format("2006/01/02 15:04 MST"))
+	c.Status.SetRenewalDate(c.CertificateName, next)
+
+	// Ask the CA for changes of the suggested renewal window in time
+	if c.renewal.window != nil {
+		if check := c.renewal.nextCheck.Sub(now); check < left {
+			if check < time.Minute {
+				check = time.Minute
+			}
+			left = check
+		}
+	}
 
 	// test mode forces renewal
 	if c.TestMode {
@@ -153,7 +269,21 @@ func (c *Context) getRenewalDate() time.Time {
 	if c.ExpiryDate.IsZero() {
 		logrus.Fatalf("Could not determine expiry date for certificate: %s", c.CertificateName)
 	}
-	date := c.ExpiryDate.AddDate(0, 0, -c.RenewalPeriodDays)
-	dYear, dMonth, dDay := date.Date()
-	return time.Date(dYear, dMonth, dDay, c.RenewalDayTime, 0, 0, 0, time.UTC)
+	date, suggested := c.dueDate()
+	if c.RenewalSchedule != nil {
+		if !suggested {
+			date = date.Add(c.jitter(date))
+		}
+		if now := time.Now(); date.Before(now) {
+			date = now
+		}
+		return c.RenewalSchedule.Next(date)
+	}
+	// The time picked in the window suggested by the CA is kept as is
+	if suggested {
+		return date
+	}
+	dYear, dMonth, dDay := date.In(c.Location).Date()
+	date = time.Date(dYear, dMonth, dDay, c.RenewalDayTime, 0, 0, 0, c.Location)
+	return date.Add(c.jitter(date))
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricRegistry holds gauges and counters exposed in the Prometheus text format
+type metricRegistry struct {
+	mu      sync.Mutex
+	help    map[string]string
+	kinds   map[string]string
+	samples map[string]map[string]*metricSample
+}
+
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{
+		help:    map[string]string{},
+		kinds:   map[string]string{},
+		samples: map[string]map[string]*metricSample{},
+	}
+}
+
+// Set sets the value of a gauge
+func (m *metricRegistry) Set(name, help string, labels map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample(name, help, "gauge", labels).value = value
+}
+
+// Add increments a counter
+func (m *metricRegistry) Add(name, help string, labels map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample(name, help, "counter", labels).value += value
+}
+
+// Reset removes the samples of a metric having all of the given labels,
+// e.g. before setting the current set of labels
+func (m *metricRegistry) Reset(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+outer:
+	for key, sample := range m.samples[name] {
+		for k, v := range labels {
+			if sample.labels[k] != v {
+				continue outer
+			}
+		}
+		delete(m.samples[name], key)
+	}
+}
+
+func (m *metricRegistry) sample(name, help, kind string, labels map[string]string) *metricSample {
+	m.help[name] = help
+	m.kinds[name] = kind
+	if m.samples[name] == nil {
+		m.samples[name] = map[string]*metricSample{}
+	}
+
+	key := formatLabels(labels)
+	if m.samples[name][key] == nil {
+		m.samples[name][key] = &metricSample{labels: labels}
+	}
+	return m.samples[name][key]
+}
+
+// Write writes all metrics in the Prometheus text exposition format
+func (m *metricRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name := range m.samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help[name])
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kinds[name])
+
+		var labels []string
+		for l := range m.samples[name] {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(w, "%s%s %v\n", name, l, m.samples[name][l].value)
+		}
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
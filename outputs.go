@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+// publishCert makes the certificate available to consumers other than
+// Rancher load balancers. Errors are logged but don't interrupt the
+// certificate management.
+func (c *Context) publishCert(acmeCert *letsencrypt.AcmeCertificate) {
+	if c.DryRun {
+		c.planPublish()
+		return
+	}
+
+	if err := letsencrypt.ExportCertificate(c.CertificateName, acmeCert, c.Export); err != nil {
+		logrus.Errorf("Failed to export certificate '%s': %v", c.CertificateName, err)
+	}
+
+	if c.RancherSecrets {
+		c.publishRancherSecrets(acmeCert)
+	}
+
+	if c.Kubernetes != nil {
+		c.publishKubernetesSecrets(acmeCert)
+	}
+}
+
+// publishRancherSecrets stores the private key, certificate and chain as Rancher secrets
+func (c *Context) publishRancherSecrets(acmeCert *letsencrypt.AcmeCertificate) {
+	cert, chain, err := letsencrypt.SplitCertificateChain(acmeCert.Certificate)
+	if err != nil {
+		logrus.Errorf("Failed to publish Rancher secrets for certificate '%s': %v", c.CertificateName, err)
+		return
+	}
+
+	secrets := []struct {
+		suffix string
+		value  []byte
+	}{
+		{"key", acmeCert.PrivateKey},
+		{"cert", cert},
+		{"chain", chain},
+		{"fullchain", acmeCert.Certificate},
+	}
+
+	// Rancher doesn't return the value of secrets,
+	// changes are detected by the serial number instead
+	descr := fmt.Sprintf("%s [serial=%s]", CERT_DESCRIPTION, acmeCert.SerialNumber)
+	for _, secret := range secrets {
+		name := c.RancherSecretName + "-" + secret.suffix
+		changed, err := c.Rancher.PublishSecret(name, descr, secret.value)
+		if err != nil {
+			logrus.Errorf("Failed to publish Rancher secret '%s': %v", name, err)
+			continue
+		}
+		if changed {
+			logrus.Infof("Published Rancher secret '%s'", name)
+		}
+	}
+}
+
+// KubernetesSecretOpts configures the Kubernetes TLS secrets
+type KubernetesSecretOpts struct {
+	Namespaces  []string
+	Name        string
+	Annotations map[string]string
+	// Take over existing secrets not created by this manager
+	Adopt bool
+}
+
+// publishKubernetesSecrets creates or updates a TLS secret in each configured namespace
+func (c *Context) publishKubernetesSecrets(acmeCert *letsencrypt.AcmeCertificate) {
+	opts := c.KubernetesSecret
+	for _, namespace := range opts.Namespaces {
+		changed, err := c.Kubernetes.ApplyTLSSecret(namespace, opts.Name, opts.Annotations, acmeCert.Certificate, acmeCert.PrivateKey, opts.Adopt)
+		if err != nil {
+			logrus.Errorf("Failed to publish Kubernetes secret %s/%s: %v", namespace, opts.Name, err)
+			continue
+		}
+		if changed {
+			logrus.Infof("Published Kubernetes secret %s/%s", namespace, opts.Name)
+		}
+	}
+}
+
+// kubernetesName converts name to a valid Kubernetes object name
+func kubernetesName(name string) string {
+	name = strings.ToLower(name)
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, name)
+	return strings.Trim(name, "-.")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	MANAGED_BY = "rancher-letsencrypt"
+
+	// Storage key of the generated instance ID
+	instanceIdKey = "instance-id"
+)
+
+// Ownership is the metadata stamped into the description of the certificates
+// managed by this application, e.g.:
+// "Created by Let's Encrypt Certificate Manager [managed-by=rancher-letsencrypt
+// instance=4f2a... domains=example.com,www.example.com ca=production]"
+type Ownership struct {
+	ManagedBy  string
+	InstanceId string
+	Domains    []string
+	CA         string
+}
+
+// String returns the ownership metadata in the format of the description
+func (o Ownership) String() string {
+	return fmt.Sprintf("%s [managed-by=%s instance=%s domains=%s ca=%s]", CERT_DESCRIPTION,
+		o.ManagedBy, o.InstanceId, strings.Join(o.Domains, ","), o.CA)
+}
+
+// parseOwnership extracts the ownership metadata from a certificate description.
+// Returns nil if the certificate was not created by this application.
+func parseOwnership(description string) *Ownership {
+	if !strings.HasPrefix(description, CERT_DESCRIPTION) {
+		return nil
+	}
+
+	// Created by a version without ownership metadata
+	o := &Ownership{ManagedBy: MANAGED_BY}
+
+	start := strings.Index(description, "[")
+	end := strings.LastIndex(description, "]")
+	if start < 0 || end < start {
+		return o
+	}
+
+	for _, field := range strings.Fields(description[start+1 : end]) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "managed-by":
+			o.ManagedBy = parts[1]
+		case "instance":
+			o.InstanceId = parts[1]
+		case "domains":
+			o.Domains = splitList(parts[1])
+		case "ca":
+			o.CA = parts[1]
+		}
+	}
+	return o
+}
+
+// ownership returns the ownership metadata of the certificate
+func (c *Context) ownership(acmeCert *letsencrypt.AcmeCertificate) Ownership {
+	return Ownership{
+		ManagedBy:  MANAGED_BY,
+		InstanceId: c.InstanceId,
+		Domains:    strings.Split(acmeCert.DnsNames, "|"),
+		CA:         strings.ToLower(c.Acme.ApiVersion()),
+	}
+}
+
+// checkOwnership returns an error if the Rancher certificate must not be overwritten
+func (c *Context) checkOwnership(target *RancherTarget, rancherCert *rancherClient.Certificate) error {
+	owner := parseOwnership(rancherCert.Description)
+
+	switch {
+	case c.ownedByThis(owner):
+		target.Owned = true
+		return nil
+	case owner != nil && owner.ManagedBy == MANAGED_BY && target.Owned:
+		// We have been managing the certificate, but another instance took it over
+		target.Owned = false
+		return fmt.Errorf("Certificate '%s' was overwritten by manager instance %s: "+
+			"Two instances are managing the same certificate name", c.CertificateName, owner.InstanceId)
+	}
+	if err := c.adoptionError(owner); err != nil {
+		return err
+	}
+
+	logrus.Infof("[%s] Adopting Rancher certificate '%s'", target.Name, c.CertificateName)
+	target.Owned = true
+	return nil
+}
+
+// checkTargetsOwnership verifies that the certificates with the configured name in
+// Rancher may be overwritten before a certificate is requested, so that a certificate
+// refused by syncTargets doesn't spend the rate limits of the CA on every restart
+func (c *Context) checkTargetsOwnership() error {
+	for _, target := range c.Targets {
+		rancherCert, err := target.Client.FindCertByName(c.CertificateName)
+		if err != nil {
+			if target.Name == DEFAULT_TARGET {
+				return fmt.Errorf("Could not lookup certificate in Rancher API: %v", err)
+			}
+			logrus.Warnf("[%s] Could not check ownership of certificate '%s': %v", target.Name, c.CertificateName, err)
+			continue
+		}
+		if rancherCert == nil {
+			continue
+		}
+		owner := parseOwnership(rancherCert.Description)
+		if c.ownedByThis(owner) {
+			continue
+		}
+		if err := c.adoptionError(owner); err != nil {
+			return fmt.Errorf("[%s] %v", target.Name, err)
+		}
+	}
+	return nil
+}
+
+// ownedByThis returns true if the owner is this manager instance
+// or a version of this manager without instance IDs
+func (c *Context) ownedByThis(owner *Ownership) bool {
+	return owner != nil && owner.ManagedBy == MANAGED_BY && (owner.InstanceId == "" || owner.InstanceId == c.InstanceId)
+}
+
+// adoptionError returns an error unless a certificate of another owner may be taken over
+func (c *Context) adoptionError(owner *Ownership) error {
+	switch {
+	case c.Adopt:
+		return nil
+	case owner != nil && owner.ManagedBy == MANAGED_BY:
+		return fmt.Errorf("Certificate '%s' is managed by another manager instance %s: "+
+			"Set ADOPT_CERTIFICATE=true to take it over", c.CertificateName, owner.InstanceId)
+	default:
+		return fmt.Errorf("Certificate '%s' was not created by this manager: "+
+			"Set ADOPT_CERTIFICATE=true to overwrite it", c.CertificateName)
+	}
+}
+
+// loadInstanceId returns the ID of this manager instance, which is generated
+// once and kept in the storage so that it survives restarts. Returns true
+// if the ID was generated now.
+func loadInstanceId(storage letsencrypt.Storage) (string, bool, error) {
+	data, err := storage.Get(instanceIdKey)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), false, nil
+	}
+	if err != nil && err != letsencrypt.ErrNotFound {
+		return "", false, err
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, err
+	}
+	id := hex.EncodeToString(b)
+
+	if err := saveInstanceId(storage, id); err != nil {
+		return "", false, err
+	}
+	logrus.Infof("Generated manager instance ID %s", id)
+	return id, true, nil
+}
+
+func saveInstanceId(storage letsencrypt.Storage, id string) error {
+	return storage.Put(instanceIdKey, []byte(id))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+func newTestContext(t *testing.T) (*Context, func()) {
+	dir, err := ioutil.TempDir("", "ownership")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Context{CertificateName: "example", Storage: letsencrypt.NewFileStorage(dir)}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func testOwner(instanceId string) *Ownership {
+	o := Ownership{ManagedBy: MANAGED_BY, InstanceId: instanceId, Domains: []string{"example.com"}, CA: "production"}
+	return parseOwnership(o.String())
+}
+
+func TestRecoveryLostStorage(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	// The instance ID was lost along with the storage and is generated again
+	var err error
+	c.InstanceId, c.instanceIdGenerated, err = loadInstanceId(c.Storage)
+	if err != nil || !c.instanceIdGenerated {
+		t.Fatalf("Expected a new instance ID to be generated, got %v", err)
+	}
+
+	owner := testOwner("0123456789abcdef")
+	if err := c.recoveryError(owner); err != nil {
+		t.Fatalf("Expected the certificate to be recovered without ADOPT_CERTIFICATE: %v", err)
+	}
+	if err := c.recoverInstanceId(owner); err != nil {
+		t.Fatal(err)
+	}
+	if c.InstanceId != owner.InstanceId {
+		t.Errorf("Expected instance ID %s to be recovered, got %s", owner.InstanceId, c.InstanceId)
+	}
+
+	// The recovered ID is kept after a restart
+	id, generated, err := loadInstanceId(c.Storage)
+	if err != nil || generated || id != owner.InstanceId {
+		t.Errorf("Expected instance ID %s to be loaded, got %s, %v, %v", owner.InstanceId, id, generated, err)
+	}
+}
+
+func TestRecoveryOtherInstance(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	// Set with INSTANCE_ID or loaded from the storage
+	c.InstanceId = "fedcba9876543210"
+	owner := testOwner("0123456789abcdef")
+
+	err := c.recoveryError(owner)
+	if err == nil {
+		t.Fatal("Expected the certificate of another instance not to be recovered")
+	}
+
+	c.Adopt = true
+	if err := c.recoveryError(owner); err != nil {
+		t.Fatalf("Expected the certificate to be adopted: %v", err)
+	}
+	if err := c.recoverInstanceId(owner); err != nil {
+		t.Fatal(err)
+	}
+	if c.InstanceId != "fedcba9876543210" {
+		t.Errorf("Expected an adopting instance to keep its ID, got %s", c.InstanceId)
+	}
+	if ok, _ := c.Storage.Exists(instanceIdKey); ok {
+		t.Error("Expected the instance ID of the owner not to be stored")
+	}
+}
+
+func TestRecoveryOwnCertificate(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	c.InstanceId = "0123456789abcdef"
+	for _, owner := range []*Ownership{testOwner(c.InstanceId), testOwner("")} {
+		if err := c.recoveryError(owner); err != nil {
+			t.Errorf("Expected a certificate of this instance to be recovered: %v", err)
+		}
+	}
+	if err := c.recoveryError(parseOwnership("Uploaded manually")); err == nil {
+		t.Error("Expected a certificate not created by this manager not to be recovered")
+	}
+}
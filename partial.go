@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+const PARTIAL_RETRY_INTERVAL_MINUTES = 360
+
+// storedCertificate returns the locally stored certificate for the configured
+// domains, or for the domains that validated if partial issuance is enabled
+func (c *Context) storedCertificate() (bool, *letsencrypt.AcmeCertificate) {
+	ok, acmeCert := c.Acme.GetStoredCertificate(c.CertificateName, c.Domains)
+	if !ok && c.PartialIssuance {
+		ok, acmeCert = c.Acme.GetStoredPartialCertificate(c.CertificateName, c.Domains)
+	}
+	return ok, acmeCert
+}
+
+// issue obtains a certificate for the configured domains from the production CA
+// after rehearsing with the staging CA. With partial issuance, the domains failing
+// validation by either CA are left out.
+func (c *Context) issue() (*letsencrypt.AcmeCertificate, map[string]error) {
+	var acmeCert *letsencrypt.AcmeCertificate
+	failures := c.rehearse(c.Domains)
+	if len(failures) == 0 {
+		logrus.Infof("Trying to obtain SSL certificate (%s) from Let's Encrypt %s CA", strings.Join(c.Domains, ","), c.Acme.ApiVersion())
+		acmeCert, failures = c.Acme.Issue(c.CertificateName, c.Domains)
+	}
+	if len(failures) > 0 && c.PartialIssuance {
+		acmeCert, failures = c.issuePartial(failures)
+	}
+	return acmeCert, failures
+}
+
+// issuePartial obtains a certificate for the configured domains that are not
+// in failures and records the excluded domains with the certificate
+func (c *Context) issuePartial(failures map[string]error) (*letsencrypt.AcmeCertificate, map[string]error) {
+	var validated []string
+	excluded := map[string]string{}
+	for _, domain := range c.Domains {
+		if err, ok := failures[domain]; ok {
+			excluded[domain] = err.Error()
+		} else {
+			validated = append(validated, domain)
+		}
+	}
+	// Failures not caused by individual domains, e.g. rate limits
+	if len(validated) == 0 || len(excluded) != len(failures) {
+		return nil, failures
+	}
+
+	logrus.Warnf("Issuing certificate '%s' without domains that failed validation: %s",
+		c.CertificateName, strings.Join(keys(excluded), ","))
+
+	if rehearsalFailures := c.rehearse(validated); len(rehearsalFailures) > 0 {
+		return nil, rehearsalFailures
+	}
+	acmeCert, partialFailures := c.Acme.Issue(c.CertificateName, validated)
+	if len(partialFailures) > 0 {
+		return nil, partialFailures
+	}
+
+	if err := c.Acme.SetExcludedDomains(c.CertificateName, acmeCert, excluded); err != nil {
+		logrus.Errorf("Failed to save excluded domains of certificate '%s': %v", c.CertificateName, err)
+	}
+	return acmeCert, nil
+}
+
+// partialRetryLoop periodically retries to validate the domains excluded
+// from the certificate and reissues it once any of them recovered
+func (c *Context) partialRetryLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		c.mu.Lock()
+		c.retryExcludedDomains()
+		c.mu.Unlock()
+	}
+}
+
+func (c *Context) retryExcludedDomains() {
+	ok, current := c.storedCertificate()
+	if !ok || len(current.ExcludedDomains) == 0 {
+		return
+	}
+
+	if err := c.Acme.CheckRateLimits(c.Domains, false); err != nil {
+		logrus.Warnf("%v: Not retrying domains excluded from certificate '%s'", err, c.CertificateName)
+		return
+	}
+
+	logrus.Infof("Retrying validation of domains excluded from certificate '%s': %s",
+		c.CertificateName, strings.Join(current.ExcludedDomainNames(), ","))
+
+	var acmeCert *letsencrypt.AcmeCertificate
+	failures := c.rehearse(c.Domains)
+	if len(failures) == 0 {
+		acmeCert, failures = c.Acme.Issue(c.CertificateName, c.Domains)
+	}
+	if len(failures) == 0 {
+		logrus.Infof("All domains validated: Reissued certificate '%s' with the full set of domains", c.CertificateName)
+		c.deployCert(acmeCert)
+		return
+	}
+
+	// Don't reissue the certificate unless more domains validated than before
+	recovered := false
+	for domain := range current.ExcludedDomains {
+		if _, failed := failures[domain]; !failed {
+			recovered = true
+		}
+	}
+	for domain := range failures {
+		if _, excluded := current.ExcludedDomains[domain]; !excluded {
+			recovered = false
+		}
+	}
+	if !recovered {
+		for domain, err := range failures {
+			logrus.Warnf("[%s] Domain still failing validation: %v", domain, err)
+		}
+		return
+	}
+
+	acmeCert, failures = c.issuePartial(failures)
+	if len(failures) > 0 {
+		for domain, err := range failures {
+			logrus.Errorf("[%s] Error obtaining certificate: %v", domain, err)
+		}
+		return
+	}
+	c.deployCert(acmeCert)
+}
+
+// deployCert publishes a reissued certificate and updates the Rancher targets
+func (c *Context) deployCert(acmeCert *letsencrypt.AcmeCertificate) {
+	c.trackCertificate(acmeCert)
+	c.publishCert(acmeCert)
+
+	if err := c.syncTargets(acmeCert); isReverted(err) {
+		return
+	} else if err != nil {
+		logrus.Error(err)
+	}
+
+	c.runHooks(acmeCert)
+}
+
+func keys(m map[string]string) []string {
+	var list []string
+	for k := range m {
+		list = append(list, k)
+	}
+	return list
+}
@@ -93,3 +93,35 @@ func (r *Client) GetCertById(certId string) (*rancherClient.Certificate, error)
 	logrus.Debugf("Got Rancher certificate %s by ID %s", rancherCert.Name, certId)
 	return rancherCert, nil
 }
+
+// FindCertById retrieves a certificate by ID, returning nil if it doesn't exist or was removed
+func (r *Client) FindCertById(certId string) (*rancherClient.Certificate, error) {
+	rancherCert, err := r.client.Certificate.ById(certId)
+	if err != nil {
+		return nil, err
+	}
+
+	if rancherCert == nil || len(rancherCert.Removed) > 0 || rancherCert.State == "removed" || rancherCert.State == "purged" {
+		return nil, nil
+	}
+
+	return rancherCert, nil
+}
+
+// UpdateCertificateMetadata changes the name and/or description of an existing certificate
+func (r *Client) UpdateCertificateMetadata(certId, name, descr string) error {
+	rancherCert, err := r.client.Certificate.ById(certId)
+	if err != nil {
+		return err
+	}
+
+	rancherCert, err = r.client.Certificate.Update(rancherCert, &rancherClient.Certificate{
+		Name:        name,
+		Description: descr,
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.WaitCertificate(rancherCert)
+}
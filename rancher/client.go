@@ -1,6 +1,7 @@
 package rancher
 
 import (
+	"sync"
 	"time"
 
 	rancherClient "github.com/rancher/go-rancher/v2"
@@ -8,6 +9,10 @@ import (
 
 type Client struct {
 	client *rancherClient.RancherClient
+
+	// Index of load balancers by certificate, maintained while watching events
+	index   *lbIndex
+	indexMu sync.Mutex
 }
 
 // NewClient returns a new client for the Rancher/Cattle API
@@ -35,5 +40,5 @@ func NewClient(rancherUrl string, rancherAccessKey string, rancherSecretKey stri
 		return nil, err
 	}
 
-	return &Client{apiClient}, nil
+	return &Client{client: apiClient}, nil
 }
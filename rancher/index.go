@@ -0,0 +1,125 @@
+package rancher
+
+import (
+	"sync"
+
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+// Load balancers in these states are not indexed. Load balancers that are
+// transitioning while active (e.g. while being upgraded) remain indexed.
+var inactiveStates = map[string]bool{
+	"inactive":     true,
+	"deactivating": true,
+	"removing":     true,
+	"removed":      true,
+	"purging":      true,
+	"purged":       true,
+}
+
+// lbIndex maps certificate IDs to the active load balancers using them
+type lbIndex struct {
+	sync.RWMutex
+	// certificate ID => load balancer IDs
+	certs map[string]map[string]bool
+	// load balancer ID => certificate IDs
+	balancers map[string][]string
+}
+
+func newLBIndex() *lbIndex {
+	return &lbIndex{
+		certs:     map[string]map[string]bool{},
+		balancers: map[string][]string{},
+	}
+}
+
+// update replaces the entries of the load balancer with the certificates it currently
+// uses. Returns the IDs of the certificates the load balancer started or stopped using.
+func (i *lbIndex) update(lb *rancherClient.LoadBalancerService) []string {
+	i.Lock()
+	defer i.Unlock()
+
+	previous := i.balancers[lb.Id]
+	for _, certId := range previous {
+		delete(i.certs[certId], lb.Id)
+		if len(i.certs[certId]) == 0 {
+			delete(i.certs, certId)
+		}
+	}
+	delete(i.balancers, lb.Id)
+
+	var certIds []string
+	if !inactiveStates[lb.State] && len(lb.Removed) == 0 && lb.LbConfig != nil {
+		certIds = lbCertificateIds(lb)
+	}
+	for _, certId := range certIds {
+		if i.certs[certId] == nil {
+			i.certs[certId] = map[string]bool{}
+		}
+		i.certs[certId][lb.Id] = true
+	}
+	if len(certIds) > 0 {
+		i.balancers[lb.Id] = certIds
+	}
+
+	return changedIds(previous, certIds)
+}
+
+// changedIds returns the IDs contained in only one of the lists
+func changedIds(a, b []string) []string {
+	count := map[string]int{}
+	for _, id := range a {
+		count[id]++
+	}
+	for _, id := range b {
+		count[id]--
+	}
+
+	var changed []string
+	for _, ids := range [][]string{a, b} {
+		for _, id := range ids {
+			if count[id] != 0 {
+				changed = append(changed, id)
+				count[id] = 0
+			}
+		}
+	}
+	return changed
+}
+
+// loadBalancers returns the IDs of the load balancers using the certificate
+func (i *lbIndex) loadBalancers(certId string) []string {
+	i.RLock()
+	defer i.RUnlock()
+
+	var ids []string
+	for id := range i.certs[certId] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func lbCertificateIds(lb *rancherClient.LoadBalancerService) []string {
+	var ids []string
+	if len(lb.LbConfig.DefaultCertificateId) > 0 {
+		ids = append(ids, lb.LbConfig.DefaultCertificateId)
+	}
+	for _, id := range lb.LbConfig.CertificateIds {
+		if id != lb.LbConfig.DefaultCertificateId {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (r *Client) setIndex(index *lbIndex) {
+	r.indexMu.Lock()
+	r.index = index
+	r.indexMu.Unlock()
+}
+
+func (r *Client) getIndex() *lbIndex {
+	r.indexMu.Lock()
+	defer r.indexMu.Unlock()
+	return r.index
+}
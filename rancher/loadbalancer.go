@@ -1,6 +1,8 @@
 package rancher
 
 import (
+	"fmt"
+
 	"github.com/Sirupsen/logrus"
 	rancherClient "github.com/rancher/go-rancher/v2"
 )
@@ -35,6 +37,133 @@ func (r *Client) UpdateLoadBalancers(certId string) error {
 	return nil
 }
 
+// LoadBalancerRef records that a load balancer uses a certificate
+type LoadBalancerRef struct {
+	Id string
+	// The certificate is the default certificate of the load balancer
+	Default bool
+}
+
+// LoadBalancerRefs returns the load balancers using the certificate
+func (r *Client) LoadBalancerRefs(certId string) ([]LoadBalancerRef, error) {
+	ids, err := r.findLoadBalancerServicesByCert(certId)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []LoadBalancerRef
+	for _, id := range ids {
+		lb, err := r.client.LoadBalancerService.ById(id)
+		if err != nil {
+			return nil, err
+		}
+		if lb == nil || lb.LbConfig == nil {
+			continue
+		}
+		refs = append(refs, LoadBalancerRef{Id: id, Default: lb.LbConfig.DefaultCertificateId == certId})
+	}
+	return refs, nil
+}
+
+// RewireLoadBalancers configures the load balancers to use the certificate newId
+// in place of oldId, e.g. after the certificate has been deleted and recreated
+func (r *Client) RewireLoadBalancers(refs []LoadBalancerRef, oldId, newId string) error {
+	var failed int
+	for _, ref := range refs {
+		lb, err := r.client.LoadBalancerService.ById(ref.Id)
+		if err != nil || lb == nil || len(lb.Removed) > 0 || lb.LbConfig == nil {
+			logrus.Warnf("Load balancer %s no longer exists", ref.Id)
+			continue
+		}
+
+		lbConfig := *lb.LbConfig
+		certIds := []string{}
+		for _, id := range lbConfig.CertificateIds {
+			if id != oldId && id != newId {
+				certIds = append(certIds, id)
+			}
+		}
+		if ref.Default {
+			lbConfig.DefaultCertificateId = newId
+		} else {
+			if lbConfig.DefaultCertificateId == oldId {
+				lbConfig.DefaultCertificateId = ""
+			}
+			certIds = append(certIds, newId)
+		}
+		lbConfig.CertificateIds = certIds
+
+		name := lb.Name
+		logrus.Debugf("Rewiring load balancer %s from certificate %s to %s", name, oldId, newId)
+
+		lb, err = r.client.LoadBalancerService.Update(lb, map[string]interface{}{
+			"lbConfig": &lbConfig,
+		})
+		if err == nil {
+			err = r.WaitLoadBalancerService(lb)
+		}
+		if err != nil {
+			logrus.Errorf("Failed to rewire load balancer '%s': %v", name, err)
+			failed++
+			continue
+		}
+		logrus.Infof("Rewired load balancer '%s' to the recreated certificate", name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to rewire %d load balancers", failed)
+	}
+	return nil
+}
+
+// AttachCertificate adds the certificate to the load balancers not using it yet
+func (r *Client) AttachCertificate(lbIds []string, certId string) error {
+	var failed int
+	seen := map[string]bool{}
+	for _, id := range lbIds {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		lb, err := r.client.LoadBalancerService.ById(id)
+		if err != nil || lb == nil || len(lb.Removed) > 0 || lb.LbConfig == nil {
+			logrus.Warnf("Load balancer %s no longer exists", id)
+			continue
+		}
+
+		attached := lb.LbConfig.DefaultCertificateId == certId
+		for _, existing := range lb.LbConfig.CertificateIds {
+			attached = attached || existing == certId
+		}
+		if attached {
+			continue
+		}
+
+		lbConfig := *lb.LbConfig
+		lbConfig.CertificateIds = append(append([]string{}, lbConfig.CertificateIds...), certId)
+
+		name := lb.Name
+		lb, err = r.client.LoadBalancerService.Update(lb, map[string]interface{}{
+			"lbConfig": &lbConfig,
+		})
+		if err == nil {
+			err = r.WaitLoadBalancerService(lb)
+		}
+		if err != nil {
+			logrus.Errorf("Failed to attach certificate to load balancer '%s': %v", name, err)
+			failed++
+			continue
+		}
+		logrus.Infof("Attached certificate %s to load balancer '%s'", certId, name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to attach certificate to %d load balancers", failed)
+	}
+	return nil
+}
+
 func (r *Client) update(lb *rancherClient.LoadBalancerService) error {
 
 	logrus.Debugf("Updating load balancer %s", lb.Name)
@@ -44,41 +173,36 @@ func (r *Client) update(lb *rancherClient.LoadBalancerService) error {
 		return err
 	}
 
-	err = r.WaitService(service)
-	if err != nil {
-		logrus.Warnf(err.Error())
-	}
-
-	return nil
+	return r.WaitService(service)
 }
 
 func (r *Client) findLoadBalancerServicesByCert(certId string) ([]string, error) {
+	if index := r.getIndex(); index != nil {
+		results := index.loadBalancers(certId)
+		logrus.Debugf("Found %d load balancers with matching certificate in index", len(results))
+		return results, nil
+	}
+
 	var results []string
 
 	logrus.Debugf("Looking up load balancers matching certificate ID %s", certId)
 
-	balancers, err := r.client.LoadBalancerService.List(&rancherClient.ListOpts{
-		Filters: map[string]interface{}{
-			"removed_null": nil,
-			"state":        "active",
-		},
-	})
+	balancers, err := r.listActiveLoadBalancers()
 	if err != nil {
 		return results, err
 	}
-	if len(balancers.Data) == 0 {
+	if len(balancers) == 0 {
 		logrus.Debug("Did not find any active load balancers")
 		return results, nil
 	}
 
-	logrus.Debugf("Found %d active load balancers", len(balancers.Data))
+	logrus.Debugf("Found %d active load balancers", len(balancers))
 
-	for _, b := range balancers.Data {
-		if b.LbConfig.DefaultCertificateId == certId {
-			results = append(results, b.Id)
+	for _, b := range balancers {
+		if b.LbConfig == nil {
 			continue
 		}
-		for _, id := range b.LbConfig.CertificateIds {
+		for _, id := range lbCertificateIds(&b) {
 			if id == certId {
 				results = append(results, b.Id)
 				break
@@ -89,3 +213,16 @@ func (r *Client) findLoadBalancerServicesByCert(certId string) ([]string, error)
 	logrus.Debugf("Found %d load balancers with matching certificate", len(results))
 	return results, nil
 }
+
+func (r *Client) listActiveLoadBalancers() ([]rancherClient.LoadBalancerService, error) {
+	balancers, err := r.client.LoadBalancerService.List(&rancherClient.ListOpts{
+		Filters: map[string]interface{}{
+			"removed_null": nil,
+			"state":        "active",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return balancers.Data, nil
+}
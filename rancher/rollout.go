@@ -0,0 +1,140 @@
+package rancher
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+// RolloutOpts configures the rollout of a changed certificate to load balancers
+type RolloutOpts struct {
+	// Update a single load balancer first
+	Canary bool
+	// Number of load balancers updated at once, 0 for all
+	BatchSize int
+	// Pause between batches
+	BatchInterval time.Duration
+	// Verify is called after a load balancer has been updated with the
+	// addresses of its TLS endpoints. An error stops the rollout.
+	Verify func(lbName string, endpoints []string) error
+}
+
+// RolloutLoadBalancers updates the load balancers using the certificate in batches.
+// The rollout stops at the first load balancer failing to update or verify.
+// Returns the IDs of the load balancers that have been updated.
+func (r *Client) RolloutLoadBalancers(certId string, opts RolloutOpts) ([]string, error) {
+	var updated []string
+
+	ids, err := r.findLoadBalancerServicesByCert(certId)
+	if err != nil {
+		return updated, err
+	}
+
+	if len(ids) == 0 {
+		logrus.Info("Certificate not used by any load balancer")
+		return updated, nil
+	}
+
+	for i, batch := range rolloutBatches(ids, opts.Canary, opts.BatchSize) {
+		if i > 0 && opts.BatchInterval > 0 {
+			time.Sleep(opts.BatchInterval)
+		}
+
+		logrus.Infof("Updating batch %d of load balancers (%d load balancers)", i+1, len(batch))
+
+		for _, id := range batch {
+			lb, err := r.client.LoadBalancerService.ById(id)
+			if err != nil {
+				return updated, fmt.Errorf("Failed to get load balancer by ID %s: %v", id, err)
+			}
+
+			if err := r.update(lb); err != nil {
+				return updated, fmt.Errorf("Failed to update load balancer '%s': %v", lb.Name, err)
+			}
+			updated = append(updated, id)
+
+			if opts.Verify != nil {
+				if err := opts.Verify(lb.Name, lbTLSEndpoints(lb)); err != nil {
+					return updated, fmt.Errorf("Verification of load balancer '%s' failed: %v", lb.Name, err)
+				}
+			}
+
+			logrus.Infof("Updated load balancer '%s' with changed certificate", lb.Name)
+		}
+	}
+
+	return updated, nil
+}
+
+// rolloutBatches splits the load balancer IDs into batches
+func rolloutBatches(ids []string, canary bool, size int) [][]string {
+	var batches [][]string
+	if canary && len(ids) > 1 {
+		batches = append(batches, ids[:1])
+		ids = ids[1:]
+	}
+	if size <= 0 {
+		size = len(ids)
+	}
+	for len(ids) > 0 {
+		n := size
+		if n > len(ids) {
+			n = len(ids)
+		}
+		batches = append(batches, ids[:n])
+		ids = ids[n:]
+	}
+	return batches
+}
+
+// lbTLSEndpoints returns the public addresses of the load balancer's TLS ports
+func lbTLSEndpoints(lb *rancherClient.LoadBalancerService) []string {
+	tlsPorts := map[int64]bool{}
+	if lb.LbConfig != nil {
+		for _, rule := range lb.LbConfig.PortRules {
+			if protocol := strings.ToLower(rule.Protocol); protocol == "https" || protocol == "tls" {
+				tlsPorts[rule.SourcePort] = true
+			}
+		}
+	}
+
+	var endpoints []string
+	seen := map[string]bool{}
+	for _, endpoint := range lb.PublicEndpoints {
+		if !tlsPorts[endpoint.Port] || len(endpoint.IpAddress) == 0 {
+			continue
+		}
+		address := net.JoinHostPort(endpoint.IpAddress, strconv.FormatInt(endpoint.Port, 10))
+		if !seen[address] {
+			seen[address] = true
+			endpoints = append(endpoints, address)
+		}
+	}
+	return endpoints
+}
+
+// LoadBalancerEndpoints returns the public TLS endpoints of the
+// load balancers using the certificate, keyed by load balancer name
+func (r *Client) LoadBalancerEndpoints(certId string) (map[string][]string, error) {
+	ids, err := r.findLoadBalancerServicesByCert(certId)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := map[string][]string{}
+	for _, id := range ids {
+		lb, err := r.client.LoadBalancerService.ById(id)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get load balancer by ID %s: %v", id, err)
+		}
+		if lb != nil {
+			endpoints[lb.Name] = lbTLSEndpoints(lb)
+		}
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,160 @@
+package rancher
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+const secretUpgradeTimeout = 5 * time.Minute
+
+// PublishSecret creates or replaces the secret with the given name. Rancher secrets
+// are immutable and their value can't be read back, so the description is
+// expected to identify the value, e.g. by the serial number of the certificate.
+// A changed secret is replaced by a new one: The services referencing the old
+// secret are upgraded to use the new one before the old secret is removed.
+// Returns true if the secret was created or replaced.
+func (r *Client) PublishSecret(name, descr string, value []byte) (bool, error) {
+	existing, err := r.findSecretsByName(name)
+	if err != nil {
+		return false, err
+	}
+
+	// Secrets left over by an earlier replacement that failed
+	// to upgrade all services are retried below
+	if n := len(existing); n > 0 && existing[n-1].Description == descr {
+		logrus.Debugf("Rancher secret '%s' is up to date", name)
+		return false, r.retireSecrets(name, existing[:n-1], &existing[n-1])
+	}
+
+	secret, err := r.client.Secret.Create(&rancherClient.Secret{
+		Name:        name,
+		Description: descr,
+		Value:       base64.StdEncoding.EncodeToString(value),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.WaitFor(&secret.Resource, secret, func() string {
+		return secret.Transitioning
+	}); err != nil {
+		return false, err
+	}
+
+	return true, r.retireSecrets(name, existing, secret)
+}
+
+// retireSecrets moves the services referencing the outdated secrets over to
+// the current one and removes each outdated secret once it's no longer used
+func (r *Client) retireSecrets(name string, outdated []rancherClient.Secret, current *rancherClient.Secret) error {
+	var failed int
+	for i := range outdated {
+		old := &outdated[i]
+		if err := r.replaceSecretReferences(old.Id, current.Id); err != nil {
+			logrus.Errorf("Keeping outdated Rancher secret '%s' (%s): %v", name, old.Id, err)
+			failed++
+			continue
+		}
+
+		logrus.Debugf("Removing outdated Rancher secret '%s' (%s)", name, old.Id)
+		if _, err := r.client.Secret.ActionRemove(old); err != nil {
+			logrus.Errorf("Failed to remove outdated Rancher secret '%s' (%s): %v", name, old.Id, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to retire %d outdated versions of secret '%s'", failed, name)
+	}
+	return nil
+}
+
+// FindSecretByName retrieves the most recently created active secret with the name
+func (r *Client) FindSecretByName(name string) (*rancherClient.Secret, error) {
+	secrets, err := r.findSecretsByName(name)
+	if err != nil || len(secrets) == 0 {
+		return nil, err
+	}
+	return &secrets[len(secrets)-1], nil
+}
+
+// findSecretsByName returns the active secrets with the name, oldest first
+func (r *Client) findSecretsByName(name string) ([]rancherClient.Secret, error) {
+	secrets, err := r.client.Secret.List(&rancherClient.ListOpts{
+		Filters: map[string]interface{}{
+			"name":         name,
+			"removed_null": nil,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var active []rancherClient.Secret
+	for _, secret := range secrets.Data {
+		if secret.State == "active" {
+			active = append(active, secret)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].Created < active[j].Created
+	})
+	return active, nil
+}
+
+// replaceSecretReferences upgrades all services using the secret oldId to use newId
+func (r *Client) replaceSecretReferences(oldId, newId string) error {
+	services, err := r.client.Service.List(&rancherClient.ListOpts{
+		Filters: map[string]interface{}{
+			"removed_null": nil,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for i := range services.Data {
+		service := &services.Data[i]
+
+		found := false
+		if service.LaunchConfig != nil {
+			found = replaceSecretId(service.LaunchConfig.Secrets, oldId, newId) || found
+		}
+		for _, config := range service.SecondaryLaunchConfigs {
+			found = replaceSecretId(config.Secrets, oldId, newId) || found
+		}
+		if !found {
+			continue
+		}
+
+		err := r.upgradeService(service, service.LaunchConfig, service.SecondaryLaunchConfigs, secretUpgradeTimeout)
+		if err != nil {
+			logrus.Errorf("Failed to upgrade service '%s' with replaced secret: %v", service.Name, err)
+			failed++
+			continue
+		}
+		logrus.Infof("Upgraded service '%s' with replaced secret", service.Name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to upgrade %d services using the replaced secret", failed)
+	}
+	return nil
+}
+
+func replaceSecretId(refs []rancherClient.SecretReference, oldId, newId string) bool {
+	found := false
+	for i := range refs {
+		if refs[i].SecretId == oldId {
+			refs[i].SecretId = newId
+			found = true
+		}
+	}
+	return found
+}
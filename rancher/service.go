@@ -0,0 +1,231 @@
+package rancher
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+const stackServiceLabel = "io.rancher.stack_service.name"
+
+// FindServices returns the active services matching selector. The selector is
+// either a service name, optionally prefixed with the stack name ("stack/service"),
+// or a launch config label in the form "label:key=value".
+func (r *Client) FindServices(selector string) ([]rancherClient.Service, error) {
+	var results []rancherClient.Service
+
+	// Stopped and inactive services must not be started as a side effect
+	filters := map[string]interface{}{
+		"removed_null": nil,
+		"state":        "active",
+	}
+
+	labelKey, labelValue, isLabel := parseLabelSelector(selector)
+	if !isLabel {
+		stackName, serviceName := splitServiceName(selector)
+		filters["name"] = serviceName
+		if len(stackName) > 0 {
+			stackId, err := r.findStackId(stackName)
+			if err != nil {
+				return nil, err
+			}
+			if len(stackId) == 0 {
+				return results, nil
+			}
+			filters["stackId"] = stackId
+		}
+	}
+
+	services, err := r.client.Service.List(&rancherClient.ListOpts{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, service := range services.Data {
+		if isLabel && (service.LaunchConfig == nil || !labelMatches(service.LaunchConfig.Labels, labelKey, labelValue)) {
+			continue
+		}
+		results = append(results, service)
+	}
+
+	logrus.Debugf("Found %d services matching '%s'", len(results), selector)
+	return results, nil
+}
+
+// RestartService restarts the containers of a service one at a time
+// and waits up to timeout for the restart to complete
+func (r *Client) RestartService(service *rancherClient.Service, timeout time.Duration) error {
+	logrus.Debugf("Restarting service %s", service.Name)
+
+	service, err := r.client.Service.ActionRestart(service, &rancherClient.ServiceRestart{
+		RollingRestartStrategy: rancherClient.RollingRestartStrategy{
+			BatchSize:      1,
+			IntervalMillis: 2000,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.WaitServiceTimeout(service, timeout)
+}
+
+// UpgradeService recreates the containers of a service using the current launch
+// config, waits up to timeout for the upgrade to complete and finishes it
+func (r *Client) UpgradeService(service *rancherClient.Service, timeout time.Duration) error {
+	return r.upgradeService(service, service.LaunchConfig, service.SecondaryLaunchConfigs, timeout)
+}
+
+func (r *Client) upgradeService(service *rancherClient.Service, launchConfig *rancherClient.LaunchConfig,
+	secondaryLaunchConfigs []rancherClient.SecondaryLaunchConfig, timeout time.Duration) error {
+	logrus.Debugf("Upgrading service %s", service.Name)
+
+	service, err := r.client.Service.ActionUpgrade(service, &rancherClient.ServiceUpgrade{
+		InServiceStrategy: &rancherClient.InServiceUpgradeStrategy{
+			BatchSize:              1,
+			IntervalMillis:         2000,
+			LaunchConfig:           launchConfig,
+			SecondaryLaunchConfigs: secondaryLaunchConfigs,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if err := r.WaitServiceTimeout(service, timeout); err != nil {
+		return err
+	}
+
+	if service.State != "upgraded" {
+		return fmt.Errorf("Upgrade of service %s ended in state '%s'", service.Name, service.State)
+	}
+
+	service, err = r.client.Service.ActionFinishupgrade(service)
+	if err != nil {
+		return err
+	}
+
+	return r.WaitServiceTimeout(service, timeout-time.Since(start))
+}
+
+// FindContainers returns the running containers matching selector. The selector is
+// either a container name, a service name in the form "stack/service" or a
+// container label in the form "label:key=value".
+func (r *Client) FindContainers(selector string) ([]rancherClient.Container, error) {
+	var results []rancherClient.Container
+
+	containers, err := r.client.Container.List(&rancherClient.ListOpts{
+		Filters: map[string]interface{}{
+			"removed_null": nil,
+			"state":        "running",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	labelKey, labelValue, isLabel := parseLabelSelector(selector)
+	for _, container := range containers.Data {
+		switch {
+		case isLabel && labelMatches(container.Labels, labelKey, labelValue):
+		case !isLabel && container.Name == selector:
+		case !isLabel && labelMatches(container.Labels, stackServiceLabel, selector):
+		default:
+			continue
+		}
+		results = append(results, container)
+	}
+
+	logrus.Debugf("Found %d containers matching '%s'", len(results), selector)
+	return results, nil
+}
+
+// SignalContainer sends signal to the main process of a container by
+// executing kill inside of it. Any output of the command is returned.
+func (r *Client) SignalContainer(container *rancherClient.Container, signal string, timeout time.Duration) (string, error) {
+	logrus.Debugf("Sending signal %s to container %s", signal, container.Name)
+
+	access, err := r.client.Container.ActionExecute(container, &rancherClient.ContainerExec{
+		AttachStdout: true,
+		Command:      []string{"kill", "-s", signal, "1"},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	conn, _, err := r.client.Websocket(access.Url+"?token="+access.Token, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to attach to container: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	// The output is streamed base64 encoded until the command exits
+	var output []byte
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return string(output), fmt.Errorf("Time out waiting for signal command to complete")
+			}
+			break
+		}
+		decoded, err := base64.StdEncoding.DecodeString(string(message))
+		if err == nil {
+			output = append(output, decoded...)
+		}
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (r *Client) findStackId(name string) (string, error) {
+	stacks, err := r.client.Stack.List(&rancherClient.ListOpts{
+		Filters: map[string]interface{}{
+			"name":         name,
+			"removed_null": nil,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(stacks.Data) == 0 {
+		return "", nil
+	}
+	return stacks.Data[0].Id, nil
+}
+
+func parseLabelSelector(selector string) (key, value string, ok bool) {
+	if !strings.HasPrefix(selector, "label:") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(selector, "label:"), "=", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1], true
+	}
+	return parts[0], "", true
+}
+
+func splitServiceName(name string) (stack, service string) {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// labelMatches returns true if labels contain key. If value
+// is not empty the label must also have the given value.
+func labelMatches(labels map[string]interface{}, key, value string) bool {
+	v, ok := labels[key]
+	if !ok {
+		return false
+	}
+	return len(value) == 0 || fmt.Sprint(v) == value
+}
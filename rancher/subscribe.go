@@ -0,0 +1,138 @@
+package rancher
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	resourceChangeEvent = "resource.change"
+
+	// Rancher sends a ping every few seconds, so a connection
+	// without any message for this long is considered broken
+	subscribeReadTimeout = 60 * time.Second
+)
+
+// Event is a change of a resource in the Rancher environment
+type Event struct {
+	ResourceType string
+	ResourceId   string
+	// Name and state of the resource after the change
+	Name  string
+	State string
+	// Certificates a load balancer started or stopped using
+	CertificateIds []string
+}
+
+type rawEvent struct {
+	Name         string `json:"name"`
+	ResourceType string `json:"resourceType"`
+	ResourceId   string `json:"resourceId"`
+	Data         struct {
+		Resource json.RawMessage `json:"resource"`
+	} `json:"data"`
+}
+
+// Watch subscribes to resource change events of the environment and calls
+// handler for each event. While subscribed, the load balancers using a certificate
+// are looked up in an index maintained from the events instead of listing all
+// load balancers. Watch blocks until the subscription fails.
+func (r *Client) Watch(handler func(Event)) error {
+	url, err := r.subscribeUrl()
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := r.client.Websocket(url, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to subscribe to events: %v", err)
+	}
+	defer conn.Close()
+
+	// Build the index after subscribing, so that no change is missed
+	index := newLBIndex()
+	if err := r.rebuildIndex(index); err != nil {
+		return err
+	}
+	r.setIndex(index)
+	defer r.setIndex(nil)
+
+	logrus.Debugf("Subscribed to Rancher events at %s", url)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(subscribeReadTimeout))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("Event subscription closed: %v", err)
+		}
+
+		var raw rawEvent
+		if err := json.Unmarshal(message, &raw); err != nil {
+			logrus.Debugf("Ignoring malformed event: %v", err)
+			continue
+		}
+		// Skip pings and other events
+		if raw.Name != resourceChangeEvent {
+			continue
+		}
+
+		event := Event{ResourceType: raw.ResourceType, ResourceId: raw.ResourceId}
+		var resource struct {
+			Name  string `json:"name"`
+			State string `json:"state"`
+		}
+		if len(raw.Data.Resource) > 0 {
+			json.Unmarshal(raw.Data.Resource, &resource)
+		}
+		event.Name = resource.Name
+		event.State = resource.State
+
+		if raw.ResourceType == rancherClient.LOAD_BALANCER_SERVICE_TYPE {
+			var lb rancherClient.LoadBalancerService
+			if err := json.Unmarshal(raw.Data.Resource, &lb); err == nil {
+				event.CertificateIds = index.update(&lb)
+			}
+		}
+
+		handler(event)
+	}
+}
+
+func (r *Client) subscribeUrl() (string, error) {
+	schema, ok := r.client.GetSchemas().CheckSchema(rancherClient.SUBSCRIBE_TYPE)
+	if !ok {
+		return "", fmt.Errorf("API key is not allowed to subscribe to events")
+	}
+
+	url, ok := schema.Links["collection"]
+	if !ok {
+		return "", fmt.Errorf("Failed to find subscribe URL")
+	}
+
+	if strings.HasPrefix(url, "https://") {
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	} else {
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	}
+
+	return url + "?eventNames=" + resourceChangeEvent, nil
+}
+
+func (r *Client) rebuildIndex(index *lbIndex) error {
+	balancers, err := r.listActiveLoadBalancers()
+	if err != nil {
+		return fmt.Errorf("Failed to list load balancers: %v", err)
+	}
+
+	for i := range balancers {
+		index.update(&balancers[i])
+	}
+
+	logrus.Debugf("Indexed certificates of %d load balancers", len(balancers))
+	return nil
+}
@@ -66,3 +66,14 @@ func (r *Client) WaitCertificate(certificate *rancherClient.Certificate) error {
 		return certificate.Transitioning
 	})
 }
+
+// WaitServiceTimeout waits up to timeout for a service resource to transition
+func (r *Client) WaitServiceTimeout(service *rancherClient.Service, timeout time.Duration) error {
+	return backoff(timeout, fmt.Sprintf("Time out waiting for service %s to become active", service.Name), func() (bool, error) {
+		err := r.client.Reload(&service.Resource, service)
+		if err != nil {
+			return false, err
+		}
+		return service.Transitioning != "yes", nil
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+// initRateLimits enables the local rate limit ledger. The limits of the Let's Encrypt
+// production CA apply by default and can be overridden with RATE_LIMITS.
+func (c *Context) initRateLimits(apiVersion letsencrypt.ApiVersion) {
+	param := getEnvOption("RATE_LIMITS", false)
+	if param == "none" || (len(param) == 0 && apiVersion != letsencrypt.Production) {
+		return
+	}
+
+	limits, err := letsencrypt.ParseRateLimits(param, letsencrypt.DefaultRateLimits())
+	if err != nil {
+		logrus.Fatalf("Invalid value for RATE_LIMITS: %v", err)
+	}
+	if err := c.Acme.SetRateLimits(limits); err != nil {
+		logrus.Fatalf("Could not initialize rate limits: %v", err)
+	}
+}
+
+// deferForRateLimits returns true if a certificate for the domains can't be
+// requested now without exceeding a rate limit of the CA. The request is
+// deferred until the limit allows it instead of blocking the manager.
+func (c *Context) deferForRateLimits(domains []string) bool {
+	err := c.Acme.CheckRateLimits(domains, false)
+	rateLimitErr, ok := err.(*letsencrypt.RateLimitError)
+	if !ok {
+		return false
+	}
+	logrus.Warnf("%v: Deferring certificate request", rateLimitErr)
+	c.RenewalDeferredUntil = rateLimitErr.RetryAfter
+	return true
+}
+
+// reportQuota logs the remaining rate limit quota and updates the metrics
+func (c *Context) reportQuota(domains []string) {
+	quota := c.Acme.RateLimitQuota(domains)
+	if len(quota) == 0 {
+		return
+	}
+
+	c.Status.metrics.Reset("letsencrypt_ratelimit_remaining", map[string]string{"certificate": c.CertificateName})
+	for _, q := range quota {
+		c.Status.metrics.Set("letsencrypt_ratelimit_remaining",
+			"Requests remaining within the rate limits of the CA",
+			map[string]string{"certificate": c.CertificateName, "limit": q.Limit, "key": q.Key}, float64(q.Remaining))
+
+		if q.Remaining <= q.Max/5 {
+			logrus.Warnf("Rate limit '%s' for %s: %d of %d requests remaining", q.Limit, q.Key, q.Remaining, q.Max)
+		} else {
+			logrus.Debugf("Rate limit '%s' for %s: %d of %d requests remaining", q.Limit, q.Key, q.Remaining, q.Max)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+const rehearsalKeyPrefix = "rehearsals"
+
+// rehearsalRecord is stored after the domains have been validated by the staging CA
+type rehearsalRecord struct {
+	Domains     []string  `json:"domains"`
+	Serial      string    `json:"serial"`
+	RehearsedAt time.Time `json:"rehearsedAt"`
+}
+
+// rehearse obtains a certificate for the domains from the staging CA if
+// STAGING_REHEARSAL is enabled, unless the same set of domains has been
+// rehearsed successfully before. Returns the domains failing validation.
+func (c *Context) rehearse(domains []string) map[string]error {
+	if c.Staging == nil {
+		return nil
+	}
+	key := rehearsalKey(domains)
+	if ok, err := c.Storage.Exists(key); err != nil {
+		logrus.Warnf("Could not look up staging rehearsal: %v", err)
+	} else if ok {
+		logrus.Infof("Domains (%s) have been validated by the staging CA before", strings.Join(domains, ","))
+		return nil
+	}
+
+	logrus.Infof("Rehearsing issuance of certificate (%s) with the Let's Encrypt %s CA", strings.Join(domains, ","), c.Staging.ApiVersion())
+	acmeCert, failures := c.Staging.Issue(c.CertificateName, domains)
+	if len(failures) > 0 {
+		for domain, err := range failures {
+			logrus.Errorf("[%s] Staging rehearsal failed: %v", domain, err)
+		}
+		return failures
+	}
+
+	data, err := json.Marshal(rehearsalRecord{
+		Domains:     domains,
+		Serial:      acmeCert.SerialNumber,
+		RehearsedAt: time.Now().UTC(),
+	})
+	if err == nil {
+		err = c.Storage.Put(key, data)
+	}
+	if err != nil {
+		logrus.Warnf("Could not store result of staging rehearsal: %v", err)
+	}
+
+	logrus.Infof("Staging rehearsal succeeded")
+	return nil
+}
+
+// rehearsalKey returns the storage key of the rehearsal record for a set of domains
+func rehearsalKey(domains []string) string {
+	sorted := append([]string{}, domains...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return path.Join(rehearsalKeyPrefix, hex.EncodeToString(sum[:16]))
+}
+
+// newStagingClient returns a client for the staging CA using a separate account
+func newStagingClient(storage letsencrypt.Storage, accountName string, emails []string, keyType letsencrypt.KeyType, dnsResolvers []string, providerOpts letsencrypt.ProviderOpts) *letsencrypt.Client {
+	client, err := letsencrypt.NewClient(storage, accountName, emails, keyType, letsencrypt.Sandbox, dnsResolvers, providerOpts)
+	if err != nil {
+		logrus.Fatalf("LetsEncrypt staging client: %v", err)
+	}
+	return client
+}
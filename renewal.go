@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+// RENEWAL_INFO_POLL_INTERVAL is how often the CA is asked for a renewal window
+// of the certificate unless it tells otherwise
+const RENEWAL_INFO_POLL_INTERVAL = 6 * time.Hour
+
+// The renewal jitter delays a renewal by at most this share of the time left until expiry
+const RENEWAL_JITTER_MAX_SHARE = 4
+
+// renewalState holds what the renewal time of the current certificate is derived from
+type renewalState struct {
+	cert      *letsencrypt.AcmeCertificate
+	notBefore time.Time
+	// Random delay of the renewal
+	jitter time.Duration
+	// Renewal window suggested by the CA and the time picked in it
+	window    *letsencrypt.RenewalWindow
+	windowAt  time.Time
+	nextCheck time.Time
+}
+
+// trackCertificate makes the given certificate the one whose renewal is scheduled
+func (c *Context) trackCertificate(acmeCert *letsencrypt.AcmeCertificate) {
+	c.ExpiryDate = acmeCert.ExpiryDate
+	if c.renewal.cert != nil && c.renewal.cert.SerialNumber == acmeCert.SerialNumber {
+		c.renewal.cert = acmeCert
+		return
+	}
+
+	c.renewal = renewalState{cert: acmeCert}
+	if c.RenewalJitter > 0 {
+		c.renewal.jitter = time.Duration(rand.Int63n(int64(c.RenewalJitter)))
+	}
+	if c.RenewalLifetimePercent > 0 {
+		notBefore, _, err := letsencrypt.ValidityPeriod(acmeCert)
+		if err != nil {
+			logrus.Warnf("Could not determine validity period of certificate '%s': %v", c.CertificateName, err)
+		}
+		c.renewal.notBefore = notBefore
+	}
+}
+
+// dueDate returns when the certificate is due for renewal, before RENEWAL_TIME,
+// the renewal schedule and jitter are applied. The returned bool is true if
+// the date has been picked from the renewal window suggested by the CA.
+func (c *Context) dueDate() (time.Time, bool) {
+	if window := c.renewalWindow(); window != nil {
+		return c.renewal.windowAt, true
+	}
+	if c.RenewalLifetimePercent > 0 && !c.renewal.notBefore.IsZero() {
+		lifetime := c.ExpiryDate.Sub(c.renewal.notBefore)
+		return c.ExpiryDate.Add(-lifetime / 100 * time.Duration(c.RenewalLifetimePercent)), false
+	}
+	return c.ExpiryDate.AddDate(0, 0, -c.RenewalPeriodDays), false
+}
+
+// renewalWindow returns the renewal window suggested by the CA, nil if it doesn't
+// suggest one. It's kept up to date by refreshRenewalInfo.
+func (c *Context) renewalWindow() *letsencrypt.RenewalWindow {
+	if !c.RenewalInfo || c.renewal.cert == nil {
+		return nil
+	}
+	return c.renewal.window
+}
+
+// refreshRenewalInfo asks the CA for the renewal window of the certificate once
+// the previous answer is outdated. The caller must not hold c.mu, which is shared
+// by all certificates, while waiting for the CA.
+func (c *Context) refreshRenewalInfo() {
+	c.mu.Lock()
+	cert := c.renewal.cert
+	now := time.Now()
+	due := c.RenewalInfo && cert != nil && !now.Before(c.renewal.nextCheck)
+	if due {
+		c.renewal.nextCheck = now.Add(RENEWAL_INFO_POLL_INTERVAL)
+	}
+	c.mu.Unlock()
+	if !due {
+		return
+	}
+
+	window, err := c.Acme.RenewalInfo(cert)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The certificate may have been renewed meanwhile
+	if c.renewal.cert == nil || c.renewal.cert.SerialNumber != cert.SerialNumber {
+		return
+	}
+	if err != nil {
+		logrus.Warnf("Could not get renewal information for certificate '%s': %v", c.CertificateName, err)
+		return
+	}
+	if window == nil {
+		c.renewal.window = nil
+		return
+	}
+	if window.RetryAfter.After(now) {
+		c.renewal.nextCheck = window.RetryAfter
+	}
+
+	if old := c.renewal.window; old == nil || !old.Start.Equal(window.Start) || !old.End.Equal(window.End) {
+		c.renewal.windowAt = window.Start.Add(time.Duration(rand.Int63n(int64(window.End.Sub(window.Start)))))
+		logrus.Infof("CA suggests renewing certificate '%s' between %s and %s", c.CertificateName,
+			window.Start.In(c.Location).Format("2006/01/02 15:04 MST"), window.End.In(c.Location).Format("2006/01/02 15:04 MST"))
+		if window.ExplanationURL != "" {
+			logrus.Infof("Reason for the renewal window of certificate '%s': %s", c.CertificateName, window.ExplanationURL)
+		}
+	}
+	c.renewal.window = window
+}
+
+// jitter returns the random delay of a renewal due at date. It's limited to a
+// share of the time left until expiry, so that a large RENEWAL_JITTER can't
+// delay the renewal past the expiry of the certificate.
+func (c *Context) jitter(date time.Time) time.Duration {
+	max := c.ExpiryDate.Sub(date) / RENEWAL_JITTER_MAX_SHARE
+	if max <= 0 {
+		return 0
+	}
+	if c.renewal.jitter > max {
+		return max
+	}
+	return c.renewal.jitter
+}
+
+// issuancePending returns true if no certificate has been obtained yet
+// because the request was deferred
+func (c *Context) issuancePending() bool {
+	return c.ExpiryDate.IsZero() && !c.RenewalDeferredUntil.IsZero()
+}
+
+// renewalTime returns when the certificate is renewed next,
+// or requested if the request has been deferred
+func (c *Context) renewalTime() time.Time {
+	if c.issuancePending() {
+		return c.RenewalDeferredUntil
+	}
+	next := c.getRenewalDate()
+	if next.Before(c.RenewalDeferredUntil) {
+		next = c.RenewalDeferredUntil
+	}
+	if c.renewal.cert != nil && next.Before(c.renewal.cert.RenewalHoldUntil) {
+		next = c.renewal.cert.RenewalHoldUntil
+	}
+	return next
+}
+
+// renewalDue returns whether the certificate should be renewed now
+func (c *Context) renewalDue() bool {
+	return c.TestMode || !time.Now().Before(c.renewalTime())
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+func TestRenewalTimeRollbackHold(t *testing.T) {
+	c := &Context{Location: time.UTC, RenewalPeriodDays: 20, RenewalDayTime: 12}
+
+	// A restored version already due for renewal
+	acmeCert := &letsencrypt.AcmeCertificate{SerialNumber: "1", ExpiryDate: time.Now().Add(10 * 24 * time.Hour)}
+	c.trackCertificate(acmeCert)
+	if !c.renewalDue() {
+		t.Fatal("Expected the certificate to be due for renewal")
+	}
+
+	acmeCert.RenewalHoldUntil = time.Now().Add(24 * time.Hour)
+	c.trackCertificate(acmeCert)
+	if next := c.renewalTime(); !next.Equal(acmeCert.RenewalHoldUntil) {
+		t.Errorf("Expected renewal to be held until %s, got %s", acmeCert.RenewalHoldUntil, next)
+	}
+	if c.renewalDue() {
+		t.Error("Expected renewal to be held")
+	}
+}
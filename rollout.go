@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+const ROLLOUT_VERIFY_TIMEOUT_SECONDS = 60
+
+// RolloutOpts configures how a changed certificate is rolled out
+// to the load balancers using it
+type RolloutOpts struct {
+	// Update and verify a single load balancer first
+	Canary bool
+	// Number of load balancers updated at once, 0 for all
+	BatchSize int
+	// Pause between batches
+	BatchInterval time.Duration
+	// Check that the load balancers serve the new certificate
+	Verify        bool
+	VerifyTimeout time.Duration
+	// Restore the previous certificate if the rollout fails
+	Revert bool
+}
+
+// Enabled returns true if load balancers are updated in a controlled rollout
+func (r RolloutOpts) Enabled() bool {
+	return r.Canary || r.BatchSize > 0 || r.Verify || r.Revert
+}
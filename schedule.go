@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Schedule restricts when an action may run
+type Schedule interface {
+	// Next returns the earliest time not before t the action may run at
+	Next(t time.Time) time.Time
+	String() string
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// ParseSchedule parses a cron expression ("minute hour day-of-month month day-of-week")
+// or a weekly window of days and hours, e.g. "Mon-Fri 02:00-05:00" or "Sat,Sun 22-04"
+func ParseSchedule(spec string, loc *time.Location) (Schedule, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		return parseCron(fields, loc)
+	case 2:
+		return parseWindow(fields, loc)
+	}
+	return nil, fmt.Errorf("Invalid schedule '%s': Expected a cron expression or a window like 'Mon-Fri 02:00-05:00'", spec)
+}
+
+// cronSchedule allows the minutes matching a cron expression
+type cronSchedule struct {
+	spec                          string
+	minute, hour, dom, month, dow []bool
+	domRestricted, dowRestricted  bool
+	loc                           *time.Location
+}
+
+func parseCron(fields []string, loc *time.Location) (Schedule, error) {
+	s := &cronSchedule{spec: strings.Join(fields, " "), loc: loc}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are Sunday
+	s.dow[0] = s.dow[0] || s.dow[7]
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+func parseCronField(field string, min, max int, names map[string]int) ([]bool, error) {
+	set := make([]bool, max+1)
+	value := func(str string) (int, error) {
+		if v, ok := names[strings.ToLower(str)]; ok {
+			return v, nil
+		}
+		v, err := strconv.Atoi(str)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("Invalid value '%s' in cron field '%s'", str, field)
+		}
+		return v, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("Invalid step in cron field '%s'", field)
+			}
+			step = s
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = value(bounds[0]); err != nil {
+				return nil, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = value(bounds[1]); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				to = max
+			}
+			if to < from {
+				return nil, fmt.Errorf("Invalid range in cron field '%s'", field)
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	if !s.month[int(t.Month())] {
+		return false
+	}
+	dom := s.dom[t.Day()]
+	dow := s.dow[int(t.Weekday())]
+	// Like cron, match either day field if both are restricted
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc)
+	if s.dayMatches(t) && s.hour[t.Hour()] && s.minute[t.Minute()] {
+		return t
+	}
+
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	// Give up after five years, e.g. for February 30th
+	for limit := t.AddDate(5, 0, 0); next.Before(limit); {
+		if !s.dayMatches(next) {
+			y, m, d := next.Date()
+			next = time.Date(y, m, d+1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.hour[next.Hour()] {
+			y, m, d := next.Date()
+			next = time.Date(y, m, d, next.Hour()+1, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.minute[next.Minute()] {
+			next = next.Add(time.Minute)
+			continue
+		}
+		return next
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) String() string {
+	return fmt.Sprintf("cron '%s' (%s)", s.spec, s.loc)
+}
+
+// windowSchedule allows a daily range of hours on some days of the week.
+// A window ending before it starts lasts until the next day.
+type windowSchedule struct {
+	spec       string
+	days       [7]bool
+	start, end int // minutes of the day
+	loc        *time.Location
+}
+
+func parseWindow(fields []string, loc *time.Location) (Schedule, error) {
+	s := &windowSchedule{spec: strings.Join(fields, " "), loc: loc}
+
+	if fields[0] == "*" || strings.ToLower(fields[0]) == "daily" {
+		for i := range s.days {
+			s.days[i] = true
+		}
+	} else {
+		days, err := parseCronField(fields[0], 0, 7, weekdayNames)
+		if err != nil {
+			return nil, err
+		}
+		for i, ok := range days {
+			if ok {
+				s.days[i%7] = true
+			}
+		}
+	}
+
+	hours := strings.SplitN(fields[1], "-", 2)
+	if len(hours) != 2 {
+		return nil, fmt.Errorf("Invalid window hours '%s'", fields[1])
+	}
+	var err error
+	if s.start, err = parseTimeOfDay(hours[0]); err != nil {
+		return nil, err
+	}
+	if s.end, err = parseTimeOfDay(hours[1]); err != nil {
+		return nil, err
+	}
+	if s.start == s.end {
+		return nil, fmt.Errorf("Empty window '%s'", fields[1])
+	}
+	return s, nil
+}
+
+// parseTimeOfDay parses HH or HH:MM and returns the minutes of the day
+func parseTimeOfDay(str string) (int, error) {
+	parts := strings.SplitN(str, ":", 2)
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("Invalid time of day '%s'", str)
+	}
+	minute := 0
+	if len(parts) == 2 {
+		minute, err = strconv.Atoi(parts[1])
+		if err != nil || minute < 0 || minute > 59 || (hour == 24 && minute > 0) {
+			return 0, fmt.Errorf("Invalid time of day '%s'", str)
+		}
+	}
+	return hour*60 + minute, nil
+}
+
+// windowStart returns the start of the window on the day of t
+func (s *windowSchedule) windowStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, s.start, 0, 0, s.loc)
+}
+
+func (s *windowSchedule) length() time.Duration {
+	minutes := s.end - s.start
+	if minutes < 0 {
+		minutes += 24 * 60
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (s *windowSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc)
+	// Windows starting yesterday may still be open
+	for i := -1; i <= 7; i++ {
+		y, m, d := t.Date()
+		day := time.Date(y, m, d+i, 12, 0, 0, 0, s.loc)
+		if !s.days[int(day.Weekday())] {
+			continue
+		}
+		start := s.windowStart(day)
+		if end := start.Add(s.length()); t.Before(end) {
+			if t.Before(start) {
+				return start
+			}
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *windowSchedule) String() string {
+	return fmt.Sprintf("window '%s' (%s)", s.spec, s.loc)
+}
+
+// Interval of checking whether a deferred rollout may start
+const ROLLOUT_CHECK_INTERVAL = time.Minute
+
+// rolloutDeferred returns true if Rancher certificates may not be updated now
+func (c *Context) rolloutDeferred() bool {
+	if c.RolloutSchedule == nil || c.rolloutNow {
+		return false
+	}
+	now := time.Now()
+	return !c.RolloutSchedule.Next(now).Equal(now)
+}
+
+// rolloutLoop updates the Rancher certificates deferred
+// to the rollout schedule once it allows the update
+func (c *Context) rolloutLoop() {
+	for {
+		time.Sleep(ROLLOUT_CHECK_INTERVAL)
+
+		c.mu.Lock()
+		if c.rolloutPending && !time.Now().Before(c.RolloutSchedule.Next(c.rolloutPendingSince)) {
+			c.rolloutPending = false
+			c.runDeferredRollout()
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *Context) runDeferredRollout() {
+	ok, acmeCert := c.storedCertificate()
+	if !ok {
+		return
+	}
+
+	logrus.Infof("Rollout window reached: Updating Rancher certificate '%s'", c.CertificateName)
+	c.rolloutNow = true
+	defer func() { c.rolloutNow = false }()
+
+	if err := c.syncTargets(acmeCert); err != nil {
+		logrus.Error(err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(day, clock string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", day+" "+clock, time.UTC)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		spec string
+		from time.Time
+		next time.Time
+	}{
+		// Sunday
+		{"0 3 * * mon", date("2026-10-18", "10:00:00"), date("2026-10-19", "03:00:00")},
+		{"*/15 * * * *", date("2026-10-18", "10:07:30"), date("2026-10-18", "10:15:00")},
+		{"*/15 * * * *", date("2026-10-18", "10:15:30"), date("2026-10-18", "10:15:30")},
+		{"0 12 * * 7", date("2026-10-24", "13:00:00"), date("2026-10-25", "12:00:00")},
+		{"30 2 * jan-feb *", date("2026-10-18", "10:00:00"), date("2027-01-01", "02:30:00")},
+		// Either day field matches if both are restricted
+		{"0 0 1 * fri", date("2026-10-24", "00:00:00"), date("2026-10-30", "00:00:00")},
+		{"0 0 1 * fri", date("2026-10-30", "00:01:00"), date("2026-11-01", "00:00:00")},
+		{"0 0 30 2 *", date("2026-10-18", "10:00:00"), time.Time{}},
+
+		{"Mon-Fri 02:00-05:00", date("2026-10-19", "03:00:00"), date("2026-10-19", "03:00:00")},
+		{"Mon-Fri 02:00-05:00", date("2026-10-18", "10:00:00"), date("2026-10-19", "02:00:00")},
+		{"Mon-Fri 02:00-05:00", date("2026-10-23", "05:00:00"), date("2026-10-26", "02:00:00")},
+		// The window starting on Sunday lasts until Monday morning
+		{"Sat,Sun 22-04", date("2026-10-19", "01:00:00"), date("2026-10-19", "01:00:00")},
+		{"Sat,Sun 22-04", date("2026-10-19", "05:00:00"), date("2026-10-24", "22:00:00")},
+		{"daily 1-3", date("2026-10-18", "04:00:00"), date("2026-10-19", "01:00:00")},
+		{"* 23:30-24", date("2026-10-18", "23:45:00"), date("2026-10-18", "23:45:00")},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.spec, time.UTC)
+		if err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+			continue
+		}
+		if next := schedule.Next(test.from); !next.Equal(test.next) {
+			t.Errorf("%s: Expected next time after %s to be %s, got %s", test.spec, test.from, test.next, next)
+		}
+	}
+}
+
+func TestScheduleLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	schedule, err := ParseSchedule("daily 1-3", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 02:30 in the location of the schedule
+	from := date("2026-10-18", "00:30:00")
+	if next := schedule.Next(from); !next.Equal(from) {
+		t.Errorf("Expected %s to be within the window, got %s", from, next)
+	}
+	if next := schedule.Next(date("2026-10-18", "01:00:00")); !next.Equal(date("2026-10-18", "23:00:00")) {
+		t.Errorf("Expected the next window to start at 23:00 UTC, got %s", next)
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"61 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * * someday",
+		"Mon 02:00",
+		"Mon 3-3",
+		"Mon 25-3",
+		"Mon 02:60-03",
+		"Mon 24:30-03",
+		"Someday 02-03",
+	} {
+		if _, err := ParseSchedule(spec, time.UTC); err == nil {
+			t.Errorf("Expected an error for schedule '%s'", spec)
+		}
+	}
+}
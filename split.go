@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+// Maximum number of domains per certificate accepted by Let's Encrypt
+const SPLIT_MAX_DOMAINS = 100
+
+type SplitMode string
+
+const (
+	SplitNone = SplitMode("")
+	// Fill certificates with up to MaxDomains domains in the configured order
+	SplitByCount = SplitMode("count")
+	// One certificate per registered domain, the first one keeps the name
+	SplitByDomain = SplitMode("domain")
+)
+
+// SplitOpts configures how the domains are split into several certificates
+type SplitOpts struct {
+	Mode       SplitMode
+	MaxDomains int
+}
+
+type shardSpec struct {
+	Name    string
+	Domains []string
+}
+
+// planShards splits the domains of the named certificate according to opts.
+// The first shard keeps the name, so that the existing certificate stays in
+// use on the load balancers, e.g. as their default certificate.
+func planShards(certName string, domains []string, opts SplitOpts) []shardSpec {
+	var shards []shardSpec
+	switch opts.Mode {
+	case SplitByCount:
+		for i, chunk := range chunkDomains(domains, opts.MaxDomains) {
+			name := certName
+			if i > 0 {
+				name += "-" + strconv.Itoa(i+1)
+			}
+			shards = append(shards, shardSpec{name, chunk})
+		}
+	case SplitByDomain:
+		var registered []string
+		groups := map[string][]string{}
+		for _, domain := range domains {
+			r := letsencrypt.RegisteredDomain(domain)
+			if _, ok := groups[r]; !ok {
+				registered = append(registered, r)
+			}
+			groups[r] = append(groups[r], domain)
+		}
+		for _, r := range registered {
+			for i, chunk := range chunkDomains(groups[r], opts.MaxDomains) {
+				name := certName + "-" + r
+				if i > 0 {
+					name += "-" + strconv.Itoa(i+1)
+				}
+				if len(shards) == 0 {
+					name = certName
+				}
+				shards = append(shards, shardSpec{name, chunk})
+			}
+		}
+	}
+
+	if len(shards) <= 1 {
+		return []shardSpec{{certName, domains}}
+	}
+	return shards
+}
+
+func chunkDomains(domains []string, size int) [][]string {
+	var chunks [][]string
+	for len(domains) > 0 {
+		n := size
+		if n > len(domains) {
+			n = len(domains)
+		}
+		chunks = append(chunks, domains[:n])
+		domains = domains[n:]
+	}
+	return chunks
+}
+
+// splitShards returns a context for each certificate the domains are split into
+func (c *Context) splitShards() []*Context {
+	specs := planShards(c.CertificateName, c.Domains, c.Split)
+	if len(specs) == 1 {
+		return []*Context{c}
+	}
+
+	// The original certificate is part of the group, so that the
+	// load balancers using it receive the new certificates
+	group := []string{c.CertificateName}
+	for _, spec := range specs {
+		if spec.Name != c.CertificateName {
+			group = append(group, spec.Name)
+		}
+	}
+
+	var shards []*Context
+	for _, spec := range specs {
+		logrus.Infof("Managing domains (%s) in certificate '%s'", strings.Join(spec.Domains, ","), spec.Name)
+		shards = append(shards, c.newShard(spec, group))
+	}
+	return shards
+}
+
+func (c *Context) newShard(spec shardSpec, group []string) *Context {
+	shard := *c
+	shard.CertificateName = spec.Name
+	shard.Domains = spec.Domains
+	shard.ShardGroup = group
+	shard.ExpiryDate = time.Time{}
+	shard.RenewalDeferredUntil = time.Time{}
+	shard.renewal = renewalState{}
+	shard.verifyNow = make(chan struct{}, 1)
+	shard.plannedChanges = nil
+
+	suffix := strings.TrimPrefix(spec.Name, c.CertificateName)
+	shard.RancherSecretName = c.RancherSecretName + suffix
+	shard.KubernetesSecret.Name = kubernetesName(c.KubernetesSecret.Name + suffix)
+
+	shard.Targets = nil
+	for _, target := range c.Targets {
+		shard.Targets = append(shard.Targets, &RancherTarget{Name: target.Name, Client: target.Client})
+	}
+	return &shard
+}
+
+// runShards manages the certificates of all shards concurrently
+func runShards(shards []*Context) {
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard *Context) {
+			defer wg.Done()
+			shard.run()
+		}(shard)
+	}
+	wg.Wait()
+}
+
+// attachShard adds the certificate to the load balancers using
+// any other certificate the domains have been split into
+func (c *Context) attachShard(target *RancherTarget) error {
+	var lbIds []string
+	for _, name := range c.ShardGroup {
+		if name == c.CertificateName {
+			continue
+		}
+		rancherCert, err := target.Client.FindCertByName(name)
+		if err != nil {
+			return err
+		}
+		if rancherCert == nil {
+			continue
+		}
+		refs, err := target.Client.LoadBalancerRefs(rancherCert.Id)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			lbIds = append(lbIds, ref.Id)
+		}
+	}
+
+	return target.Client.AttachCertificate(lbIds, target.CertId)
+}
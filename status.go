@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// A certificate not renewed this long after its renewal date means that the manager is stuck
+const RENEWAL_OVERDUE_GRACE = 24 * time.Hour
+
+// Status tracks the state reported by the health endpoint and the metrics
+type Status struct {
+	mu           sync.Mutex
+	certificates map[string]*CertificateStatus
+	// Current leader if leader election is enabled
+	leader   string
+	isLeader bool
+
+	metrics *metricRegistry
+}
+
+// CertificateStatus is the state of a managed certificate
+type CertificateStatus struct {
+	Name       string    `json:"name"`
+	Serial     string    `json:"serial,omitempty"`
+	ExpiryDate time.Time `json:"expiryDate"`
+	// Next scheduled renewal, zero if this replica doesn't manage the renewal
+	RenewalDate time.Time `json:"renewalDate"`
+	// Results of the last verification of the deployed certificate
+	Verification []VerifyResult `json:"verification,omitempty"`
+	VerifiedAt   time.Time      `json:"verifiedAt"`
+}
+
+type healthResponse struct {
+	Status       string              `json:"status"`
+	Error        string              `json:"error,omitempty"`
+	Failures     []string            `json:"failures,omitempty"`
+	Role         string              `json:"role,omitempty"`
+	Leader       string              `json:"leader,omitempty"`
+	Certificates []CertificateStatus `json:"certificates"`
+}
+
+// VerifyResult is the outcome of checking the certificate served by an endpoint
+type VerifyResult struct {
+	Endpoint   string `json:"endpoint"`
+	ServerName string `json:"serverName"`
+	// Name of the load balancer, empty for domain endpoints
+	LoadBalancer string `json:"loadBalancer,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+func newStatus() *Status {
+	return &Status{
+		certificates: map[string]*CertificateStatus{},
+		metrics:      newMetricRegistry(),
+	}
+}
+
+// certificate returns the status of the named certificate, the caller must hold s.mu
+func (s *Status) certificate(certName string) *CertificateStatus {
+	if s.certificates[certName] == nil {
+		s.certificates[certName] = &CertificateStatus{Name: certName}
+	}
+	return s.certificates[certName]
+}
+
+// SetCertificate records the certificate currently managed
+func (s *Status) SetCertificate(certName, serial string, expiryDate time.Time) {
+	s.mu.Lock()
+	cert := s.certificate(certName)
+	cert.Serial = serial
+	cert.ExpiryDate = expiryDate
+	s.mu.Unlock()
+
+	labels := map[string]string{"certificate": certName}
+	s.metrics.Set("letsencrypt_certificate_expiry_timestamp_seconds",
+		"Expiry date of the managed certificate", labels, float64(expiryDate.Unix()))
+}
+
+// SetRenewalDate records when the certificate is renewed next
+func (s *Status) SetRenewalDate(certName string, renewalDate time.Time) {
+	s.mu.Lock()
+	s.certificate(certName).RenewalDate = renewalDate
+	s.mu.Unlock()
+
+	labels := map[string]string{"certificate": certName}
+	s.metrics.Set("letsencrypt_certificate_renewal_timestamp_seconds",
+		"Next scheduled renewal of the managed certificate", labels, float64(renewalDate.Unix()))
+}
+
+// SetVerification records the results of a verification run
+func (s *Status) SetVerification(certName string, results []VerifyResult) {
+	s.mu.Lock()
+	cert := s.certificate(certName)
+	cert.Verification = results
+	cert.VerifiedAt = time.Now()
+	s.mu.Unlock()
+
+	labels := map[string]string{"certificate": certName}
+	failed := 0
+	s.metrics.Reset("letsencrypt_verify_endpoint_ok", labels)
+	for _, result := range results {
+		ok := 1.0
+		if len(result.Error) > 0 {
+			ok = 0
+			failed++
+		}
+		s.metrics.Set("letsencrypt_verify_endpoint_ok",
+			"Whether the endpoint serves the managed certificate",
+			map[string]string{"certificate": certName, "endpoint": result.Endpoint, "server_name": result.ServerName}, ok)
+	}
+
+	s.metrics.Set("letsencrypt_verify_failed_endpoints",
+		"Number of endpoints not serving the managed certificate", labels, float64(failed))
+	s.metrics.Set("letsencrypt_verify_last_run_timestamp_seconds",
+		"Time of the last verification of the deployed certificate", labels, float64(time.Now().Unix()))
+}
+
+// SetLeader records the elected leader and whether it's this replica
+func (s *Status) SetLeader(leader string, isLeader bool) {
+	s.mu.Lock()
+	s.leader = leader
+	s.isLeader = isLeader
+	s.mu.Unlock()
+
+	value := 0.0
+	if isLeader {
+		value = 1
+	}
+	s.metrics.Set("letsencrypt_leader", "Whether this replica is the elected leader", nil, value)
+}
+
+// Leader returns the current leader and whether it's this replica
+func (s *Status) Leader() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leader, s.isLeader
+}
+
+// Certificates returns a copy of the state of all certificates ordered by name
+func (s *Status) Certificates() []CertificateStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.certificates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	certs := make([]CertificateStatus, 0, len(names))
+	for _, name := range names {
+		certs = append(certs, *s.certificates[name])
+	}
+	return certs
+}
+
+// Healthy returns an error describing the problem if a certificate is expired
+// or the manager failed to renew it long after it was due
+func (s *Status) Healthy() error {
+	now := time.Now()
+	for _, cert := range s.Certificates() {
+		if !cert.ExpiryDate.IsZero() && now.After(cert.ExpiryDate) {
+			return fmt.Errorf("Certificate '%s' expired on %s", cert.Name, cert.ExpiryDate.UTC().Format(time.RFC3339))
+		}
+		if !cert.RenewalDate.IsZero() && now.After(cert.RenewalDate.Add(RENEWAL_OVERDUE_GRACE)) {
+			return fmt.Errorf("Renewal of certificate '%s' is overdue since %s", cert.Name, cert.RenewalDate.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Failures returns the endpoints that didn't serve the certificate at the last verification
+func (s *Status) Failures() []string {
+	var failures []string
+	for _, cert := range s.Certificates() {
+		for _, result := range cert.Verification {
+			if len(result.Error) > 0 {
+				failures = append(failures, fmt.Sprintf("%s: %s", result.Endpoint, result.Error))
+			}
+		}
+	}
+	return failures
+}
+
+// serveStatus serves the health endpoint and the metrics on port
+func (c *Context) serveStatus(port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.handleHealth)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.Status.metrics.Write(w)
+	})
+
+	address := net.JoinHostPort("", strconv.Itoa(port))
+	logrus.Infof("Serving health endpoint and metrics on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logrus.Fatalf("Failed to serve health endpoint: %v", err)
+	}
+}
+
+func (c *Context) handleHealth(w http.ResponseWriter, r *http.Request) {
+	response := healthResponse{Status: "ok", Certificates: c.Status.Certificates()}
+	if c.Leader.Enabled {
+		response.Role = "follower"
+		var isLeader bool
+		if response.Leader, isLeader = c.Status.Leader(); isLeader {
+			response.Role = "leader"
+		}
+	}
+	code := http.StatusOK
+	// Endpoints not serving the certificate are reported without failing the health check,
+	// since the manager can't fix them by restarting
+	if response.Failures = c.Status.Failures(); len(response.Failures) > 0 {
+		response.Status = "degraded"
+	}
+	if err := c.Status.Healthy(); err != nil {
+		response.Status = "unhealthy"
+		response.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+	"github.com/janeczku/rancher-letsencrypt/rancher"
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	DEFAULT_TARGET = "default"
+
+	// Time before a certificate reverted after a failed rollout is renewed again
+	REVERT_RENEWAL_DELAY = 24 * time.Hour
+)
+
+// revertedError is returned by syncTargets if the rollout of the certificate failed
+// and it was reverted to the previous version, locally as well as in Rancher
+type revertedError struct {
+	cert *letsencrypt.AcmeCertificate
+	err  error
+}
+
+func (e *revertedError) Error() string {
+	return fmt.Sprintf("Reverted certificate to serial %s: %v", e.cert.SerialNumber, e.err)
+}
+
+// isReverted returns true if the certificate was reverted to the previous version
+// by syncTargets, in which case the rejected certificate must not be used further
+func isReverted(err error) bool {
+	_, ok := err.(*revertedError)
+	return ok
+}
+
+// RancherTarget is a Rancher environment the certificate is published to
+type RancherTarget struct {
+	Name   string
+	Client *rancher.Client
+	// ID of the certificate in the environment, empty if it doesn't exist yet
+	CertId string
+	// Load balancers using the certificate when it was last synchronized
+	LoadBalancers []rancher.LoadBalancerRef
+	// The certificate in Rancher is owned by this manager instance
+	Owned bool
+
+	// The certificate could not be published, it's retried on the next reconcile
+	SyncFailed bool
+
+	// Number of times the certificate was found modified outside of this manager
+	DriftCount int
+	LastDrift  time.Time
+}
+
+// InitTargets configures the Rancher environments from environmental variables.
+// The environment of CATTLE_URL is always the first target. Additional targets
+// are listed in RANCHER_TARGETS and configured by <NAME>_CATTLE_URL,
+// <NAME>_CATTLE_ACCESS_KEY and <NAME>_CATTLE_SECRET_KEY. The API keys
+// default to the keys of the default target.
+func (c *Context) InitTargets(accessKey, secretKey string) {
+	c.Targets = []*RancherTarget{{Name: DEFAULT_TARGET, Client: c.Rancher}}
+
+	for _, name := range splitList(getEnvOption("RANCHER_TARGETS", false)) {
+		prefix := strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+		url := getEnvOption(prefix+"CATTLE_URL", true)
+		targetAccessKey := getEnvOption(prefix+"CATTLE_ACCESS_KEY", false)
+		targetSecretKey := getEnvOption(prefix+"CATTLE_SECRET_KEY", false)
+		if len(targetAccessKey) == 0 {
+			targetAccessKey, targetSecretKey = accessKey, secretKey
+		}
+
+		client, err := rancher.NewClient(url, targetAccessKey, targetSecretKey)
+		if err != nil {
+			logrus.Fatalf("Could not connect to Rancher API of target '%s': %v", name, err)
+		}
+
+		logrus.Infof("Publishing certificate to Rancher target '%s' (%s)", name, url)
+		c.Targets = append(c.Targets, &RancherTarget{Name: name, Client: client})
+	}
+}
+
+// syncTargets adds the certificate to all Rancher targets or updates it where the
+// serial number differs. Load balancers using an updated certificate are upgraded.
+// Only a failure of the default target is returned; other targets are retried on
+// the next reconcile.
+func (c *Context) syncTargets(acmeCert *letsencrypt.AcmeCertificate) error {
+	var primaryErr error
+	for _, target := range c.Targets {
+		var err error
+		if c.DryRun {
+			err = c.planTarget(target, acmeCert)
+		} else {
+			err = c.syncTarget(target, acmeCert, false)
+		}
+		if reverted, ok := err.(*revertedError); ok {
+			logrus.Errorf("[%s] %v", target.Name, reverted)
+			c.restoreReverted(reverted.cert)
+			return reverted
+		}
+		target.SyncFailed = err != nil
+		switch {
+		case err == nil:
+		case target.Name == DEFAULT_TARGET:
+			primaryErr = fmt.Errorf("Failed to publish certificate '%s' to Rancher: %v", c.CertificateName, err)
+		default:
+			logrus.Errorf("[%s] Failed to publish certificate '%s', retrying on the next reconcile: %v", target.Name, c.CertificateName, err)
+		}
+	}
+
+	if primaryErr != nil {
+		return primaryErr
+	}
+
+	c.Status.SetCertificate(c.CertificateName, acmeCert.SerialNumber, acmeCert.ExpiryDate)
+	c.triggerVerify()
+	return nil
+}
+
+// restoreReverted publishes the version of the certificate restored after a failed
+// rollout in place of the rejected one and defers the next renewal attempt
+func (c *Context) restoreReverted(acmeCert *letsencrypt.AcmeCertificate) {
+	c.trackCertificate(acmeCert)
+	c.publishCert(acmeCert)
+
+	c.reverting = true
+	defer func() { c.reverting = false }()
+	for _, target := range c.Targets {
+		err := c.syncTarget(target, acmeCert, false)
+		if err != nil {
+			logrus.Errorf("[%s] Failed to restore certificate '%s', retrying on the next reconcile: %v", target.Name, c.CertificateName, err)
+		}
+		target.SyncFailed = err != nil
+	}
+
+	c.RenewalDeferredUntil = time.Now().Add(REVERT_RENEWAL_DELAY)
+	logrus.Warnf("Deferring renewal of reverted certificate '%s' until %s", c.CertificateName,
+		c.RenewalDeferredUntil.In(c.Location).Format("2006/01/02 15:04 MST"))
+	c.Status.SetCertificate(c.CertificateName, acmeCert.SerialNumber, acmeCert.ExpiryDate)
+}
+
+// syncTarget brings the certificate of the target in line with the local certificate.
+// If reconcile is true, the local certificate is expected to be in Rancher already
+// and any difference is reported as drift.
+func (c *Context) syncTarget(target *RancherTarget, acmeCert *letsencrypt.AcmeCertificate, reconcile bool) error {
+	var rancherCert *rancherClient.Certificate
+	var err error
+
+	// Follow the certificate by ID to detect renaming and deletion
+	previousId := target.CertId
+	if len(previousId) > 0 {
+		rancherCert, err = target.Client.FindCertById(previousId)
+		if err != nil {
+			return fmt.Errorf("Could not lookup certificate in Rancher API: %v", err)
+		}
+		if rancherCert == nil {
+			c.reportDrift(target, "certificate %s was deleted", previousId)
+		} else if err := c.checkOwnership(target, rancherCert); err != nil {
+			return err
+		} else if rancherCert.Name != c.CertificateName {
+			c.reportDrift(target, "certificate %s was renamed to '%s'", previousId, rancherCert.Name)
+			if err := target.Client.UpdateCertificateMetadata(previousId, c.CertificateName, ""); err != nil {
+				return fmt.Errorf("Failed to restore name of Rancher certificate %s: %v", previousId, err)
+			}
+			logrus.Infof("[%s] Restored name of Rancher certificate '%s'", target.Name, c.CertificateName)
+		}
+	}
+
+	if rancherCert == nil {
+		rancherCert, err = target.Client.FindCertByName(c.CertificateName)
+		if err != nil {
+			return fmt.Errorf("Could not lookup certificate in Rancher API: %v", err)
+		}
+		if rancherCert != nil {
+			if err := c.checkOwnership(target, rancherCert); err != nil {
+				return err
+			}
+		}
+	}
+
+	if rancherCert == nil {
+		if reconcile && len(previousId) == 0 {
+			c.reportDrift(target, "certificate '%s' is missing", c.CertificateName)
+		}
+		logrus.Debugf("[%s] Adding certificate '%s' to Rancher", target.Name, c.CertificateName)
+		if err := c.addRancherCert(target, acmeCert); err != nil {
+			return err
+		}
+	} else {
+		target.CertId = rancherCert.Id
+		description := c.ownership(acmeCert).String()
+		// Exported files, secrets and hooks are not deferred, only the Rancher certificate
+		if rancherCert.SerialNumber != acmeCert.SerialNumber && c.rolloutDeferred() {
+			logrus.Infof("[%s] Deferring update of Rancher certificate '%s' to the next rollout window at %s", target.Name,
+				c.CertificateName, c.RolloutSchedule.Next(time.Now()).Format("2006/01/02 15:04 MST"))
+			if !c.rolloutPending {
+				c.rolloutPending = true
+				c.rolloutPendingSince = time.Now()
+			}
+			return nil
+		} else if rancherCert.SerialNumber != acmeCert.SerialNumber {
+			if reconcile && !target.SyncFailed {
+				c.reportDrift(target, "serial number %s differs from local certificate %s", rancherCert.SerialNumber, acmeCert.SerialNumber)
+			} else {
+				logrus.Infof("[%s] Serial number mismatch between Rancher and local certificate '%s'", target.Name, c.CertificateName)
+			}
+			if err := c.updateRancherCert(target, acmeCert, rancherCert.SerialNumber); err != nil {
+				return err
+			}
+		} else if rancherCert.Description != description {
+			logrus.Infof("[%s] Updating ownership metadata of Rancher certificate '%s'", target.Name, c.CertificateName)
+			if err := target.Client.UpdateCertificateMetadata(target.CertId, "", description); err != nil {
+				return fmt.Errorf("Failed to update Rancher certificate '%s': %v", c.CertificateName, err)
+			}
+		} else {
+			logrus.Debugf("[%s] Rancher certificate '%s' is up to date", target.Name, c.CertificateName)
+		}
+	}
+
+	// Reattach the load balancers that used a deleted certificate
+	if len(previousId) > 0 && previousId != target.CertId && len(target.LoadBalancers) > 0 {
+		if err := target.Client.RewireLoadBalancers(target.LoadBalancers, previousId, target.CertId); err != nil {
+			return err
+		}
+	}
+
+	if len(c.ShardGroup) > 0 {
+		if err := c.attachShard(target); err != nil {
+			logrus.Errorf("[%s] Failed to attach certificate '%s' to load balancers: %v", target.Name, c.CertificateName, err)
+		}
+	}
+
+	refs, err := target.Client.LoadBalancerRefs(target.CertId)
+	if err != nil {
+		logrus.Warnf("[%s] Failed to look up load balancers using certificate '%s': %v", target.Name, c.CertificateName, err)
+		return nil
+	}
+	target.LoadBalancers = refs
+	return nil
+}
+
+func (c *Context) reportDrift(target *RancherTarget, format string, args ...interface{}) {
+	target.DriftCount++
+	target.LastDrift = time.Now()
+	c.Status.metrics.Add("letsencrypt_rancher_drift_total",
+		"Number of differences between Rancher and the local certificate",
+		map[string]string{"target": target.Name}, 1)
+	logrus.Warnf("[%s] Drift detected: %s", target.Name, fmt.Sprintf(format, args...))
+}
+
+func (c *Context) addRancherCert(target *RancherTarget, acmeCert *letsencrypt.AcmeCertificate) error {
+	description := c.ownership(acmeCert).String()
+	rancherCert, err := target.Client.AddCertificate(c.CertificateName, description, acmeCert.PrivateKey, acmeCert.Certificate)
+	if err != nil {
+		return fmt.Errorf("Failed to add Rancher certificate '%s': %v", c.CertificateName, err)
+	}
+	target.CertId = rancherCert.Id
+	target.Owned = true
+	logrus.Infof("[%s] Certificate '%s' added to Rancher", target.Name, c.CertificateName)
+	return nil
+}
+
+func (c *Context) updateRancherCert(target *RancherTarget, acmeCert *letsencrypt.AcmeCertificate, previousSerial string) error {
+	description := c.ownership(acmeCert).String()
+	err := target.Client.UpdateCertificate(target.CertId, description, acmeCert.PrivateKey, acmeCert.Certificate)
+	if err != nil {
+		return fmt.Errorf("Failed to update Rancher certificate '%s': %v", c.CertificateName, err)
+	}
+	logrus.Infof("[%s] Updated Rancher certificate '%s'", target.Name, c.CertificateName)
+
+	if !c.Rollout.Enabled() {
+		err = target.Client.UpdateLoadBalancers(target.CertId)
+		if err != nil {
+			return fmt.Errorf("Failed to upgrade load balancers: %v", err)
+		}
+		return nil
+	}
+
+	opts := rancher.RolloutOpts{
+		Canary:        c.Rollout.Canary,
+		BatchSize:     c.Rollout.BatchSize,
+		BatchInterval: c.Rollout.BatchInterval,
+	}
+	if c.Rollout.Verify {
+		opts.Verify = c.rolloutVerifier(acmeCert)
+	}
+
+	updated, err := target.Client.RolloutLoadBalancers(target.CertId, opts)
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("Failed to roll out certificate to load balancers: %v", err)
+	logrus.Errorf("[%s] Rollout of certificate '%s' stopped after %d load balancers", target.Name, c.CertificateName, len(updated))
+	if !c.Rollout.Revert || len(updated) == 0 || c.reverting {
+		return err
+	}
+
+	// The rejected version must not be deployed again by a reconcile,
+	// so the local certificate is rolled back first
+	previous, revertErr := c.Acme.Rollback(c.CertificateName, previousSerial, time.Now().Add(REVERT_RENEWAL_DELAY))
+	if revertErr != nil {
+		logrus.Errorf("[%s] Failed to revert certificate '%s': %v", target.Name, c.CertificateName, revertErr)
+		return err
+	}
+	if revertErr := c.revertRancherCert(target, previous); revertErr != nil {
+		// Retried when the restored version is synchronized
+		logrus.Errorf("[%s] Failed to revert Rancher certificate '%s': %v", target.Name, c.CertificateName, revertErr)
+	}
+	return &revertedError{cert: previous, err: err}
+}
+
+// revertRancherCert restores the previous version of the certificate
+// in Rancher and updates all load balancers using it at once
+func (c *Context) revertRancherCert(target *RancherTarget, previous *letsencrypt.AcmeCertificate) error {
+	err := target.Client.UpdateCertificate(target.CertId, c.ownership(previous).String(), previous.PrivateKey, previous.Certificate)
+	if err != nil {
+		return err
+	}
+	if err := target.Client.UpdateLoadBalancers(target.CertId); err != nil {
+		return err
+	}
+
+	logrus.Warnf("[%s] Reverted Rancher certificate '%s' to serial %s", target.Name, c.CertificateName, previous.SerialNumber)
+	return nil
+}
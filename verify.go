@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/letsencrypt"
+)
+
+const (
+	VERIFY_DIAL_TIMEOUT = 10 * time.Second
+	VERIFY_RETRY        = 5 * time.Second
+	// Time given to load balancers to pick up a changed certificate
+	VERIFY_DELAY = 60 * time.Second
+
+	VERIFY_PORT             = 443
+	VERIFY_INTERVAL_MINUTES = 60
+)
+
+// VerifyOpts configures the periodic verification of the deployed certificate
+type VerifyOpts struct {
+	// Connect to each configured domain
+	Domains bool
+	// Connect to the public endpoints of the load balancers using the certificate
+	LoadBalancers bool
+	// Port used to connect to the domains
+	Port     int
+	Interval time.Duration
+}
+
+// Enabled returns true if the deployed certificate is verified
+func (v VerifyOpts) Enabled() bool {
+	return v.Domains || v.LoadBalancers
+}
+
+// fetchServedChain performs a TLS handshake with address using serverName
+// for SNI and returns the certificate chain presented by the server
+func fetchServedChain(address, serverName string) ([]*x509.Certificate, error) {
+	dialer := &net.Dialer{Timeout: VERIFY_DIAL_TIMEOUT}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		ServerName: serverName,
+		// The certificate is compared with the expected one instead
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	chain := conn.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("No certificate presented")
+	}
+	return chain, nil
+}
+
+// checkServedCertificate returns an error unless the server at address presents
+// the certificate and chain of acmeCert for serverName. Returns the served serial.
+func checkServedCertificate(address, serverName string, acmeCert *letsencrypt.AcmeCertificate) (string, error) {
+	chain, err := fetchServedChain(address, serverName)
+	if err != nil {
+		return "", err
+	}
+
+	served := chain[0].SerialNumber.String()
+	if served != acmeCert.SerialNumber {
+		return served, fmt.Errorf("Serves certificate with serial %s instead of %s", served, acmeCert.SerialNumber)
+	}
+
+	expected := pemBlocks(acmeCert.Certificate)
+	if len(chain) != len(expected) {
+		return served, fmt.Errorf("Serves %d certificates in chain instead of %d", len(chain), len(expected))
+	}
+	for i := 1; i < len(chain); i++ {
+		if !bytes.Equal(chain[i].Raw, expected[i]) {
+			return served, fmt.Errorf("Serves unexpected intermediate certificate '%s'", chain[i].Subject.CommonName)
+		}
+	}
+	return served, nil
+}
+
+// pemBlocks returns the DER encoded certificates of a PEM bundle
+func pemBlocks(bundle []byte) [][]byte {
+	var blocks [][]byte
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return blocks
+		}
+		if block.Type == "CERTIFICATE" {
+			blocks = append(blocks, block.Bytes)
+		}
+	}
+}
+
+// verifyServerName returns a host name covered by the certificate to use for SNI
+func verifyServerName(domains []string) string {
+	for _, domain := range domains {
+		if !strings.HasPrefix(domain, "*.") {
+			return domain
+		}
+	}
+	return strings.Replace(domains[0], "*", "www", 1)
+}
+
+// rolloutVerifier returns a function verifying that the endpoints of a load
+// balancer serve the certificate, retrying until the verify timeout expires
+func (c *Context) rolloutVerifier(acmeCert *letsencrypt.AcmeCertificate) func(string, []string) error {
+	serverName := verifyServerName(strings.Split(acmeCert.DnsNames, "|"))
+
+	return func(lbName string, endpoints []string) error {
+		if len(endpoints) == 0 {
+			logrus.Warnf("Can't verify load balancer '%s': No public TLS endpoints", lbName)
+			return nil
+		}
+
+		deadline := time.Now().Add(c.Rollout.VerifyTimeout)
+		for _, address := range endpoints {
+			for {
+				_, err := checkServedCertificate(address, serverName, acmeCert)
+				if err == nil {
+					logrus.Infof("Verified that load balancer '%s' serves serial %s on %s", lbName, acmeCert.SerialNumber, address)
+					break
+				}
+				if time.Now().After(deadline) {
+					return fmt.Errorf("%s: %v", address, err)
+				}
+				logrus.Debugf("Verification of load balancer '%s' pending: %v", lbName, err)
+				time.Sleep(VERIFY_RETRY)
+			}
+		}
+		return nil
+	}
+}
+
+// verifyLoop verifies the deployed certificate every interval and
+// shortly after the certificate has been changed in Rancher
+func (c *Context) verifyLoop(interval time.Duration) {
+	time.Sleep(VERIFY_DELAY)
+	for {
+		c.verifyDeployment()
+
+		select {
+		case <-time.After(interval):
+		case <-c.verifyNow:
+			time.Sleep(VERIFY_DELAY)
+		}
+	}
+}
+
+// triggerVerify schedules a verification of the deployed certificate
+func (c *Context) triggerVerify() {
+	select {
+	case c.verifyNow <- struct{}{}:
+	default:
+	}
+}
+
+// verifyDeployment performs TLS handshakes with the configured endpoints and
+// reports those not serving the locally stored certificate
+func (c *Context) verifyDeployment() {
+	c.mu.Lock()
+	if c.rolloutPending {
+		c.mu.Unlock()
+		logrus.Debugf("Not verifying certificate '%s' while its rollout is deferred", c.CertificateName)
+		return
+	}
+	ok, acmeCert := c.storedCertificate()
+	endpoints := c.verifyEndpoints()
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	results := make([]VerifyResult, 0, len(endpoints))
+	failed := 0
+	for _, result := range endpoints {
+		serial, err := checkServedCertificate(result.Endpoint, result.ServerName, acmeCert)
+		result.Serial = serial
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+			logrus.Errorf("Verification of %s (%s) failed: %v", result.Endpoint, result.ServerName, err)
+		} else {
+			logrus.Debugf("Verified that %s (%s) serves serial %s", result.Endpoint, result.ServerName, serial)
+		}
+		results = append(results, result)
+	}
+
+	c.Status.SetVerification(c.CertificateName, results)
+	if failed == 0 {
+		logrus.Infof("Verified that %d endpoints serve certificate '%s'", len(results), c.CertificateName)
+	}
+}
+
+// verifyEndpoints returns the endpoints to verify without the results
+func (c *Context) verifyEndpoints() []VerifyResult {
+	var endpoints []VerifyResult
+
+	if c.Verify.Domains {
+		port := strconv.Itoa(c.Verify.Port)
+		for _, domain := range c.Domains {
+			if strings.HasPrefix(domain, "*.") {
+				continue
+			}
+			endpoints = append(endpoints, VerifyResult{
+				Endpoint:   net.JoinHostPort(domain, port),
+				ServerName: domain,
+			})
+		}
+	}
+
+	if c.Verify.LoadBalancers {
+		serverName := verifyServerName(c.Domains)
+		for _, target := range c.Targets {
+			if len(target.CertId) == 0 {
+				continue
+			}
+			lbs, err := target.Client.LoadBalancerEndpoints(target.CertId)
+			if err != nil {
+				logrus.Errorf("[%s] Could not look up load balancer endpoints: %v", target.Name, err)
+				continue
+			}
+			var names []string
+			for name := range lbs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				for _, address := range lbs[name] {
+					endpoints = append(endpoints, VerifyResult{
+						Endpoint:     address,
+						ServerName:   serverName,
+						LoadBalancer: target.Name + "/" + name,
+					})
+				}
+			}
+		}
+	}
+
+	return endpoints
+}
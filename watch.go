@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/janeczku/rancher-letsencrypt/rancher"
+	rancherClient "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	WATCH_RETRY_MIN = 5 * time.Second
+	WATCH_RETRY_MAX = 5 * time.Minute
+)
+
+// reconcileLoop periodically compares the certificates of all
+// Rancher targets with the local certificate and repairs them
+func (c *Context) reconcileLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		logrus.Debugf("Reconciling certificate '%s'", c.CertificateName)
+		for _, target := range c.Targets {
+			c.reconcileTarget(target)
+		}
+	}
+}
+
+// watchTargets subscribes to the events of all Rancher targets and reconciles
+// a target as soon as the managed certificate or the set of load balancers
+// using it is changed
+func (c *Context) watchTargets() {
+	for _, target := range c.Targets {
+		go c.watch(target)
+	}
+}
+
+func (c *Context) watch(target *RancherTarget) {
+	retry := WATCH_RETRY_MIN
+	for {
+		start := time.Now()
+		err := target.Client.Watch(func(event rancher.Event) {
+			c.handleEvent(target, event)
+		})
+
+		// Reset the backoff if the subscription was working for a while
+		if time.Since(start) > WATCH_RETRY_MAX {
+			retry = WATCH_RETRY_MIN
+		}
+		logrus.Warnf("[%s] %v: Resubscribing in %s", target.Name, err, retry)
+		time.Sleep(retry)
+
+		retry *= 2
+		if retry > WATCH_RETRY_MAX {
+			retry = WATCH_RETRY_MAX
+		}
+
+		// Changes may have been missed while not subscribed
+		c.reconcileTarget(target)
+	}
+}
+
+func (c *Context) handleEvent(target *RancherTarget, event rancher.Event) {
+	switch event.ResourceType {
+	case "certificate":
+	case rancherClient.LOAD_BALANCER_SERVICE_TYPE:
+		c.handleLoadBalancerEvent(target, event)
+		return
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	relevant := event.ResourceId == target.CertId || event.Name == c.CertificateName
+	c.mu.Unlock()
+	if !relevant {
+		return
+	}
+
+	// Wait for transitions to finish, the final state triggers another event
+	if event.State != "active" && event.State != "removed" {
+		return
+	}
+
+	logrus.Debugf("[%s] Certificate '%s' changed in Rancher (%s)", target.Name, event.Name, event.State)
+	c.reconcileTarget(target)
+}
+
+// handleLoadBalancerEvent reconciles the target if a load balancer started
+// or stopped using the certificate, e.g. to update the tracked load balancers
+// or to attach the certificates of a shard group again
+func (c *Context) handleLoadBalancerEvent(target *RancherTarget, event rancher.Event) {
+	c.mu.Lock()
+	certId := target.CertId
+	c.mu.Unlock()
+
+	for _, id := range event.CertificateIds {
+		if len(certId) > 0 && id == certId {
+			logrus.Debugf("[%s] Load balancer '%s' changed its use of certificate '%s'", target.Name, event.Name, c.CertificateName)
+			c.reconcileTarget(target)
+			return
+		}
+	}
+}
+
+// reconcileTarget repairs the certificate of the target from the local certificate
+func (c *Context) reconcileTarget(target *RancherTarget) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ok, acmeCert := c.storedCertificate()
+	if !ok {
+		logrus.Warnf("[%s] Can't reconcile certificate '%s': No local certificate", target.Name, c.CertificateName)
+		return
+	}
+
+	err := c.syncTarget(target, acmeCert, true)
+	if err != nil {
+		logrus.Errorf("[%s] Failed to reconcile certificate '%s': %v", target.Name, c.CertificateName, err)
+	} else if target.SyncFailed {
+		logrus.Infof("[%s] Published certificate '%s' after an earlier failure", target.Name, c.CertificateName)
+	}
+	target.SyncFailed = err != nil
+}